@@ -13,10 +13,8 @@ replace go.etcd.io/etcd/client/v3 => github.com/HariKube/etcd/client/v3 v3.0.0-2
 replace go.etcd.io/etcd/server/v3 => github.com/HariKube/etcd/server/v3 v3.0.0-20260804095457-e55f908d87ac
 
 require (
-	github.com/Code-Hex/go-generics-cache v1.5.1
 	github.com/Rican7/retry v0.3.1
 	github.com/alphadose/haxmap v1.4.1
-	github.com/gertd/go-pluralize v0.2.1
 	github.com/go-sql-driver/mysql v1.10.0
 	github.com/golang/protobuf v1.5.4
 	github.com/jackc/pgerrcode v0.0.0-20240316143900-6e2875d9b438
@@ -41,6 +39,7 @@ require (
 	go.uber.org/zap v1.27.1
 	google.golang.org/grpc v1.81.1
 	k8s.io/api v0.35.4
+	k8s.io/apiextensions-apiserver v0.35.4
 	k8s.io/apimachinery v0.35.4
 	k8s.io/apiserver v0.35.4
 	k8s.io/client-go v0.35.4
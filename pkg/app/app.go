@@ -3,7 +3,10 @@ package app
 import (
 	"fmt"
 	"io/ioutil"
+	"maps"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -195,6 +198,19 @@ func New() *cli.App {
 			Value:       1000,
 			EnvVars:     []string{"KINE_COMPACT_MIN_RETAIN"},
 		},
+		&cli.DurationFlag{
+			Name:        "compact-retain-duration",
+			Usage:       "Wall-clock duration of history to retain when compacting automatically; revisions committed longer ago are compacted. Default is 0, to compact to the revision current at the previous compaction.",
+			Destination: &config.CompactRetainDuration,
+			Value:       0,
+			EnvVars:     []string{"KINE_COMPACT_RETAIN_DURATION"},
+		},
+		&cli.GenericFlag{
+			Name:    "compact-retain-prefix",
+			Usage:   "Wall-clock duration of history to retain when compacting automatically the keys under a prefix, as PREFIX=DURATION, e.g. /registry/events/=0s. May be repeated or comma-separated. Prefixes never retain more history than the other keys, and are not held to --compact-min-retain.",
+			Value:   retainPrefixes{&config.CompactRetainPrefixes},
+			EnvVars: []string{"KINE_COMPACT_RETAIN_PREFIX"},
+		},
 		&cli.Int64Flag{
 			Name:        "compact-batch-size",
 			Usage:       "Number of revisions to compact in a single batch. Default is 1000.",
@@ -209,6 +225,65 @@ func New() *cli.App {
 			Value:       500,
 			EnvVars:     []string{"KINE_POLL_BATCH_SIZE"},
 		},
+		&cli.StringFlag{
+			Name:        "extra-fields-file",
+			Usage:       "JSON file mapping key prefixes to fields to index for field selectors, by name and JSONPath, e.g. {\"/registry/pods/\": {\"spec.priorityClassName\": \"$.spec.priorityClassName\"}}.",
+			Destination: &config.ExtraFieldsFile,
+			EnvVars:     []string{"KINE_EXTRA_FIELDS_FILE"},
+		},
+		&cli.BoolFlag{
+			Name:        "current-metadata-only",
+			Usage:       "Index the labels and fields of only the latest revision of each key for selectors, and match selectors at past revisions by decoding values. Revisions written in this mode are not indexed for past revisions if it is turned off again.",
+			Destination: &config.CurrentMetadataOnly,
+			EnvVars:     []string{"KINE_CURRENT_METADATA_ONLY"},
+		},
+		&cli.Int64Flag{
+			Name:        "gc-max-objects-per-transaction",
+			Usage:       "Number of dependents the garbage collector writes in a single transaction; the other dependents of an owner are collected in further transactions. Default is 1000.",
+			Destination: &config.GCMaxObjects,
+			Value:       1000,
+			EnvVars:     []string{"KINE_GC_MAX_OBJECTS_PER_TRANSACTION"},
+		},
+		&cli.DurationFlag{
+			Name:        "gc-interval",
+			Usage:       "Interval between runs of the garbage collection of the dependents of deleted owners, which are queued in the datastore and collected by one kine at a time. Default is 1s.",
+			Destination: &config.GCInterval,
+			Value:       endpoint.DefaultGCInterval,
+			EnvVars:     []string{"KINE_GC_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:        "gc-disable",
+			Usage:       "Leave the garbage collection of the dependents of deleted owners to other kines sharing the datastore.",
+			Destination: &config.GCDisabled,
+			EnvVars:     []string{"KINE_GC_DISABLE"},
+		},
+		&cli.DurationFlag{
+			Name:        "gc-sweep-interval",
+			Usage:       "Interval between sweeps for owners that no longer exist but are still referenced by objects garbage collected by kine, which are then queued for garbage collection. Set 0 to disable. Default is 10m.",
+			Destination: &config.GCSweepInterval,
+			Value:       10 * time.Minute,
+			EnvVars:     []string{"KINE_GC_SWEEP_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:        "gc-sweep-dry-run",
+			Usage:       "Only report the owners found by sweeps for dangling owners, without queueing them for garbage collection.",
+			Destination: &config.GCSweepDryRun,
+			EnvVars:     []string{"KINE_GC_SWEEP_DRY_RUN"},
+		},
+		&cli.DurationFlag{
+			Name:        "reindex-interval",
+			Usage:       "Interval between checks for metadata indexed with an outdated configuration, which is then rebuilt in the background. Set 0 to disable. Default is 1m.",
+			Destination: &config.ReindexInterval,
+			Value:       time.Minute,
+			EnvVars:     []string{"KINE_REINDEX_INTERVAL"},
+		},
+		&cli.Int64Flag{
+			Name:        "reindex-batch-size",
+			Usage:       "Number of keys to reindex in a single transaction. Default is 100.",
+			Destination: &config.ReindexBatchSize,
+			Value:       100,
+			EnvVars:     []string{"KINE_REINDEX_BATCH_SIZE"},
+		},
 		&cli.StringFlag{
 			Name:        "peer-bind-address",
 			Usage:       "gRPC listen address (host:port) for the t4 peer WAL-streaming server. Empty means single-node mode. Example: 0.0.0.0:3380.",
@@ -281,6 +356,21 @@ func New() *cli.App {
 			EnvVars: []string{"KINE_DEBUG"},
 		},
 	}
+	app.Commands = []*cli.Command{
+		{
+			Name:      "reindex",
+			Usage:     "Rebuild the labels, fields and owners indexed for the keys under a prefix, then exit.",
+			UsageText: "kine [global options] reindex [--prefix PREFIX]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "prefix",
+					Usage: "Key prefix to reindex. Default is every key.",
+					Value: "/",
+				},
+			},
+			Action: reindex,
+		},
+	}
 	app.Action = run
 	return app
 }
@@ -290,6 +380,57 @@ func run(c *cli.Context) (rerr error) {
 		return fmt.Errorf("%s does not accept positional arguments, only flags", c.App.Name)
 	}
 
+	if err := setupLogging(c); err != nil {
+		return err
+	}
+
+	ctx := signals.SetupSignalContext()
+
+	if !metricsIgnoreTLSConfig {
+		metricsConfig.ServerTLSConfig = config.ServerTLSConfig
+	}
+	config.MetricsRegisterer = metrics.Registry
+	metrics.RegisterCoreCollectors()
+
+	config.WaitGroup = &sync.WaitGroup{}
+	_, err := endpoint.Listen(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	go metrics.Serve(ctx, metricsConfig)
+
+	// Wait for WaitGroup to finish before exiting, and capture error from
+	// context if it is not already set.
+	defer func() {
+		config.WaitGroup.Wait()
+		if rerr == nil {
+			rerr = ctx.Err()
+		}
+	}()
+
+	return nil
+}
+
+func reindex(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		return fmt.Errorf("%s %s does not accept positional arguments, only flags", c.App.Name, c.Command.Name)
+	}
+
+	if err := setupLogging(c); err != nil {
+		return err
+	}
+
+	ctx := signals.SetupSignalContext()
+
+	// wait for the database connections to close before exiting
+	config.WaitGroup = &sync.WaitGroup{}
+	defer config.WaitGroup.Wait()
+
+	return endpoint.Reindex(ctx, config, c.String("prefix"))
+}
+
+func setupLogging(c *cli.Context) error {
 	if config.LogFormat == "plain" {
 		logrus.SetFormatter(&logrus.TextFormatter{
 			ForceColors:     true,
@@ -318,34 +459,47 @@ func run(c *cli.Context) (rerr error) {
 	logrus.AddHook(&writer.Hook{Writer: os.Stderr, LogLevels: []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}})
 	logrus.AddHook(&writer.Hook{Writer: os.Stdout, LogLevels: []logrus.Level{logrus.DebugLevel, logrus.TraceLevel}})
 
-	ctx := signals.SetupSignalContext()
-
-	if !metricsIgnoreTLSConfig {
-		metricsConfig.ServerTLSConfig = config.ServerTLSConfig
-	}
-	config.MetricsRegisterer = metrics.Registry
-	metrics.RegisterCoreCollectors()
-
-	config.WaitGroup = &sync.WaitGroup{}
-	_, err := endpoint.Listen(ctx, config)
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	go metrics.Serve(ctx, metricsConfig)
+// retainPrefixes parses the values of --compact-retain-prefix into the retain duration
+// of each key prefix.
+type retainPrefixes struct {
+	durations *map[string]time.Duration
+}
 
-	// Wait for WaitGroup to finish before exiting, and capture error from
-	// context if it is not already set.
-	defer func() {
-		config.WaitGroup.Wait()
-		if rerr == nil {
-			rerr = ctx.Err()
+func (r retainPrefixes) Set(value string) error {
+	for _, policy := range strings.Split(value, ",") {
+		prefix, duration, ok := strings.Cut(strings.TrimSpace(policy), "=")
+		if !ok || prefix == "" {
+			return fmt.Errorf("invalid retain policy %q: expected PREFIX=DURATION", policy)
 		}
-	}()
-
+		retain, err := time.ParseDuration(duration)
+		if err != nil {
+			return fmt.Errorf("invalid retain duration for %s: %w", prefix, err)
+		}
+		if retain < 0 {
+			return fmt.Errorf("invalid retain duration for %s: %s is negative", prefix, duration)
+		}
+		if *r.durations == nil {
+			*r.durations = map[string]time.Duration{}
+		}
+		(*r.durations)[prefix] = retain
+	}
 	return nil
 }
 
+func (r retainPrefixes) String() string {
+	if r.durations == nil {
+		return ""
+	}
+	policies := []string{}
+	for _, prefix := range slices.Sorted(maps.Keys(*r.durations)) {
+		policies = append(policies, prefix+"="+(*r.durations)[prefix].String())
+	}
+	return strings.Join(policies, ",")
+}
+
 // Config returns the endpoint config provided by parsing the provided CLI flags.
 func Config(args []string) endpoint.Config {
 	a := New()
@@ -0,0 +1,122 @@
+// Package crds keeps the selectable fields of custom resources in sync with the
+// CustomResourceDefinitions stored in any server.Backend.
+//
+// The registry in pkg/util is not persisted: Load rebuilds it from the CRD rows at
+// startup, and Run follows the CRDs written after that with a watch, so that every
+// kine instance sharing a datastore indexes custom resources with the same fields
+// regardless of which instance the CRD was written through.
+package crds
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	Prefix = "/registry/apiextensions.k8s.io/customresourcedefinitions/"
+	end    = "/registry/apiextensions.k8s.io/customresourcedefinitions0"
+
+	// listPageSize is the page size used when loading the stored CRDs.
+	listPageSize = 1000
+	// retryInterval is how long we wait before reloading after a failed watch.
+	retryInterval = time.Second
+)
+
+// Load replaces the registry with the selectable fields of every CRD stored in b, and
+// returns the revision they were listed at.
+func Load(ctx context.Context, b server.Backend) (int64, error) {
+	rawDefs := [][]byte{}
+
+	rev, kvs, err := b.List(ctx, Prefix, end, listPageSize, 0, false, "", "")
+	if err != nil {
+		return rev, err
+	}
+	for len(kvs) > 0 {
+		for _, kv := range kvs {
+			rawDefs = append(rawDefs, kv.Value)
+		}
+		if int64(len(kvs)) < listPageSize {
+			break
+		}
+		_, kvs, err = b.List(ctx, kvs[len(kvs)-1].Key+"\x00", end, listPageSize, rev, false, "", "")
+		if err != nil {
+			return rev, err
+		}
+	}
+
+	if err := util.ResetCustomResourceDefinitions(rawDefs); err != nil {
+		logrus.Warnf("Some custom resource definitions could not be registered: %v", err)
+	}
+	logrus.Infof("Loaded %d custom resource definitions at revision %d", len(rawDefs), rev)
+
+	return rev, nil
+}
+
+// Run registers the CRDs written to b after rev, and unregisters the ones deleted,
+// until ctx is done. If the watch fails, for instance because rev has been compacted,
+// the registry is loaded again and followed from there.
+func Run(ctx context.Context, b server.Backend, rev int64) {
+	for {
+		if err := watch(ctx, b, rev); err != nil {
+			logrus.Warnf("Custom resource definition watch failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+
+		var err error
+		if rev, err = Load(ctx, b); err != nil && !errors.Is(err, context.Canceled) {
+			logrus.Errorf("Custom resource definition reload failed: %v", err)
+		}
+	}
+}
+
+// watch follows the CRDs written and deleted after rev until ctx is done or the watch
+// ends.
+func watch(ctx context.Context, b server.Backend, rev int64) error {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wr := b.Watch(wctx, Prefix, end, rev+1, "", "")
+	if wr.CompactRevision != 0 {
+		return server.ErrCompacted
+	}
+
+	errc := wr.Errorc
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-errc:
+			if !ok {
+				errc = nil
+			} else if err != nil {
+				return err
+			}
+		case events, ok := <-wr.Events:
+			if !ok {
+				return errors.New("watch channel closed")
+			}
+			for _, event := range events {
+				if event.KV == nil {
+					continue
+				}
+				if event.Delete {
+					util.UnregisterCustomResourceDefinition(event.KV.Key)
+					continue
+				}
+				if err := util.RegisterCustomResourceDefinition(event.KV.Value); err != nil {
+					logrus.Warnf("Failed to register custom resource definition %s: %v", event.KV.Key, err)
+				}
+			}
+		}
+	}
+}
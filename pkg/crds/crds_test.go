@@ -0,0 +1,161 @@
+package crds_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/crds"
+	"github.com/k3s-io/kine/pkg/internal/testutil"
+	"github.com/k3s-io/kine/pkg/util"
+)
+
+func TestCustomResourceDefinitionsAreLoadedAndWatched(t *testing.T) {
+	ctx, backend := testutil.NewBackend(t)
+	t.Cleanup(func() {
+		_ = util.ResetCustomResourceDefinitions(nil)
+	})
+
+	crd := func(plural, kind string) []byte {
+		return []byte(`{"apiVersion":"apiextensions.k8s.io/v1","kind":"CustomResourceDefinition",` +
+			`"metadata":{"name":"` + plural + `.example.com"},` +
+			`"spec":{"group":"example.com","names":{"plural":"` + plural + `","kind":"` + kind + `"},` +
+			`"versions":[{"name":"v1","served":true,"storage":true,"selectableFields":[{"jsonPath":".spec.color"}]}]}}`)
+	}
+	createCR := func(plural, kind, name, color string) {
+		t.Helper()
+		key := "/registry/example.com/" + plural + "/default/" + name
+		value := `{"apiVersion":"example.com/v1","kind":"` + kind + `","metadata":{"namespace":"default","name":"` + name + `"},"spec":{"color":"` + color + `"}}`
+		if _, err := backend.Create(ctx, key, []byte(value), 0); err != nil {
+			t.Fatalf("failed to create %s: %v", key, err)
+		}
+	}
+	listCRs := func(plural, fieldSelector string) []string {
+		t.Helper()
+		prefix := "/registry/example.com/" + plural + "/"
+		_, kvs, err := backend.List(ctx, prefix, strings.TrimSuffix(prefix, "/")+"0", 0, 0, false, "", fieldSelector)
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		listed := []string{}
+		for _, kv := range kvs {
+			listed = append(listed, kv.Key)
+		}
+		return listed
+	}
+
+	// written straight to the backend, as through another instance
+	if _, err := backend.Create(ctx, crds.Prefix+"widgets.example.com", crd("widgets", "Widget"), 0); err != nil {
+		t.Fatalf("failed to create crd: %v", err)
+	}
+
+	rev, err := crds.Load(ctx, backend)
+	if err != nil {
+		t.Fatalf("failed to load crds: %v", err)
+	}
+	go crds.Run(ctx, backend, rev)
+
+	createCR("widgets", "Widget", "red", "red")
+	createCR("widgets", "Widget", "blue", "blue")
+	if want, got := []string{"/registry/example.com/widgets/default/red"}, listCRs("widgets", "spec.color=red"); !slices.Equal(want, got) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if _, err := backend.Create(ctx, crds.Prefix+"gadgets.example.com", crd("gadgets", "Gadget"), 0); err != nil {
+		t.Fatalf("failed to create crd: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(util.GetCustomResourceDefinitions(), "example.com/gadgets") {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the gadgets crd to be registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	createCR("gadgets", "Gadget", "green", "green")
+	createCR("gadgets", "Gadget", "blue", "blue")
+	if want, got := []string{"/registry/example.com/gadgets/default/green"}, listCRs("gadgets", "spec.color=green"); !slices.Equal(want, got) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestCustomResourceDefinitionLifecycle(t *testing.T) {
+	ctx, backend := testutil.NewBackend(t)
+	t.Cleanup(func() {
+		_ = util.ResetCustomResourceDefinitions(nil)
+	})
+
+	const (
+		crdKey = crds.Prefix + "cacti.example.com"
+		prefix = "/registry/example.com/cacti/"
+	)
+	crd := []byte(`{"apiVersion":"apiextensions.k8s.io/v1","kind":"CustomResourceDefinition",` +
+		`"metadata":{"name":"cacti.example.com"},` +
+		`"spec":{"group":"example.com","names":{"plural":"cacti","kind":"Cactus"},"versions":[` +
+		`{"name":"v1","served":true,"storage":true,"selectableFields":[{"jsonPath":".spec.color"}]},` +
+		`{"name":"v1beta1","served":true,"storage":false,"selectableFields":[{"jsonPath":".spec.size"}]},` +
+		`{"name":"v1alpha1","served":false,"storage":false,"selectableFields":[{"jsonPath":".spec.secret"}]}]}}`)
+	createCR := func(name string) {
+		t.Helper()
+		value := `{"apiVersion":"example.com/v1","kind":"Cactus","metadata":{"namespace":"default","name":"` + name + `"},` +
+			`"spec":{"color":"green","size":"small","secret":"x"}}`
+		if _, err := backend.Create(ctx, prefix+"default/"+name, []byte(value), 0); err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+	}
+	expectList := func(fieldSelector string, want ...string) {
+		t.Helper()
+		_, kvs, err := backend.List(ctx, prefix, "/registry/example.com/cacti0", 0, 0, false, "", fieldSelector)
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		listed := []string{}
+		for _, kv := range kvs {
+			listed = append(listed, strings.TrimPrefix(kv.Key, prefix+"default/"))
+		}
+		if want == nil {
+			want = []string{}
+		}
+		if !slices.Equal(want, listed) {
+			t.Errorf("list %q: expected %v, got %v", fieldSelector, want, listed)
+		}
+	}
+	waitFor := func(registered bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for slices.Contains(util.GetCustomResourceDefinitions(), "example.com/cacti") != registered {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the crd to be registered=%v", registered)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	rev, err := crds.Load(ctx, backend)
+	if err != nil {
+		t.Fatalf("failed to load crds: %v", err)
+	}
+	go crds.Run(ctx, backend, rev)
+
+	// the plural is taken from the crd, not guessed from the kind
+	crdRev, err := backend.Create(ctx, crdKey, crd, 0)
+	if err != nil {
+		t.Fatalf("failed to create crd: %v", err)
+	}
+	waitFor(true)
+
+	// the fields of every served version are indexed, and those of others are not
+	createCR("first")
+	expectList("spec.color=green", "first")
+	expectList("spec.size=small", "first")
+	expectList("spec.secret=x")
+
+	// deleted crds are unregistered, from the watch as well
+	if _, _, _, err := backend.Delete(ctx, crdKey, crdRev); err != nil {
+		t.Fatalf("failed to delete crd: %v", err)
+	}
+	waitFor(false)
+	createCR("second")
+	expectList("spec.color=green", "first")
+}
@@ -19,8 +19,12 @@ type Config struct {
 	CompactIntervalJitter int
 	CompactTimeout        time.Duration
 	CompactMinRetain      int64
+	CompactRetainDuration time.Duration
+	CompactRetainPrefixes map[string]time.Duration
 	CompactBatchSize      int64
 	PollBatchSize         int64
+	CurrentMetadataOnly   bool
+	GCMaxObjects          int64
 	PeerConfig            PeerConfig
 	S3Config              S3Config
 }
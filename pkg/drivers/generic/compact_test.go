@@ -0,0 +1,191 @@
+package generic_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/internal/testutil"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func TestCommitTimesTranslateToRevisions(t *testing.T) {
+	ctx, backend := testutil.NewBackend(t)
+	resolver, ok := backend.(server.RevisionResolver)
+	if !ok {
+		t.Fatal("expected the backend to resolve revisions by commit time")
+	}
+
+	key := "/test/commit-times"
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	createRev, err := backend.Create(ctx, key, []byte(`{"value":"created"}`), 0)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", key, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	updateRev, _, _, err := backend.Update(ctx, key, []byte(`{"value":"updated"}`), createRev, 0)
+	if err != nil {
+		t.Fatalf("failed to update %s: %v", key, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	after := time.Now()
+
+	for _, tc := range []struct {
+		name  string
+		at    time.Time
+		rev   int64
+		value string
+	}{
+		{name: "between", at: between, rev: createRev, value: `{"value":"created"}`},
+		{name: "after", at: after, rev: updateRev, value: `{"value":"updated"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rev, err := resolver.RevisionAt(ctx, tc.at)
+			if err != nil {
+				t.Fatalf("failed to get revision: %v", err)
+			}
+			if rev != tc.rev {
+				t.Fatalf("expected revision %d, got %d", tc.rev, rev)
+			}
+			_, kv, err := backend.Get(ctx, key, rev, false)
+			if err != nil {
+				t.Fatalf("failed to get %s at %d: %v", key, rev, err)
+			}
+			if kv == nil || string(kv.Value) != tc.value {
+				t.Errorf("expected %s to be %q at %d, got %v", key, tc.value, rev, kv)
+			}
+		})
+	}
+
+	t.Run("before", func(t *testing.T) {
+		rev, err := resolver.RevisionAt(ctx, before)
+		if err != nil {
+			t.Fatalf("failed to get revision: %v", err)
+		}
+		if rev >= createRev {
+			t.Errorf("expected a revision before %d, got %d", createRev, rev)
+		}
+	})
+}
+
+func TestRetainDurationCompaction(t *testing.T) {
+	const retain = time.Second
+	ctx, backend, _ := testutil.StartBackend(t, &drivers.Config{
+		CompactInterval:       50 * time.Millisecond,
+		CompactTimeout:        5 * time.Second,
+		CompactRetainDuration: retain,
+		CompactBatchSize:      1000,
+		PollBatchSize:         500,
+	})
+
+	key := "/test/retained"
+	start := time.Now()
+	oldRev, err := backend.Create(ctx, key, []byte(`{"value":"old"}`), 0)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", key, err)
+	}
+	newRev, _, _, err := backend.Update(ctx, key, []byte(`{"value":"new"}`), oldRev, 0)
+	if err != nil {
+		t.Fatalf("failed to update %s: %v", key, err)
+	}
+
+	// The replaced revision is kept for the retain duration, then compacted.
+	for {
+		_, _, err := backend.Get(ctx, key, oldRev, false)
+		if err == server.ErrCompacted {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to get %s at %d: %v", key, oldRev, err)
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("expected revision %d to be compacted", oldRev)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < retain {
+		t.Errorf("expected revision %d to be retained for %s, compacted after %s", oldRev, retain, elapsed)
+	}
+
+	_, kv, err := backend.Get(ctx, key, newRev, false)
+	if err != nil {
+		t.Fatalf("failed to get %s at %d: %v", key, newRev, err)
+	}
+	if kv == nil || string(kv.Value) != `{"value":"new"}` {
+		t.Errorf("expected %s to be %q, got %v", key, `{"value":"new"}`, kv)
+	}
+}
+
+func TestCompactRetainPrefixes(t *testing.T) {
+	ctx, backend, _ := testutil.StartBackend(t, &drivers.Config{
+		CompactInterval:       50 * time.Millisecond,
+		CompactTimeout:        5 * time.Second,
+		CompactMinRetain:      1000,
+		CompactRetainDuration: time.Hour,
+		// the prefix is compacted regardless of the revisions retained for the
+		// other keys
+		CompactRetainPrefixes: map[string]time.Duration{"/test/events/": 0},
+		CompactBatchSize:      1000,
+		PollBatchSize:         500,
+	})
+
+	write := func(key string) (int64, int64) {
+		t.Helper()
+		oldRev, err := backend.Create(ctx, key, []byte(`{"value":"old"}`), 0)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", key, err)
+		}
+		newRev, _, _, err := backend.Update(ctx, key, []byte(`{"value":"new"}`), oldRev, 0)
+		if err != nil {
+			t.Fatalf("failed to update %s: %v", key, err)
+		}
+		return oldRev, newRev
+	}
+	eventRev, _ := write("/test/events/a")
+	podRev, _ := write("/test/pods/a")
+	if _, err := backend.Create(ctx, "/test/events/b", []byte(`{"value":"old"}`), 0); err != nil {
+		t.Fatalf("failed to create /test/events/b: %v", err)
+	}
+	if _, _, _, err := backend.Delete(ctx, "/test/events/b", 0); err != nil {
+		t.Fatalf("failed to delete /test/events/b: %v", err)
+	}
+
+	// the prefix is compacted past the history of both keys once the revisions are
+	// polled, so a list including it is compacted at either
+	start := time.Now()
+	for {
+		_, _, err := backend.List(ctx, "/test/", "/test0", 0, podRev, false, "", "")
+		if err == server.ErrCompacted {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to list /test/ at %d: %v", podRev, err)
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("expected a list including /test/events/ at %d to be compacted", podRev)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, _, err := backend.Get(ctx, "/test/events/a", eventRev, false); err != server.ErrCompacted {
+		t.Errorf("expected /test/events/a at %d to be compacted, got %v", eventRev, err)
+	}
+
+	_, kv, err := backend.Get(ctx, "/test/pods/a", podRev, false)
+	if err != nil {
+		t.Fatalf("failed to get /test/pods/a at %d: %v", podRev, err)
+	}
+	if kv == nil || string(kv.Value) != `{"value":"old"}` {
+		t.Errorf("expected the history of /test/pods/a to be retained, got %v", kv)
+	}
+
+	_, kvs, err := backend.List(ctx, "/test/events/", "/test/events0", 0, 0, false, "", "")
+	if err != nil {
+		t.Fatalf("failed to list /test/events/: %v", err)
+	}
+	if len(kvs) != 1 || kvs[0].Key != "/test/events/a" || string(kvs[0].Value) != `{"value":"new"}` {
+		t.Errorf("expected only the latest revision of /test/events/a to be listed, got %v", kvs)
+	}
+}
@@ -0,0 +1,534 @@
+package generic
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// explicit interface check
+var _ server.GarbageCollector = (*Generic)(nil)
+
+// errGCLeaseLost is returned when the garbage collection lease has been taken over by
+// another kine sharing the datastore while collecting.
+var errGCLeaseLost = errors.New("garbage collection lease was lost")
+
+// gcLabel marks the objects whose dependents are garbage collected by kine, rather
+// than by the controller manager.
+const gcLabel = "skip-controller-manager-metadata-caching"
+
+const (
+	// defaultGCMaxObjects is the number of dependents a single transaction collects
+	// when Generic.GCMaxObjects is not set.
+	defaultGCMaxObjects = 1000
+	// gcQueueBatchSize is the number of queued owners read at a time.
+	gcQueueBatchSize = 100
+	// gcLeaseName names the lease held by the kine collecting garbage, among those
+	// sharing the datastore.
+	gcLeaseName = "gc"
+	// gcLeaseDuration is how long the lease is held for once acquired or renewed.
+	gcLeaseDuration = 30 * time.Second
+	// sweepLeaseName names the lease held by the kine sweeping for dangling owners.
+	sweepLeaseName = "gc-sweep"
+	// sweepReportedKeys is the number of dependents reported for each dangling owner.
+	sweepReportedKeys = 10
+)
+
+// leaseHolder identifies this kine among those sharing the datastore.
+var leaseHolder = func() string {
+	hostname, _ := os.Hostname()
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hostname + "-" + hex.EncodeToString(b)
+}()
+
+// gcState is the garbage collection done by one transaction.
+type gcState struct {
+	// visited holds the objects whose dependents are being or have been collected, so
+	// that ownership cycles are followed only once
+	visited map[types.UID]bool
+	// remaining is the number of dependents that may still be written, out of limit
+	remaining int64
+	limit     int64
+	exhausted bool
+}
+
+// gcItem is an owner queued for the garbage collection of its dependents.
+type gcItem struct {
+	id         int64
+	owner      types.UID
+	orphan     bool
+	foreground bool
+	enqueued   int64
+}
+
+// dependent is the latest revision of an object with an owner reference.
+type dependent struct {
+	id                 int64
+	key                string
+	uid                types.UID
+	createRevision     int64
+	value              []byte
+	blockOwnerDeletion bool
+}
+
+// CollectGarbage collects the dependents of the queued owners until the queue is
+// empty, each owner in transactions of its own of at most GCMaxObjects dependents.
+// Nothing is collected unless this kine holds the garbage collection lease.
+func (d *Generic) CollectGarbage(ctx context.Context) error {
+	var depth int64
+	if err := d.queryRow(ctx, d.CountGCSQL).Scan(&depth); err != nil {
+		return err
+	}
+	metrics.GCQueueDepth.Set(float64(depth))
+	if depth == 0 {
+		return nil
+	}
+
+	lastID := int64(0)
+	for {
+		if leader, err := d.acquireLease(ctx, gcLeaseName, gcLeaseDuration); err != nil {
+			return err
+		} else if !leader {
+			logrus.Debugf("Garbage collection is progressing elsewhere")
+			return nil
+		}
+
+		items, err := d.listGC(ctx, lastID)
+		if err != nil || len(items) == 0 {
+			return err
+		}
+		lastID = items[len(items)-1].id
+
+		// an owner queued more than once is collected once for all
+		type itemKey struct {
+			owner              types.UID
+			orphan, foreground bool
+		}
+		seen := map[itemKey]bool{}
+		for _, item := range items {
+			key := itemKey{item.owner, item.orphan, item.foreground}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			if err := d.collectItem(ctx, item, lastID); errors.Is(err, errGCLeaseLost) {
+				logrus.Debugf("Garbage collection is progressing elsewhere: %v", err)
+				return nil
+			} else if err != nil {
+				logrus.Errorf("Failed to collect the dependents of %s: %v", item.owner, err)
+				metrics.GCTotal.WithLabelValues(metrics.ResultError).Inc()
+				continue
+			}
+			metrics.GCTotal.WithLabelValues(metrics.ResultSuccess).Inc()
+			metrics.GCLatency.Observe(time.Since(time.Unix(0, item.enqueued)).Seconds())
+		}
+
+		if err := d.queryRow(ctx, d.CountGCSQL).Scan(&depth); err != nil {
+			return err
+		}
+		metrics.GCQueueDepth.Set(float64(depth))
+	}
+}
+
+// SweepDanglingOwners finds the owners referenced by objects with gcLabel that no longer
+// exist, and were deleted without being queued for the garbage collection of their
+// dependents, for instance while kine was down or before the label was added. They are
+// queued as if they had been deleted in the background, or only reported with dryRun.
+// It returns the number of dangling owners found, or 0 if another kine sharing the
+// datastore holds the sweep lease.
+func (d *Generic) SweepDanglingOwners(ctx context.Context, dryRun bool) (int, error) {
+	if leader, err := d.acquireLease(ctx, sweepLeaseName, gcLeaseDuration); err != nil {
+		return 0, err
+	} else if !leader {
+		logrus.Debugf("Sweep for dangling owners is progressing elsewhere")
+		return 0, nil
+	}
+
+	owners, dependents, err := d.listDanglingOwners(ctx)
+	if err != nil {
+		return 0, err
+	}
+	metrics.GCDanglingOwners.Set(float64(len(owners)))
+
+	for _, owner := range owners {
+		keys := dependents[owner]
+		reported := strings.Join(keys[:min(len(keys), sweepReportedKeys)], ", ")
+		if len(keys) > sweepReportedKeys {
+			reported += ", ..."
+		}
+		if dryRun {
+			logrus.Infof("Owner %s of %d objects no longer exists, not queueing it for garbage collection in dry run: %s", owner, len(keys), reported)
+		} else {
+			logrus.Infof("Owner %s of %d objects no longer exists, queueing it for garbage collection: %s", owner, len(keys), reported)
+		}
+	}
+	if dryRun || len(owners) == 0 {
+		return len(owners), nil
+	}
+
+	t, err := d.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return 0, err
+	}
+	defer t.MustRollback()
+
+	tx := t.(*Tx)
+	for _, owner := range owners {
+		if err := tx.enqueueGC(ctx, owner, false, false); err != nil {
+			return 0, err
+		}
+	}
+	return len(owners), tx.Commit()
+}
+
+// listDanglingOwners returns the dangling owners, sorted, and the keys of the objects
+// referencing each of them.
+func (d *Generic) listDanglingOwners(ctx context.Context) ([]types.UID, map[types.UID][]string, error) {
+	rows, err := d.query(ctx, d.DanglingOwnersSQL, gcLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	owners := []types.UID{}
+	dependents := map[types.UID][]string{}
+	for rows.Next() {
+		var owner types.UID
+		var key string
+		if err := rows.Scan(&owner, &key); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := dependents[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		dependents[owner] = append(dependents[owner], key)
+	}
+	return owners, dependents, rows.Err()
+}
+
+// listGC returns the next queued owners after lastID.
+func (d *Generic) listGC(ctx context.Context, lastID int64) ([]gcItem, error) {
+	rows, err := d.query(ctx, d.ListGCSQL, lastID, gcQueueBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []gcItem{}
+	for rows.Next() {
+		item := gcItem{}
+		if err := rows.Scan(&item.id, &item.owner, &item.orphan, &item.foreground, &item.enqueued); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// collectItem collects the dependents of item, in as many transactions as it takes,
+// and removes it from the queue together with the copies of it queued up to lastID.
+// The lease is renewed before each transaction, so that an owner with many
+// dependents is not collected by two kines at once.
+func (d *Generic) collectItem(ctx context.Context, item gcItem, lastID int64) error {
+	for {
+		if leader, err := d.acquireLease(ctx, gcLeaseName, gcLeaseDuration); err != nil {
+			return err
+		} else if !leader {
+			return errGCLeaseLost
+		}
+
+		more, err := d.collectItemBatch(ctx, item, lastID)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// collectItemBatch collects the dependents of item in one transaction, and reports
+// whether some are left for another as the transaction reached GCMaxObjects. An owner
+// deleted in the foreground is deleted once no dependent blocks it.
+func (d *Generic) collectItemBatch(ctx context.Context, item gcItem, lastID int64) (bool, error) {
+	t, err := d.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return false, err
+	}
+	defer t.MustRollback()
+
+	tx := t.(*Tx)
+	ctx, gc := tx.withGCState(ctx)
+
+	var owner *dependent
+	if item.foreground {
+		// the owner may no longer be waiting for its dependents to be deleted
+		if owner, err = tx.getWaitingOwner(ctx, item.owner); err != nil {
+			return false, err
+		}
+	}
+
+	if owner != nil || !item.foreground {
+		blocked, err := tx.collectDependents(ctx, gc, item.owner, item.orphan, item.foreground)
+		if err != nil {
+			return false, err
+		}
+		if gc.exhausted {
+			return true, tx.Commit()
+		}
+
+		if owner != nil && !blocked {
+			if _, err := d.Insert(context.WithValue(ctx, txKey, tx), owner.key, false, true, owner.createRevision, owner.id, 0, nil, owner.value); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if _, err := tx.execute(ctx, d.DeleteGCSQL, item.owner, item.orphan, item.foreground, lastID); err != nil {
+		return false, err
+	}
+	return false, tx.Commit()
+}
+
+// acquireLease acquires or renews the lease name for duration, and reports whether
+// this kine holds it.
+func (d *Generic) acquireLease(ctx context.Context, name string, duration time.Duration) (bool, error) {
+	if _, err := d.execute(ctx, d.InsertLeaseSQL, name); err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	res, err := d.execute(ctx, d.AcquireLeaseSQL, leaseHolder, now.Add(duration).UnixNano(), name, leaseHolder, now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// enqueueGC queues uid for the garbage collection of its dependents.
+func (t *Tx) enqueueGC(ctx context.Context, uid types.UID, orphan, foreground bool) error {
+	if uid == "" {
+		return nil
+	}
+	_, err := t.execute(ctx, t.d.EnqueueGCSQL, uid, orphan, foreground, time.Now().UnixNano())
+	return err
+}
+
+// withGCState returns the garbage collection state of the transaction of ctx, adding
+// a new one to ctx if there is none.
+func (t *Tx) withGCState(ctx context.Context) (context.Context, *gcState) {
+	if gc, ok := ctx.Value(gcKey).(*gcState); ok {
+		return ctx, gc
+	}
+
+	limit := t.d.GCMaxObjects
+	if limit <= 0 {
+		limit = defaultGCMaxObjects
+	}
+	gc := &gcState{
+		visited:   map[types.UID]bool{},
+		remaining: limit,
+		limit:     limit,
+	}
+	return context.WithValue(ctx, gcKey, gc), gc
+}
+
+// take reserves the write of a dependent of owner, and reports whether the bound of
+// the transaction allows it.
+func (gc *gcState) take(owner types.UID) bool {
+	if gc.remaining <= 0 {
+		if !gc.exhausted {
+			logrus.Debugf("Garbage collection of the dependents of %s continues in another transaction, as one collects at most %d objects", owner, gc.limit)
+		}
+		gc.exhausted = true
+		return false
+	}
+	gc.remaining--
+	return true
+}
+
+// getObject returns the latest revision of the object uid, and whether it is deleted,
+// or nil if there is none.
+func (t *Tx) getObject(ctx context.Context, uid types.UID) (*dependent, bool, error) {
+	obj := &dependent{uid: uid}
+	var deleted bool
+	err := t.queryRow(ctx, t.d.GetUIDSQL, uid).Scan(&obj.id, &obj.key, &deleted, &obj.createRevision, &obj.value)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	return obj, deleted, err
+}
+
+// getWaitingOwner returns the latest revision of the object uid if it is waiting for
+// its dependents to be deleted in the foreground, or nil.
+func (t *Tx) getWaitingOwner(ctx context.Context, uid types.UID) (*dependent, error) {
+	owner, deleted, err := t.getObject(ctx, uid)
+	if err != nil || owner == nil || deleted {
+		return nil, err
+	}
+
+	obj, err := objectMeta(owner.key, owner.value)
+	if err != nil {
+		return nil, err
+	}
+	if len(obj.GetFinalizers()) != 1 || obj.GetFinalizers()[0] != metav1.FinalizerDeleteDependents {
+		return nil, nil
+	}
+	return owner, nil
+}
+
+// getAncestors returns the objects owning uid, directly or through their own owners,
+// up to the bound of the transaction.
+func (t *Tx) getAncestors(ctx context.Context, gc *gcState, uid types.UID) (map[types.UID]bool, error) {
+	ancestors := map[types.UID]bool{}
+	queue := []types.UID{uid}
+	for len(queue) > 0 && int64(len(ancestors)) < gc.limit {
+		next := queue[0]
+		queue = queue[1:]
+
+		owner, deleted, err := t.getObject(ctx, next)
+		if err != nil {
+			return nil, err
+		} else if owner == nil || deleted {
+			continue
+		}
+		obj, err := objectMeta(owner.key, owner.value)
+		if err != nil {
+			continue
+		}
+		for _, ref := range obj.GetOwnerReferences() {
+			if !ancestors[ref.UID] {
+				ancestors[ref.UID] = true
+				queue = append(queue, ref.UID)
+			}
+		}
+	}
+	return ancestors, nil
+}
+
+// getDependents returns the latest revision of every object that is not deleted and
+// has an owner reference to uid.
+func (t *Tx) getDependents(ctx context.Context, uid types.UID) ([]dependent, error) {
+	rows, err := t.query(ctx, t.d.GetOwnedSQL, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dependents := []dependent{}
+	for rows.Next() {
+		dep := dependent{}
+		if err := rows.Scan(&dep.id, &dep.key, &dep.uid, &dep.createRevision, &dep.value, &dep.blockOwnerDeletion); err != nil {
+			return nil, err
+		}
+		dependents = append(dependents, dep)
+	}
+	return dependents, rows.Err()
+}
+
+// collectDependents collects the dependents of the object uid, which is being deleted:
+// their owner references to it are removed if orphan is set, and otherwise they are
+// deleted, or marked for deletion if they have finalizers. With foreground, dependents
+// marked with gcLabel are deleted in the foreground as well. Deleting a dependent
+// queues it for the collection of its own dependents in turn. It reports whether the
+// deletion of uid is blocked by a dependent that is left with blockOwnerDeletion.
+func (t *Tx) collectDependents(ctx context.Context, gc *gcState, uid types.UID, orphan, foreground bool) (bool, error) {
+	if uid == "" || gc.visited[uid] {
+		return false, nil
+	}
+	gc.visited[uid] = true
+
+	dependents, err := t.getDependents(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+
+	ctx = context.WithValue(ctx, txKey, t)
+	var ancestors map[types.UID]bool
+	blocked := false
+	for _, dep := range dependents {
+		if gc.visited[dep.uid] {
+			continue
+		}
+
+		obj, err := objectMeta(dep.key, dep.value)
+		if err != nil {
+			// the dependent is left to the controller manager, rather than failing
+			// the deletion of its owner
+			logrus.Warnf("Not collecting %s, a dependent of %s: %v", dep.key, uid, err)
+			continue
+		}
+		_, labelled := obj.GetLabels()[gcLabel]
+
+		if !orphan && len(obj.GetFinalizers()) != 0 && obj.GetDeletionTimestamp() != nil {
+			// a dependent waiting for its own dependents does not block an owner it
+			// owns itself, or the deletion of an ownership cycle would wait for itself
+			if foreground && dep.blockOwnerDeletion {
+				if ancestors == nil {
+					if ancestors, err = t.getAncestors(ctx, gc, uid); err != nil {
+						return false, err
+					}
+				}
+				blocked = blocked || !ancestors[dep.uid]
+			}
+			continue
+		}
+
+		if !gc.take(uid) {
+			blocked = blocked || (foreground && dep.blockOwnerDeletion)
+			continue
+		}
+
+		switch {
+		case orphan:
+			err := t.updateDependent(ctx, dep, func(obj metav1.Object) {
+				obj.SetOwnerReferences(slices.DeleteFunc(obj.GetOwnerReferences(), func(ref metav1.OwnerReference) bool {
+					return ref.UID == uid
+				}))
+			})
+			if err != nil {
+				return false, err
+			}
+		case len(obj.GetFinalizers()) == 0 && !(foreground && labelled):
+			if _, err := t.d.Insert(ctx, dep.key, false, true, dep.createRevision, dep.id, 0, nil, dep.value); err != nil {
+				return false, err
+			}
+		default:
+			err := t.updateDependent(ctx, dep, func(obj metav1.Object) {
+				obj.SetDeletionTimestamp(&metav1.Time{Time: time.Now()})
+				if foreground && labelled && !slices.Contains(obj.GetFinalizers(), metav1.FinalizerDeleteDependents) {
+					obj.SetFinalizers(append(obj.GetFinalizers(), metav1.FinalizerDeleteDependents))
+				}
+			})
+			if err != nil {
+				return false, err
+			}
+			blocked = blocked || (foreground && dep.blockOwnerDeletion)
+		}
+	}
+
+	return blocked, nil
+}
+
+// updateDependent writes the next revision of dep, with update applied to its
+// metadata, in the media type dep is stored in.
+func (t *Tx) updateDependent(ctx context.Context, dep dependent, update func(metav1.Object)) error {
+	value, err := updateObjectMeta(dep.value, update)
+	if err != nil {
+		return err
+	}
+	_, err = t.d.Insert(ctx, dep.key, false, false, dep.createRevision, dep.id, 0, value, dep.value)
+	return err
+}
@@ -0,0 +1,350 @@
+package generic_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/internal/testutil"
+	"github.com/k3s-io/kine/pkg/util"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestGarbageCollectionFollowsOwnershipChains(t *testing.T) {
+	ctx, backend, dialect := testutil.NewDialect(t)
+
+	gcLabels := map[string]string{"skip-controller-manager-metadata-caching": "true"}
+	block := true
+	ownedBy := func(owners ...metav1.Object) []metav1.OwnerReference {
+		refs := []metav1.OwnerReference{}
+		for _, owner := range owners {
+			refs = append(refs, metav1.OwnerReference{
+				APIVersion:         "v1",
+				Kind:               "Owner",
+				Name:               owner.GetName(),
+				UID:                owner.GetUID(),
+				BlockOwnerDeletion: &block,
+			})
+		}
+		return refs
+	}
+	write := func(key string, obj runtime.Object) {
+		t.Helper()
+		value, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatalf("failed to marshal %s: %v", key, err)
+		}
+		_, kv, err := backend.Get(ctx, key, 0, true)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", key, err)
+		}
+		if kv == nil {
+			_, err = backend.Create(ctx, key, value, 0)
+		} else {
+			_, _, _, err = backend.Update(ctx, key, value, kv.ModRevision, 0)
+		}
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", key, err)
+		}
+	}
+	exists := func(key string) bool {
+		t.Helper()
+		_, kv, err := backend.Get(ctx, key, 0, true)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", key, err)
+		}
+		return kv != nil
+	}
+
+	// chain writes a deployment owning a replica set owning count pods, all collected by
+	// kine, and returns their keys from the top
+	chain := func(name string, count int) (*appsv1.Deployment, []string) {
+		t.Helper()
+		deploy := &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name + "-deploy"), Labels: gcLabels},
+		}
+		rs := &appsv1.ReplicaSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "ReplicaSet"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name + "-rs"), Labels: gcLabels, OwnerReferences: ownedBy(deploy)},
+		}
+		keys := []string{"/registry/deployments/default/" + name, "/registry/replicasets/default/" + name}
+		write(keys[0], deploy)
+		write(keys[1], rs)
+		for i := range count {
+			pod := testutil.NewPod("default", fmt.Sprintf("%s-%d", name, i), "")
+			pod.UID = types.UID(pod.Name)
+			pod.Labels = gcLabels
+			pod.OwnerReferences = ownedBy(rs)
+			write(testutil.PodKey(pod), pod)
+			keys = append(keys, testutil.PodKey(pod))
+		}
+		return deploy, keys
+	}
+
+	collect := func() {
+		t.Helper()
+		if err := dialect.CollectGarbage(ctx); err != nil {
+			t.Fatalf("failed to collect garbage: %v", err)
+		}
+	}
+	expectCollected := func(keys ...string) {
+		t.Helper()
+		for _, key := range keys {
+			if exists(key) {
+				t.Errorf("expected %s to be collected", key)
+			}
+		}
+	}
+
+	t.Run("background", func(t *testing.T) {
+		_, keys := chain("background", 3)
+		if _, _, deleted, err := backend.Delete(ctx, keys[0], 0); err != nil || !deleted {
+			t.Fatalf("failed to delete %s: deleted=%v, err=%v", keys[0], deleted, err)
+		}
+		// the dependents are left to the garbage collector
+		for _, key := range keys[1:] {
+			if !exists(key) {
+				t.Errorf("expected %s to be left until garbage is collected", key)
+			}
+		}
+		collect()
+		expectCollected(keys...)
+	})
+
+	t.Run("foreground", func(t *testing.T) {
+		deploy, keys := chain("foreground", 3)
+		deploy.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+		deploy.Finalizers = []string{metav1.FinalizerDeleteDependents}
+		write(keys[0], deploy)
+		collect()
+		expectCollected(keys...)
+	})
+
+	cycle := func(name string) (*corev1.Pod, *corev1.Pod) {
+		t.Helper()
+		a, b := testutil.NewPod("default", name+"-a", ""), testutil.NewPod("default", name+"-b", "")
+		a.UID, b.UID = types.UID(a.Name), types.UID(b.Name)
+		a.Labels, b.Labels = gcLabels, gcLabels
+		write(testutil.PodKey(a), a)
+		b.OwnerReferences = ownedBy(a)
+		write(testutil.PodKey(b), b)
+		a.OwnerReferences = ownedBy(b)
+		write(testutil.PodKey(a), a)
+		return a, b
+	}
+
+	t.Run("cycle", func(t *testing.T) {
+		a, b := cycle("cycle")
+		if _, _, deleted, err := backend.Delete(ctx, testutil.PodKey(a), 0); err != nil || !deleted {
+			t.Fatalf("failed to delete %s: deleted=%v, err=%v", testutil.PodKey(a), deleted, err)
+		}
+		collect()
+		expectCollected(testutil.PodKey(a), testutil.PodKey(b))
+	})
+
+	t.Run("foreground cycle", func(t *testing.T) {
+		a, b := cycle("foreground-cycle")
+		a.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+		a.Finalizers = []string{metav1.FinalizerDeleteDependents}
+		write(testutil.PodKey(a), a)
+		collect()
+		expectCollected(testutil.PodKey(a), testutil.PodKey(b))
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		dialect.GCMaxObjects = 2
+		defer func() { dialect.GCMaxObjects = 0 }()
+
+		_, keys := chain("bounded", 5)
+		if _, _, deleted, err := backend.Delete(ctx, keys[0], 0); err != nil || !deleted {
+			t.Fatalf("failed to delete %s: deleted=%v, err=%v", keys[0], deleted, err)
+		}
+		collect()
+		expectCollected(keys...)
+	})
+
+	t.Run("protobuf", func(t *testing.T) {
+		writeProtobuf := func(key string, pod *corev1.Pod) {
+			t.Helper()
+			value := testutil.ProtobufValue(t, "v1", "Pod", pod)
+			_, kv, err := backend.Get(ctx, key, 0, true)
+			if err != nil {
+				t.Fatalf("failed to get %s: %v", key, err)
+			}
+			if kv == nil {
+				_, err = backend.Create(ctx, key, value, 0)
+			} else {
+				_, _, _, err = backend.Update(ctx, key, value, kv.ModRevision, 0)
+			}
+			if err != nil {
+				t.Fatalf("failed to write %s: %v", key, err)
+			}
+		}
+
+		owner := testutil.NewPod("default", "protobuf-owner", "")
+		owner.UID, owner.Labels = types.UID(owner.Name), gcLabels
+		writeProtobuf(testutil.PodKey(owner), owner)
+
+		// the previous value of a dependent no longer blocking its owner is decoded
+		kept := testutil.NewPod("default", "protobuf-kept", "node1")
+		kept.UID, kept.Labels, kept.Finalizers = types.UID(kept.Name), gcLabels, []string{"example.com/keep"}
+		kept.OwnerReferences = ownedBy(owner)
+		writeProtobuf(testutil.PodKey(kept), kept)
+		kept.OwnerReferences[0].BlockOwnerDeletion = nil
+		writeProtobuf(testutil.PodKey(kept), kept)
+
+		deleted := testutil.NewPod("default", "protobuf-deleted", "")
+		deleted.UID, deleted.Labels = types.UID(deleted.Name), gcLabels
+		deleted.OwnerReferences = ownedBy(owner)
+		writeProtobuf(testutil.PodKey(deleted), deleted)
+
+		if _, _, ok, err := backend.Delete(ctx, testutil.PodKey(owner), 0); err != nil || !ok {
+			t.Fatalf("failed to delete %s: deleted=%v, err=%v", testutil.PodKey(owner), ok, err)
+		}
+		collect()
+		expectCollected(testutil.PodKey(deleted))
+
+		// the dependent with a finalizer is marked for deletion, and kept in protobuf
+		_, kv, err := backend.Get(ctx, testutil.PodKey(kept), 0, false)
+		if err != nil || kv == nil {
+			t.Fatalf("failed to get %s: kv=%v, err=%v", testutil.PodKey(kept), kv, err)
+		}
+		obj, err := util.DecodeObject(kv.Key, kv.Value)
+		if err != nil {
+			t.Fatalf("failed to decode %s: %v", kv.Key, err)
+		}
+		pod := obj.(*corev1.Pod)
+		if !util.IsProtobuf(kv.Value) || pod.DeletionTimestamp == nil || pod.Spec.NodeName != "node1" {
+			t.Errorf("expected %s to be marked for deletion in protobuf, got protobuf=%v deletionTimestamp=%v nodeName=%q", kv.Key, util.IsProtobuf(kv.Value), pod.DeletionTimestamp, pod.Spec.NodeName)
+		}
+	})
+
+	t.Run("undecodable", func(t *testing.T) {
+		owner := testutil.NewPod("default", "undecodable-owner", "")
+		owner.UID, owner.Labels = types.UID(owner.Name), gcLabels
+		write(testutil.PodKey(owner), owner)
+
+		dep := testutil.NewPod("default", "undecodable-dep", "")
+		dep.UID, dep.Labels = types.UID(dep.Name), gcLabels
+		dep.OwnerReferences = ownedBy(owner)
+		write(testutil.PodKey(dep), dep)
+
+		// a dependent whose stored value no longer decodes is left to the controller
+		// manager, without failing the collection of the others
+		undecodable := testutil.NewPod("default", "undecodable", "")
+		undecodable.UID, undecodable.Labels = types.UID(undecodable.Name), gcLabels
+		undecodable.OwnerReferences = ownedBy(owner)
+		key := testutil.PodKey(undecodable)
+		write(key, undecodable)
+		if _, err := dialect.DB.ExecContext(ctx, "UPDATE kine SET value = ? WHERE name = ?", []byte("{not json"), key); err != nil {
+			t.Fatalf("failed to overwrite %s: %v", key, err)
+		}
+
+		if _, _, deleted, err := backend.Delete(ctx, testutil.PodKey(owner), 0); err != nil || !deleted {
+			t.Fatalf("failed to delete %s: deleted=%v, err=%v", testutil.PodKey(owner), deleted, err)
+		}
+		collect()
+		expectCollected(testutil.PodKey(dep))
+		if !exists(key) {
+			t.Errorf("expected %s to be left", key)
+		}
+	})
+
+	t.Run("leased elsewhere", func(t *testing.T) {
+		_, keys := chain("leased", 1)
+		expires := time.Now().Add(time.Minute).UnixNano()
+		if _, err := dialect.DB.ExecContext(ctx, `UPDATE kine_leases SET holder = 'other', expires = ? WHERE name = 'gc'`, expires); err != nil {
+			t.Fatalf("failed to hand the lease over: %v", err)
+		}
+		if _, _, deleted, err := backend.Delete(ctx, keys[0], 0); err != nil || !deleted {
+			t.Fatalf("failed to delete %s: deleted=%v, err=%v", keys[0], deleted, err)
+		}
+		collect()
+		if !exists(keys[1]) {
+			t.Errorf("expected %s to be left to the lease holder", keys[1])
+		}
+
+		if _, err := dialect.DB.ExecContext(ctx, `UPDATE kine_leases SET expires = 0 WHERE name = 'gc'`); err != nil {
+			t.Fatalf("failed to expire the lease: %v", err)
+		}
+		collect()
+		expectCollected(keys...)
+	})
+}
+
+func TestDanglingOwnersAreSwept(t *testing.T) {
+	ctx, backend, dialect := testutil.NewDialect(t)
+
+	write := func(pod *corev1.Pod) {
+		t.Helper()
+		value, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatalf("failed to marshal pod: %v", err)
+		}
+		if _, err := backend.Create(ctx, testutil.PodKey(pod), value, 0); err != nil {
+			t.Fatalf("failed to create %s: %v", testutil.PodKey(pod), err)
+		}
+	}
+	exists := func(pod *corev1.Pod) bool {
+		t.Helper()
+		_, kv, err := backend.Get(ctx, testutil.PodKey(pod), 0, true)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", testutil.PodKey(pod), err)
+		}
+		return kv != nil
+	}
+	ownedBy := func(pod *corev1.Pod, uid types.UID, labelled bool) *corev1.Pod {
+		pod.UID = types.UID(pod.Name)
+		pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "Pod", Name: string(uid), UID: uid}}
+		if labelled {
+			pod.Labels = map[string]string{"skip-controller-manager-metadata-caching": "true"}
+		}
+		return pod
+	}
+
+	owner := ownedBy(testutil.NewPod("default", "owner", ""), "", true)
+	owner.OwnerReferences = nil
+	write(owner)
+	owned := ownedBy(testutil.NewPod("default", "owned", ""), owner.UID, true)
+	write(owned)
+	orphaned := ownedBy(testutil.NewPod("default", "orphaned", ""), "gone", true)
+	write(orphaned)
+	// objects without the label are left to the controller manager
+	unlabelled := ownedBy(testutil.NewPod("default", "unlabelled", ""), "gone-too", false)
+	write(unlabelled)
+
+	sweep := func(dryRun bool) {
+		t.Helper()
+		n, err := dialect.SweepDanglingOwners(ctx, dryRun)
+		if err != nil {
+			t.Fatalf("failed to sweep: %v", err)
+		}
+		if n != 1 {
+			t.Errorf("expected 1 dangling owner, got %d", n)
+		}
+		if err := dialect.CollectGarbage(ctx); err != nil {
+			t.Fatalf("failed to collect garbage: %v", err)
+		}
+	}
+
+	sweep(true)
+	if !exists(orphaned) {
+		t.Errorf("expected %s to be left by a dry run", testutil.PodKey(orphaned))
+	}
+
+	sweep(false)
+	if exists(orphaned) {
+		t.Errorf("expected %s to be collected", testutil.PodKey(orphaned))
+	}
+	for _, pod := range []*corev1.Pod{owner, owned, unlabelled} {
+		if !exists(pod) {
+			t.Errorf("expected %s to be left", testutil.PodKey(pod))
+		}
+	}
+}
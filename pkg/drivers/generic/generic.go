@@ -6,6 +6,7 @@ import (
 	"database/sql/driver"
 	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +16,7 @@ import (
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/query"
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
@@ -43,11 +45,52 @@ var (
 	CompactRevSQL  = `SELECT MAX(prev_revision) AS compact_rev FROM kine WHERE name = 'compact_rev_key'`
 	BetweenNameSQL = `SELECT MAX(id) AS id FROM kine WHERE name >= ? AND name < ? %s GROUP BY name`
 	EqualsNameSQL  = `SELECT MAX(id) AS id FROM kine WHERE name = ? %s`
-
-	listSQL    = fmt.Sprintf(ListFmt, Columns, CurrentRevSQL, CompactRevSQL, BetweenNameSQL)
-	listValSQL = fmt.Sprintf(ListFmt, WithVal, CurrentRevSQL, CompactRevSQL, BetweenNameSQL)
-	getSQL     = fmt.Sprintf(ListFmt, Columns, CurrentRevSQL, CompactRevSQL, EqualsNameSQL)
-	getValSQL  = fmt.Sprintf(ListFmt, WithVal, CurrentRevSQL, CompactRevSQL, EqualsNameSQL)
+	CurrentNameSQL = `SELECT id FROM kine_current WHERE name >= ? AND name < ? %s`
+
+	listSQL           = fmt.Sprintf(ListFmt, Columns, CurrentRevSQL, CompactRevSQL, BetweenNameSQL)
+	listValSQL        = fmt.Sprintf(ListFmt, WithVal, CurrentRevSQL, CompactRevSQL, BetweenNameSQL)
+	listCurrentSQL    = fmt.Sprintf(ListFmt, Columns, CurrentRevSQL, CompactRevSQL, CurrentNameSQL)
+	listCurrentValSQL = fmt.Sprintf(ListFmt, WithVal, CurrentRevSQL, CompactRevSQL, CurrentNameSQL)
+	getSQL            = fmt.Sprintf(ListFmt, Columns, CurrentRevSQL, CompactRevSQL, EqualsNameSQL)
+	getValSQL         = fmt.Sprintf(ListFmt, WithVal, CurrentRevSQL, CompactRevSQL, EqualsNameSQL)
+
+	MissingFieldSQL = `
+		SELECT COUNT(id)
+		FROM kine
+		INNER JOIN (SELECT MAX(id) AS id FROM kine WHERE name LIKE ? ESCAPE '!' GROUP BY name) AS mkv USING (id)
+		WHERE deleted = 0 AND id NOT IN (
+			SELECT kine_id
+			FROM kine_fields
+			WHERE kine_name LIKE ? ESCAPE '!' AND (%s)
+		)`
+
+	// ReindexNameSQL selects the latest revision, up to a target revision, of the keys
+	// under a prefix that sort after the last key reindexed.
+	ReindexNameSQL = `SELECT MAX(id) AS id FROM kine WHERE name > ? AND name LIKE ? ESCAPE '!' AND id <= ? GROUP BY name`
+
+	// DanglingOwnersSQL selects the owners referenced by the latest revision of objects
+	// with a label, that have no object of their own and are not queued for garbage
+	// collection, together with the keys of those objects. The owner UID is looked up
+	// in kine_uid_index as the expression substituted for %s.
+	DanglingOwnersSQL = `
+		SELECT ko.owner, k.name
+		FROM kine_owners AS ko
+		INNER JOIN kine_current AS c ON c.id = ko.kine_id
+		INNER JOIN kine AS k ON k.id = c.id
+		WHERE k.deleted = 0
+			AND EXISTS (
+				SELECT 1 FROM kine_labels AS kl WHERE kl.kine_id = k.id AND kl.name = ?
+			)
+			AND NOT EXISTS (
+				SELECT 1
+				FROM kine AS o
+				INNER JOIN kine_current AS oc ON oc.id = o.id
+				WHERE o.uid = %s AND o.deleted = 0
+			)
+			AND NOT EXISTS (
+				SELECT 1 FROM kine_gc_queue AS q WHERE q.owner = ko.owner
+			)
+		ORDER BY ko.owner, k.name`
 )
 
 type ErrRetry func(error) bool
@@ -65,14 +108,42 @@ type ConnectionPoolConfig struct {
 type Generic struct {
 	sync.Mutex
 
-	InsertLabelSQL    *query.Named
-	InsertFieldsSQL   *query.Named
-	InsertOwnerSQL    *query.Named
-	GetOwnedSQL       *query.Named
-	GetUIDSQL         *query.Named
-	SelectorLookupSQL string
+	InsertLabelSQL     *query.Named
+	InsertFieldsSQL    *query.Named
+	InsertOwnerSQL     *query.Named
+	GetOwnedSQL        *query.Named
+	GetUIDSQL          *query.Named
+	GetValueSQL        *query.Named
+	EnqueueGCSQL       *query.Named
+	ListGCSQL          *query.Named
+	DeleteGCSQL        *query.Named
+	CountGCSQL         *query.Named
+	InsertLeaseSQL     *query.Named
+	AcquireLeaseSQL    *query.Named
+	DanglingOwnersSQL  *query.Named
+	DeleteLabelsSQL    *query.Named
+	DeleteFieldsSQL    *query.Named
+	DeleteOwnersSQL    *query.Named
+	DeleteKeyLabelsSQL *query.Named
+	DeleteKeyFieldsSQL *query.Named
+	GetReindexSQL      *query.Named
+	DeleteReindexSQL   *query.Named
+	StartReindexSQL    *query.Named
+	UpdateReindexSQL   *query.Named
+	ReindexBatchSQL    *query.Named
+	CountReindexSQL    *query.Named
+	InsertCurrentSQL   *query.Named
+	RepairCurrentSQL   *query.Named
+	PruneCurrentSQL    *query.Named
+	SelectorLookupSQL  string
+	SelectorIntegerSQL string
+	FieldExistsSQL     string
+	FieldContainsSQL   string
 
 	LockWrites              bool
+	CurrentMetadataOnly     bool
+	IndexFieldValues        bool
+	GCMaxObjects            int64
 	LastInsertID            bool
 	DB                      *sql.DB
 	GetSingleSQL            *query.Named
@@ -90,13 +161,21 @@ type Generic struct {
 	AfterSingleOldValSQL    *query.Named
 	CurrentRevSQL           *query.Named
 	CompactRevSQL           *query.Named
+	RevisionAtSQL           *query.Named
 	DeleteSQL               *query.Named
 	CompactSQL              *query.Named
 	UpdateCompactSQL        *query.Named
+	CompactPrefixSQL        *query.Named
+	PrefixCompactRevSQL     *query.Named
+	PrefixCompactRevsSQL    *query.Named
+	UpdatePrefixCompactSQL  *query.Named
 	PostCompactSQL          *query.Named
 	InsertSQL               *query.Named
 	FillSQL                 *query.Named
 	InsertLastInsertIDSQL   *query.Named
+	InsertFieldValueSQL     *query.Named
+	DeleteFieldValuesSQL    *query.Named
+	DeleteKeyFieldValuesSQL *query.Named
 	GetSizeSQL              *query.Named
 	Retry                   ErrRetry
 	InsertRetry             ErrRetry
@@ -132,6 +211,67 @@ func (d *Generic) Migrate(ctx context.Context) {
 	}
 }
 
+// MigrateCurrent records the latest row of every key in kine_current if it is empty,
+// for datastores written before it was maintained.
+func (d *Generic) MigrateCurrent(ctx context.Context) {
+	var exists int
+	if err := d.queryRow(ctx, query.New("SELECT 1 FROM kine_current LIMIT 1", "?", false, "")).Scan(&exists); err != sql.ErrNoRows {
+		if err != nil {
+			logrus.Errorf("Current revision migration failed: %v", err)
+		}
+		return
+	}
+
+	logrus.Infof("Recording the current revision of each key, this may take a moment...")
+	if _, err := d.execute(ctx, d.RepairCurrentSQL, 0, int64(math.MaxInt64)); err != nil {
+		logrus.Errorf("Current revision migration failed: %v", err)
+	}
+}
+
+// CheckExtraFields reports how many current rows under the prefix of each configured
+// extra field were indexed before it was configured. Those rows are not matched by
+// field selectors on it until they are reindexed.
+func (d *Generic) CheckExtraFields(ctx context.Context) {
+	for prefix, names := range util.GetExtraFields() {
+		for _, name := range names {
+			missing, err := d.CountMissingField(ctx, prefix, name)
+			if err != nil {
+				logrus.Errorf("Failed to check extra field %s under %s: %v", name, prefix, err)
+				continue
+			}
+			if missing > 0 {
+				logrus.Warnf("%d rows under %s are not indexed by extra field %s, and will not match field selectors on it until they are reindexed", missing, prefix, name)
+			} else {
+				logrus.Infof("All rows under %s are indexed by extra field %s", prefix, name)
+			}
+		}
+	}
+}
+
+// CountMissingField returns the number of current rows under prefix whose indexed
+// fields do not include the named field.
+func (d *Generic) CountMissingField(ctx context.Context, prefix, name string) (int64, error) {
+	likePrefix := likeEscaper.Replace(prefix) + "%"
+	field := strings.ReplaceAll(name, ".", "_")
+	args := []any{likePrefix, likePrefix}
+
+	exists := d.FieldExistsSQL
+	if strings.Contains(exists, "%s") {
+		exists = fmt.Sprintf(exists, field)
+	} else {
+		args = append(args, field)
+	}
+
+	sql := fmt.Sprintf(MissingFieldSQL, exists)
+	if strings.Contains(d.CountCurrentSQL.Query, "$") {
+		sql = replaceParamsToNumbers(sql, 0)
+	}
+
+	var missing int64
+	err := d.queryRow(ctx, query.New(sql, "?", false, "MissingField"), args...).Scan(&missing)
+	return missing, err
+}
+
 func configureConnectionPooling(connPoolConfig ConnectionPoolConfig, db *sql.DB, driverName string) {
 	// behavior copied from database/sql - zero means defaultMaxIdleConns; negative means 0
 	if connPoolConfig.MaxIdle < 0 {
@@ -206,20 +346,75 @@ func OpenDB(ctx context.Context, wg *sync.WaitGroup, driverName string, connecto
 		InsertOwnerSQL: query.New(`INSERT INTO kine_owners(kine_id, owner, block_owner_deletion)
 			values(?, ?, ?)`, paramCharacter, numbered, "InsertOwner"),
 		GetOwnedSQL: query.New(`
-			SELECT s.id, s.name, s.uid, s.create_revision, s.value, COALESCE(s.block_owner_deletion, 0) FROM (
-				SELECT MAX(k.id) AS id, k.name, k.uid, k.create_revision, k.value, k.deleted, ko.block_owner_deletion
-				FROM kine_owners AS ko
-				INNER JOIN kine AS k ON k.id = ko.kine_id
-				WHERE ko.owner = ?
-				GROUP BY k.name
-				HAVING k.deleted = 0
-			) AS s`, paramCharacter, numbered, "GetOwned"),
-		GetUIDSQL: query.New(`SELECT id, name, deleted, create_revision, value FROM kine WHERE uid = ? ORDER BY id DESC LIMIT 1`, paramCharacter, numbered, "GetUID"),
+			SELECT k.id, k.name, k.uid, k.create_revision, k.value, COALESCE(ko.block_owner_deletion, 0)
+			FROM kine_owners AS ko
+			INNER JOIN kine_current AS c ON c.id = ko.kine_id
+			INNER JOIN kine AS k ON k.id = c.id
+			WHERE ko.owner = ? AND k.deleted = 0`, paramCharacter, numbered, "GetOwned"),
+		GetUIDSQL:   query.New(`SELECT id, name, deleted, create_revision, value FROM kine WHERE uid = ? ORDER BY id DESC LIMIT 1`, paramCharacter, numbered, "GetUID"),
+		GetValueSQL: query.New(`SELECT value FROM kine WHERE id = ?`, paramCharacter, numbered, "GetValue"),
+
+		EnqueueGCSQL: query.New(`INSERT INTO kine_gc_queue(owner, orphan, foreground, enqueued)
+			values(?, ?, ?, ?)`, paramCharacter, numbered, "EnqueueGC"),
+		ListGCSQL: query.New(`
+			SELECT id, owner, orphan, foreground, enqueued
+			FROM kine_gc_queue
+			WHERE id > ?
+			ORDER BY id ASC
+			LIMIT ?`, paramCharacter, numbered, "ListGC"),
+		DeleteGCSQL: query.New(`
+			DELETE FROM kine_gc_queue
+			WHERE owner = ? AND orphan = ? AND foreground = ? AND id <= ?`, paramCharacter, numbered, "DeleteGC"),
+		CountGCSQL: query.New(`SELECT COUNT(*) FROM kine_gc_queue`, paramCharacter, numbered, "CountGC"),
+		InsertLeaseSQL: query.New(`INSERT INTO kine_leases(name, holder, expires)
+			values(?, '', 0)
+			ON CONFLICT (name) DO NOTHING`, paramCharacter, numbered, "InsertLease"),
+		AcquireLeaseSQL: query.New(`
+			UPDATE kine_leases
+			SET holder = ?, expires = ?
+			WHERE name = ? AND (holder = ? OR expires < ?)`, paramCharacter, numbered, "AcquireLease"),
+		DanglingOwnersSQL: query.New(fmt.Sprintf(DanglingOwnersSQL, "ko.owner"), paramCharacter, numbered, "DanglingOwners"),
+
+		DeleteLabelsSQL:    query.New(`DELETE FROM kine_labels WHERE kine_id = ?`, paramCharacter, numbered, "DeleteLabels"),
+		DeleteFieldsSQL:    query.New(`DELETE FROM kine_fields WHERE kine_id = ?`, paramCharacter, numbered, "DeleteFields"),
+		DeleteOwnersSQL:    query.New(`DELETE FROM kine_owners WHERE kine_id = ?`, paramCharacter, numbered, "DeleteOwners"),
+		DeleteKeyLabelsSQL: query.New(`DELETE FROM kine_labels WHERE kine_name = ?`, paramCharacter, numbered, "DeleteKeyLabels"),
+		DeleteKeyFieldsSQL: query.New(`DELETE FROM kine_fields WHERE kine_name = ?`, paramCharacter, numbered, "DeleteKeyFields"),
+
+		GetReindexSQL:    query.New(`SELECT fingerprint, revision, last_key, finished FROM kine_reindex WHERE prefix = ?`, paramCharacter, numbered, "GetReindex"),
+		DeleteReindexSQL: query.New(`DELETE FROM kine_reindex WHERE prefix = ?`, paramCharacter, numbered, "DeleteReindex"),
+		StartReindexSQL: query.New(`INSERT INTO kine_reindex(prefix, fingerprint, revision, last_key, finished)
+			values(?, ?, ?, '', 0)`, paramCharacter, numbered, "StartReindex"),
+		UpdateReindexSQL: query.New(`
+			UPDATE kine_reindex
+			SET last_key = ?, finished = ?
+			WHERE prefix = ? AND fingerprint = ? AND last_key = ?`, paramCharacter, numbered, "UpdateReindex"),
+		ReindexBatchSQL: query.New(fmt.Sprintf(`
+			SELECT kv.id, kv.name, kv.deleted, kv.value
+			FROM kine AS kv
+			INNER JOIN (%s ORDER BY name ASC LIMIT ?) AS mkv ON mkv.id = kv.id
+			ORDER BY kv.name ASC`, ReindexNameSQL), paramCharacter, numbered, "ReindexBatch"),
+		CountReindexSQL: query.New(fmt.Sprintf(`SELECT COUNT(*) FROM (%s) AS mkv`, ReindexNameSQL), paramCharacter, numbered, "CountReindex"),
+
+		InsertFieldValueSQL: query.New(`INSERT INTO kine_field_values(kine_id, kine_name, name, value)
+			values(?, ?, ?, ?)`, paramCharacter, numbered, "InsertFieldValue"),
+		DeleteFieldValuesSQL:    query.New(`DELETE FROM kine_field_values WHERE kine_id = ?`, paramCharacter, numbered, "DeleteFieldValues"),
+		DeleteKeyFieldValuesSQL: query.New(`DELETE FROM kine_field_values WHERE kine_name = ?`, paramCharacter, numbered, "DeleteKeyFieldValues"),
+
+		RepairCurrentSQL: query.New(`
+			INSERT INTO kine_current(name, id)
+			SELECT name, MAX(id) FROM kine WHERE id > ? AND id <= ? GROUP BY name
+			ON CONFLICT (name) DO UPDATE SET id = excluded.id WHERE excluded.id > kine_current.id`,
+			paramCharacter, numbered, "RepairCurrent"),
+		PruneCurrentSQL: query.New(`
+			DELETE FROM kine_current
+			WHERE id > ? AND id <= ? AND NOT EXISTS (SELECT 1 FROM kine WHERE kine.id = kine_current.id)`,
+			paramCharacter, numbered, "PruneCurrent"),
 
 		DB: db,
 
-		ListCurrentSQL:          query.New(fmt.Sprintf(listSQL, ""), paramCharacter, numbered, "ListCurrent"),
-		ListCurrentValSQL:       query.New(fmt.Sprintf(listValSQL, ""), paramCharacter, numbered, "ListCurrentVal"),
+		ListCurrentSQL:          query.New(fmt.Sprintf(listCurrentSQL, ""), paramCharacter, numbered, "ListCurrent"),
+		ListCurrentValSQL:       query.New(fmt.Sprintf(listCurrentValSQL, ""), paramCharacter, numbered, "ListCurrentVal"),
 		ListRevisionStartSQL:    query.New(fmt.Sprintf(getSQL, "AND id <= ?"), paramCharacter, numbered, "ListRevisionStart"),
 		ListRevisionStartValSQL: query.New(fmt.Sprintf(getValSQL, "AND id <= ?"), paramCharacter, numbered, "ListRevisionStartVal"),
 		GetRevisionAfterSQL:     query.New(fmt.Sprintf(listSQL, "AND id <= ?"), paramCharacter, numbered, "GetRevisionAfter"),
@@ -246,7 +441,7 @@ func OpenDB(ctx context.Context, wg *sync.WaitGroup, driverName string, connecto
 			FROM kine
 			INNER JOIN (%s) AS mkv USING (id)
 			WHERE (deleted = 0 OR ?) %%s`,
-			CurrentRevSQL, fmt.Sprintf(BetweenNameSQL, "")), paramCharacter, numbered, "CountCurrent"),
+			CurrentRevSQL, fmt.Sprintf(CurrentNameSQL, "")), paramCharacter, numbered, "CountCurrent"),
 
 		CountRevisionSQL: query.New(fmt.Sprintf(`
 			SELECT (%s), (%s), COUNT(id)
@@ -259,14 +454,14 @@ func OpenDB(ctx context.Context, wg *sync.WaitGroup, driverName string, connecto
 			SELECT current_rev, compact_rev, %s
 			FROM (%s) AS current, (%s) AS compact, kine
 			WHERE	name >= ? AND name < ?
-			AND	id > ?
+			AND	id > ? %%s
 			ORDER BY id ASC`,
 			WithOldVal, CurrentRevSQL, CompactRevSQL), paramCharacter, numbered, "AfterOldVal"),
 
 		AfterAllOldValSQL: query.New(fmt.Sprintf(`
 			SELECT current_rev, compact_rev, %s
 			FROM (%s) AS current, (%s) AS compact, kine
-			WHERE id > ?
+			WHERE id > ? %%s
 			ORDER BY id ASC`,
 			WithOldVal, CurrentRevSQL, CompactRevSQL), paramCharacter, numbered, "AfterAllOldVal"),
 
@@ -274,7 +469,7 @@ func OpenDB(ctx context.Context, wg *sync.WaitGroup, driverName string, connecto
 			SELECT current_rev, compact_rev, %s
 			FROM (%s) AS current, (%s) AS compact, kine
 			WHERE name = ?
-			AND id > ?
+			AND id > ? %%s
 			ORDER BY id ASC`,
 			WithOldVal, CurrentRevSQL, CompactRevSQL), paramCharacter, numbered, "AfterSingleOldVal"),
 
@@ -283,25 +478,74 @@ func OpenDB(ctx context.Context, wg *sync.WaitGroup, driverName string, connecto
 			WHERE id = ?`,
 			paramCharacter, numbered, "Delete"),
 
+		// Commit times are not unique nor strictly increasing with the revision, but
+		// ordering by them lets the lookup stop at the first matching index entry.
+		RevisionAtSQL: query.New(`
+			SELECT id
+			FROM kine
+			WHERE committed <= ?
+			ORDER BY committed DESC, id DESC
+			LIMIT 1`,
+			paramCharacter, numbered, "RevisionAt"),
+
 		UpdateCompactSQL: query.New(`
 			UPDATE kine
 			SET prev_revision = ?
 			WHERE name = 'compact_rev_key'`,
 			paramCharacter, numbered, "UpdateCompact"),
 
+		// The keys under a prefix are compacted like every key is by CompactSQL, past
+		// the compact revision of the others.
+		CompactPrefixSQL: query.New(`
+			DELETE FROM kine
+			WHERE id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name LIKE ? ESCAPE '!' AND
+					kp.prev_revision != 0 AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.name LIKE ? ESCAPE '!' AND
+					kd.deleted != 0 AND
+					kd.id <= ?)`,
+			paramCharacter, numbered, "CompactPrefix"),
+
+		PrefixCompactRevSQL: query.New(`SELECT revision FROM kine_compact_prefixes WHERE prefix = ?`,
+			paramCharacter, numbered, "PrefixCompactRev"),
+
+		PrefixCompactRevsSQL: query.New(`SELECT prefix, revision FROM kine_compact_prefixes`,
+			paramCharacter, numbered, "PrefixCompactRevs"),
+
+		UpdatePrefixCompactSQL: query.New(`
+			INSERT INTO kine_compact_prefixes(prefix, revision)
+			VALUES(?, ?)
+			ON CONFLICT (prefix) DO UPDATE SET revision = excluded.revision`,
+			paramCharacter, numbered, "UpdatePrefixCompact"),
+
 		InsertLastInsertIDSQL: query.New(`
-			INSERT INTO kine(name, uid, created, deleted, create_revision, prev_revision, lease, value, old_value)
-			SELECT ?, ?, ?, ?, ?, ?, ?, ?, (SELECT value FROM kine WHERE id = ?) AS old_value`,
+			INSERT INTO kine(name, uid, created, deleted, create_revision, prev_revision, lease, value, old_value, committed)
+			SELECT ?, ?, ?, ?, ?, ?, ?, ?, (SELECT value FROM kine WHERE id = ?) AS old_value, ?`,
 			paramCharacter, numbered, "InsertLastInsertID"),
 
+		// The row is recorded as the current row of its key by the same statement, so
+		// that a retried insert does not have to run in a transaction of its own.
 		InsertSQL: query.New(`
-			INSERT INTO kine(name, uid, created, deleted, create_revision, prev_revision, lease, value, old_value)
-			SELECT ?, ?, ?, ?, ?, ?, ?, ?, (SELECT value FROM kine WHERE id = ?) AS old_value RETURNING id`,
+			WITH kv AS (
+				INSERT INTO kine(name, uid, created, deleted, create_revision, prev_revision, lease, value, old_value, committed)
+				SELECT ?, ?, ?, ?, ?, ?, ?, ?, (SELECT value FROM kine WHERE id = ?) AS old_value, ? RETURNING id, name
+			)
+			INSERT INTO kine_current(name, id) SELECT name, id FROM kv
+			ON CONFLICT (name) DO UPDATE SET id = excluded.id
+			RETURNING id`,
 			paramCharacter, numbered, "Insert"),
 
 		FillSQL: query.New(`
-			INSERT INTO kine(id, name, uid, created, deleted, create_revision, prev_revision, lease, value, old_value)
-			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			INSERT INTO kine(id, name, uid, created, deleted, create_revision, prev_revision, lease, value, old_value, committed)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 			paramCharacter, numbered, "Fill"),
 	}, err
 }
@@ -362,6 +606,18 @@ func (d *Generic) GetCompactRevision(ctx context.Context) (int64, error) {
 	return id, err
 }
 
+// RevisionAt returns the last revision committed at or before t, or 0 if there is
+// none. Rows written before commit times were recorded are not considered.
+func (d *Generic) RevisionAt(ctx context.Context, t time.Time) (int64, error) {
+	var id int64
+	row := d.queryRow(ctx, d.RevisionAtSQL, t.UnixNano())
+	err := row.Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
 func (d *Generic) SetCompactRevision(ctx context.Context, revision int64) error {
 	logrus.Tracef("SETCOMPACTREVISION %v", revision)
 	_, err := d.execute(ctx, d.UpdateCompactSQL, revision)
@@ -370,13 +626,90 @@ func (d *Generic) SetCompactRevision(ctx context.Context, revision int64) error
 
 func (d *Generic) Compact(ctx context.Context, revision int64) (int64, error) {
 	logrus.Tracef("COMPACT %v", revision)
-	res, err := d.execute(ctx, d.CompactSQL, revision, revision)
+	return compact(ctx, d, d, revision)
+}
+
+// compact deletes the rows compacted by revision, and repairs the current rows
+// recorded for the revisions compacted since the last compaction: the rows of keys
+// whose latest row was a deletion are dropped, and the latest rows that were not
+// recorded, for instance because they were written by an earlier kine, are added.
+func compact(ctx context.Context, d *Generic, g generic, revision int64) (int64, error) {
+	var compactRev int64
+	if err := g.queryRow(ctx, d.CompactRevSQL).Scan(&compactRev); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	res, err := g.execute(ctx, d.CompactSQL, revision, revision)
 	if err != nil {
 		return 0, err
 	}
+	if _, err := g.execute(ctx, d.PruneCurrentSQL, compactRev, revision); err != nil {
+		return 0, err
+	}
+	if _, err := g.execute(ctx, d.RepairCurrentSQL, compactRev, revision); err != nil {
+		return 0, err
+	}
 	return res.RowsAffected()
 }
 
+// CompactPrefix compacts the keys under prefix to revision in a transaction of its
+// own, unless they already are, and returns the number of rows it deleted.
+func (d *Generic) CompactPrefix(ctx context.Context, prefix string, revision int64) (int64, error) {
+	logrus.Tracef("COMPACTPREFIX %s %v", prefix, revision)
+	t, err := d.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return 0, err
+	}
+	defer t.MustRollback()
+
+	tx := t.(*Tx)
+	var compactRev int64
+	if err := tx.queryRow(ctx, d.PrefixCompactRevSQL, prefix).Scan(&compactRev); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if revision <= compactRev {
+		return 0, server.ErrCompacted
+	}
+
+	likePrefix := likeEscaper.Replace(prefix) + "%"
+	res, err := tx.execute(ctx, d.CompactPrefixSQL, likePrefix, revision, likePrefix, revision)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.execute(ctx, d.PruneCurrentSQL, compactRev, revision); err != nil {
+		return 0, err
+	}
+	if _, err := tx.execute(ctx, d.UpdatePrefixCompactSQL, prefix, revision); err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return deleted, tx.Commit()
+}
+
+// PrefixCompactRevisions returns the revisions that the keys under each prefix were
+// compacted to by CompactPrefix.
+func (d *Generic) PrefixCompactRevisions(ctx context.Context) (map[string]int64, error) {
+	rows, err := d.query(ctx, d.PrefixCompactRevsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := map[string]int64{}
+	for rows.Next() {
+		var prefix string
+		var revision int64
+		if err := rows.Scan(&prefix, &revision); err != nil {
+			return nil, err
+		}
+		revisions[prefix] = revision
+	}
+	return revisions, rows.Err()
+}
+
 func (d *Generic) PostCompact(ctx context.Context) error {
 	logrus.Trace("POSTCOMPACT")
 	if d.PostCompactSQL != nil {
@@ -416,7 +749,7 @@ func (d *Generic) ListCurrent(ctx context.Context, key, end string, limit int64,
 			sql = d.ListCurrentValSQL
 		}
 		var err error
-		selectors, args, err = renderSelectorsWhere(sql.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL)
+		selectors, args, err = renderSelectorsWhere(sql.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL, d.FieldContainsSQL, d.SelectorIntegerSQL, d.IndexFieldValues)
 		if err != nil {
 			return nil, err
 		}
@@ -449,7 +782,7 @@ func (d *Generic) List(ctx context.Context, key, end string, limit, revision int
 				sql = d.ListRevisionStartValSQL
 			}
 			var err error
-			selectors, args, err = renderSelectorsWhere(sql.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL)
+			selectors, args, err = renderSelectorsWhere(sql.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL, d.FieldContainsSQL, d.SelectorIntegerSQL, d.IndexFieldValues)
 			if err != nil {
 				return nil, err
 			}
@@ -480,7 +813,7 @@ func (d *Generic) List(ctx context.Context, key, end string, limit, revision int
 			sql = d.GetRevisionAfterValSQL
 		}
 		var err error
-		selectors, args, err = renderSelectorsWhere(sql.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL)
+		selectors, args, err = renderSelectorsWhere(sql.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL, d.FieldContainsSQL, d.SelectorIntegerSQL, d.IndexFieldValues)
 		if err != nil {
 			return nil, err
 		}
@@ -511,7 +844,7 @@ func (d *Generic) CountCurrent(ctx context.Context, key, end string, labelSelect
 	var selectors string
 	if labelSelector != "" || fieldSelector != "" {
 		var err error
-		selectors, args, err = renderSelectorsWhere(d.CountCurrentSQL.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL)
+		selectors, args, err = renderSelectorsWhere(d.CountCurrentSQL.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL, d.FieldContainsSQL, d.SelectorIntegerSQL, d.IndexFieldValues)
 		if err != nil {
 			return 0, 0, err
 		}
@@ -541,7 +874,7 @@ func (d *Generic) Count(ctx context.Context, key, end string, revision int64, la
 	var selectors string
 	if labelSelector != "" || fieldSelector != "" {
 		var err error
-		selectors, args, err = renderSelectorsWhere(d.CountRevisionSQL.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL)
+		selectors, args, err = renderSelectorsWhere(d.CountRevisionSQL.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL, d.FieldContainsSQL, d.SelectorIntegerSQL, d.IndexFieldValues)
 		if err != nil {
 			return 0, 0, 0, err
 		}
@@ -554,6 +887,13 @@ func (d *Generic) Count(ctx context.Context, key, end string, revision int64, la
 	return rev.Int64, compact.Int64, id, err
 }
 
+// IndexesRevisionMetadata reports whether the labels and fields of every revision are
+// indexed. With CurrentMetadataOnly, only those of the latest revision of each key are,
+// and selectors at past revisions must be matched by decoding values.
+func (d *Generic) IndexesRevisionMetadata() bool {
+	return !d.CurrentMetadataOnly
+}
+
 func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
 	var id int64
 	row := d.queryRow(ctx, d.CurrentRevSQL)
@@ -564,31 +904,43 @@ func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
 	return id, err
 }
 
-func (d *Generic) After(ctx context.Context, key, end string, rev, limit int64) (*sql.Rows, error) {
-	var sql *query.Named
-	if key == "" {
-		sql = d.AfterAllOldValSQL
-		if limit > 0 {
-			sql = sql.Appendf("LIMIT %d", limit)
-		}
-		return d.query(ctx, sql, rev)
+// After returns the rows of the revisions after rev of the keys from key to end. If
+// selectors are given, only the rows of the revisions that match them or whose previous
+// revision matches them are returned, the same events a watch with the selectors is
+// sent. A deletion has no metadata of its own, so it is matched by the revision it
+// deletes.
+func (d *Generic) After(ctx context.Context, key, end string, rev, limit int64, labelSelector, fieldSelector string) (*sql.Rows, error) {
+	var (
+		sql  *query.Named
+		args []any
+	)
+	switch {
+	case key == "":
+		sql, args = d.AfterAllOldValSQL, []any{rev}
+	case end == "":
+		sql, args = d.AfterSingleOldValSQL, []any{key, rev}
+	default:
+		sql, args = d.AfterOldValSQL, []any{key, end, rev}
 	}
-	if end == "" {
-		sql = d.AfterSingleOldValSQL
-		if limit > 0 {
-			sql = sql.Appendf("LIMIT %d", limit)
+
+	var selectors string
+	if labelSelector != "" || fieldSelector != "" {
+		var err error
+		selectors, args, err = renderEventSelectorsWhere(sql.String(), key, labelSelector, fieldSelector, args, d.SelectorLookupSQL, d.FieldContainsSQL, d.SelectorIntegerSQL, d.IndexFieldValues)
+		if err != nil {
+			return nil, err
 		}
-		return d.query(ctx, sql, key, rev)
 	}
-	sql = d.AfterOldValSQL
+
+	sql = &query.Named{Name: sql.Name, Query: fmt.Sprintf(sql.Query, selectors)}
 	if limit > 0 {
 		sql = sql.Appendf("LIMIT %d", limit)
 	}
-	return d.query(ctx, sql, key, end, rev)
+	return d.query(ctx, sql, args...)
 }
 
 func (d *Generic) Fill(ctx context.Context, revision int64) error {
-	_, err := d.execute(ctx, d.FillSQL, revision, fmt.Sprintf("gap-%d", revision), "", 0, 1, 0, 0, 0, nil, nil)
+	_, err := d.execute(ctx, d.FillSQL, revision, fmt.Sprintf("gap-%d", revision), "", 0, 1, 0, 0, 0, nil, nil, time.Now().UnixNano())
 	return err
 }
 
@@ -614,11 +966,32 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 		return
 	}
 
-	if _, ok := labels["skip-controller-manager-metadata-caching"]; ok && !create && len(finalizers) == 1 && finalizers[0] == metav1.FinalizerOrphanDependents {
+	// Deletions are written without a value, so the objects they delete are garbage
+	// collected by the metadata of their previous revision.
+	if delete && len(value) == 0 {
+		if len(prevValue) == 0 && previousRevision > 0 {
+			var q generic = d
+			if at := ctx.Value(txKey); at != nil {
+				q = at.(generic)
+			}
+			if err := q.queryRow(ctx, d.GetValueSQL, previousRevision).Scan(&prevValue); err != nil && err != sql.ErrNoRows {
+				return 0, err
+			}
+		}
+		if _, prevUID, prevLabels, _, prevOwners, _, dErr := decodeObject(key, prevValue); dErr == nil {
+			uid, labels, owners = prevUID, prevLabels, prevOwners
+		}
+	}
+
+	if _, ok := labels[gcLabel]; ok && !create && len(finalizers) == 1 && finalizers[0] == metav1.FinalizerOrphanDependents {
 		delete = true
 	}
 
-	if len(labels) > 0 || !fieldsSet.AsSelector().Empty() || delete {
+	// The row is recorded as the current row of its key by the insert itself, through
+	// a trigger or otherwise, unless the dialect sets InsertCurrentSQL: that statement
+	// must be in the same transaction as the insert.
+	needsMetadata := len(labels) > 0 || !fieldsSet.AsSelector().Empty() || delete
+	if needsMetadata || d.InsertCurrentSQL != nil {
 		var t server.Transaction
 		if at := ctx.Value(txKey); at != nil {
 			t = at.(server.Transaction)
@@ -642,10 +1015,12 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 				return
 			}
 
-			if err = t.InsertMetadata(ctx, id, key, createRevision, value, prevValue, obj, uid, labels, fieldsSet, owners, finalizers, delete); err != nil {
-				id = 0
+			if needsMetadata {
+				if err = t.InsertMetadata(ctx, id, key, createRevision, value, prevValue, obj, uid, labels, fieldsSet, owners, finalizers, delete); err != nil {
+					id = 0
 
-				return
+					return
+				}
 			}
 
 			if ctx.Value(txKey) == nil {
@@ -658,6 +1033,7 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 
 	cVal := 0
 	dVal := 0
+	committed := time.Now().UnixNano()
 	if create {
 		cVal = 1
 	}
@@ -666,10 +1042,15 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 	}
 
 	if d.LastInsertID {
-		row, err := g.execute(ctx, d.InsertLastInsertIDSQL, key, uid, cVal, dVal, createRevision, previousRevision, ttl, value, previousRevision)
+		row, err := g.execute(ctx, d.InsertLastInsertIDSQL, key, uid, cVal, dVal, createRevision, previousRevision, ttl, value, previousRevision, committed)
 		if err != nil {
 			return 0, err
 		}
+		if d.InsertCurrentSQL != nil {
+			if _, err := g.execute(ctx, d.InsertCurrentSQL); err != nil {
+				return 0, err
+			}
+		}
 		return row.LastInsertId()
 	}
 
@@ -680,7 +1061,7 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 	// duplicate key error to the client.
 	wait := strategy.Backoff(backoff.Linear(100 + time.Millisecond))
 	for i := uint(0); i < 20; i++ {
-		row := g.queryRow(ctx, d.InsertSQL, key, uid, cVal, dVal, createRevision, previousRevision, ttl, value, previousRevision)
+		row := g.queryRow(ctx, d.InsertSQL, key, uid, cVal, dVal, createRevision, previousRevision, ttl, value, previousRevision, committed)
 		err = row.Scan(&id)
 
 		if err != nil && d.InsertRetry != nil && d.InsertRetry(err) {
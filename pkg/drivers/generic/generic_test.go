@@ -0,0 +1,133 @@
+package generic_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/internal/testutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCurrentRowsAreMaintained(t *testing.T) {
+	ctx, backend, dialect := testutil.NewDialect(t)
+
+	rowsByName := func(sql string) map[string]int64 {
+		t.Helper()
+		rows, err := dialect.DB.QueryContext(ctx, sql)
+		if err != nil {
+			t.Fatalf("failed to query rows: %v", err)
+		}
+		defer rows.Close()
+		ids := map[string]int64{}
+		for rows.Next() {
+			var name string
+			var id int64
+			if err := rows.Scan(&name, &id); err != nil {
+				t.Fatalf("failed to scan row: %v", err)
+			}
+			ids[name] = id
+		}
+		return ids
+	}
+	checkCurrent := func(when string) {
+		t.Helper()
+		current := rowsByName(`SELECT name, id FROM kine_current`)
+		latest := rowsByName(`SELECT name, MAX(id) FROM kine GROUP BY name`)
+		if !maps.Equal(latest, current) {
+			t.Errorf("%s: expected current rows %v, got %v", when, latest, current)
+		}
+	}
+	listed := func(when string, want ...string) {
+		t.Helper()
+		_, kvs, err := backend.List(ctx, testutil.PodsPrefix, testutil.PodsEnd, 0, 0, false, "", "")
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		keys := []string{}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		if !slices.Equal(want, keys) {
+			t.Errorf("%s: expected %v, got %v", when, want, keys)
+		}
+		if _, count, err := backend.Count(ctx, testutil.PodsPrefix, testutil.PodsEnd, 0, "", ""); err != nil {
+			t.Fatalf("count failed: %v", err)
+		} else if count != int64(len(want)) {
+			t.Errorf("%s: expected a count of %d, got %d", when, len(want), count)
+		}
+	}
+	compact := func() {
+		t.Helper()
+		rev, err := backend.CurrentRevision(ctx)
+		if err != nil {
+			t.Fatalf("failed to get current revision: %v", err)
+		}
+		tx, err := dialect.BeginTx(ctx, &sql.TxOptions{})
+		if err != nil {
+			t.Fatalf("failed to begin transaction: %v", err)
+		}
+		defer tx.MustRollback()
+		if _, err := tx.Compact(ctx, rev); err != nil {
+			t.Fatalf("failed to compact: %v", err)
+		}
+		if err := tx.SetCompactRevision(ctx, rev); err != nil {
+			t.Fatalf("failed to set compact revision: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("failed to commit compaction: %v", err)
+		}
+	}
+
+	a, b, c := testutil.NewPod("default", "a", "node1"), testutil.NewPod("default", "b", "node1"), testutil.NewPod("default", "c", "node1")
+	testutil.CreatePods(ctx, t, backend, []*corev1.Pod{a, b, c})
+	if _, err := backend.Create(ctx, "/registry/plain", []byte("{}"), 0); err != nil {
+		t.Fatalf("failed to create plain key: %v", err)
+	}
+
+	a.Spec.NodeName = "node2"
+	value, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("failed to marshal pod: %v", err)
+	}
+	_, kv, err := backend.Get(ctx, testutil.PodKey(a), 0, false)
+	if err != nil {
+		t.Fatalf("failed to get %s: %v", testutil.PodKey(a), err)
+	}
+	if _, _, updated, err := backend.Update(ctx, testutil.PodKey(a), value, kv.ModRevision, 0); err != nil || !updated {
+		t.Fatalf("failed to update %s: updated=%v, err=%v", testutil.PodKey(a), updated, err)
+	}
+	if _, _, _, err := backend.Delete(ctx, testutil.PodKey(b), 0); err != nil {
+		t.Fatalf("failed to delete %s: %v", testutil.PodKey(b), err)
+	}
+	checkCurrent("after writing")
+	listed("after writing", testutil.PodKey(a), testutil.PodKey(c))
+
+	// the deletion of b is compacted away
+	compact()
+	checkCurrent("after compacting")
+	if _, ok := rowsByName(`SELECT name, id FROM kine_current`)[testutil.PodKey(b)]; ok {
+		t.Errorf("expected no current row for compacted %s", testutil.PodKey(b))
+	}
+
+	// rows that were not recorded are repaired by the next compaction
+	d := testutil.NewPod("default", "d", "node1")
+	testutil.CreatePods(ctx, t, backend, []*corev1.Pod{d})
+	if _, err := dialect.DB.ExecContext(ctx, `DELETE FROM kine_current WHERE name = ?`, testutil.PodKey(d)); err != nil {
+		t.Fatalf("failed to delete current row: %v", err)
+	}
+	listed("before repairing", testutil.PodKey(a), testutil.PodKey(c))
+	compact()
+	checkCurrent("after repairing")
+	listed("after repairing", testutil.PodKey(a), testutil.PodKey(c), testutil.PodKey(d))
+
+	// an empty table is filled from the existing rows
+	if _, err := dialect.DB.ExecContext(ctx, `DELETE FROM kine_current`); err != nil {
+		t.Fatalf("failed to empty current rows: %v", err)
+	}
+	dialect.MigrateCurrent(ctx)
+	checkCurrent("after migrating")
+	listed("after migrating", testutil.PodKey(a), testutil.PodKey(c), testutil.PodKey(d))
+}
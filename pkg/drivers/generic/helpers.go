@@ -6,20 +6,21 @@ import (
 	"strconv"
 	"strings"
 
+	jsoniter "github.com/json-iterator/go"
 	"github.com/k3s-io/kine/pkg/util"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured/unstructuredscheme"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/apimachinery/pkg/runtime/serializer/json"
 	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/types"
 )
 
 var (
-	decoder             = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
 	unstructuredDecoder = json.NewSerializerWithOptions(
 		json.DefaultMetaFactory,
 		unstructuredscheme.NewUnstructuredCreator(),
@@ -27,50 +28,130 @@ var (
 		json.SerializerOptions{Yaml: true, Pretty: false, Strict: false},
 	)
 
-	labelsSelect = ` AND %s IN (
-		SELECT kine_id
+	labelExists = `EXISTS (
+		SELECT 1
 		FROM kine_labels
-		WHERE kine_name LIKE ? AND (%s)
-		GROUP BY kine_id
-		HAVING COUNT(kine_id) = ?
-	)
-	`
+		WHERE kine_id = %s AND name = ?%s
+	)`
 
 	fieldsSelect = ` AND %s IN (
 		SELECT kine_id
 		FROM kine_fields
-		WHERE kine_name LIKE ? AND (%s)
+		WHERE kine_name LIKE ? ESCAPE '!' AND (%s)
 		GROUP BY kine_id
 	)
 	`
 
+	fieldValueIn = `%s IN (
+		SELECT kine_id
+		FROM kine_field_values
+		WHERE name = ? AND value %s ? AND kine_name LIKE ? ESCAPE '!'
+	)`
+
+	fieldValueExists = `%sEXISTS (
+		SELECT 1
+		FROM kine_field_values
+		WHERE kine_id = %s AND kine_name LIKE ? ESCAPE '!'%s
+	)`
+
 	paramsRegex = regexp.MustCompile(`\?`)
+
+	// likeEscaper quotes LIKE metacharacters so key prefixes are matched literally.
+	// The escape character is declared explicitly with ESCAPE '!', as sqlite has no
+	// default and backslash would need different quoting on mysql and postgres.
+	likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
 )
 
 func decodeObject(key string, value []byte) (runtime.Object, types.UID, map[string]string, fields.Set, []metav1.OwnerReference, []string, error) {
-	obj := util.GetObjectByKey(key)
-	if _, _, err := decoder.Decode(value, nil, obj); err != nil {
+	obj, err := util.DecodeObject(key, value)
+	if err != nil {
 		return nil, "", nil, nil, nil, nil, err
 	}
 
-	return obj, util.GetUIDByObject(obj), util.GetLabelsSetByObject(obj), util.GetFieldsSetByObject(obj, value), util.GetOwnersByObject(obj), util.GetFinalizersByObject(obj), nil
+	return obj, util.GetUIDByObject(obj), util.GetLabelsSetByObject(obj), util.GetFieldsSetByObject(key, obj, value), util.GetOwnersByObject(obj), util.GetFinalizersByObject(obj), nil
+}
+
+// objectMeta decodes the metadata of a stored value, in any of the media types read by
+// util.DecodeObject.
+func objectMeta(key string, value []byte) (metav1.Object, error) {
+	obj, err := util.DecodeObject(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Accessor(obj)
 }
 
-func renderSelectorsWhere(sql, prefix, labelSelector, fieldSelector string, args []any, selectorLookupSQL string) (string, []any, error) {
-	id := "id"
+// updateObjectMeta applies update to the metadata of a stored value, and returns the
+// value encoded again in its media type.
+func updateObjectMeta(value []byte, update func(metav1.Object)) ([]byte, error) {
+	if util.IsProtobuf(value) {
+		return util.UpdateProtobufObjectMeta(value, func(objectMeta *metav1.ObjectMeta) {
+			update(objectMeta)
+		})
+	}
 
-	numbered := strings.Contains(sql, "$")
+	obj := &unstructured.Unstructured{}
+	if _, _, err := unstructuredDecoder.Decode(value, nil, obj); err != nil {
+		return nil, err
+	}
+	update(obj)
+	return jsoniter.Marshal(obj)
+}
+
+// fieldValues returns fieldsSet with the dots in field names replaced with
+// underscores, so that the names are single JSON path segments.
+func fieldValues(fieldsSet fields.Set) map[string]string {
+	fieldsMap := map[string]string{}
+	for k, v := range fieldsSet {
+		fieldsMap[strings.ReplaceAll(k, ".", "_")] = v
+	}
+	return fieldsMap
+}
 
-	if !strings.HasSuffix(prefix, "%") {
-		prefix += "%"
+// fieldsJSON encodes fieldsSet as the JSON object stored in kine_fields.
+func fieldsJSON(fieldsSet fields.Set) (string, error) {
+	return jsoniter.MarshalToString(fieldValues(fieldsSet))
+}
+
+func renderSelectorsWhere(sql, prefix, labelSelector, fieldSelector string, args []any, selectorLookupSQL, fieldContainsSQL, selectorIntegerSQL string, indexFieldValues bool) (string, []any, error) {
+	return renderColumnSelectorsWhere("id", sql, prefix, labelSelector, fieldSelector, args, selectorLookupSQL, fieldContainsSQL, selectorIntegerSQL, indexFieldValues)
+}
+
+// renderEventSelectorsWhere compiles the selectors into a clause matching the rows of
+// kine whose own metadata matches them, or whose previous revision's does unless they
+// create their key, as watch events are filtered.
+func renderEventSelectorsWhere(sql, prefix, labelSelector, fieldSelector string, args []any, selectorLookupSQL, fieldContainsSQL, selectorIntegerSQL string, indexFieldValues bool) (string, []any, error) {
+	kvWhere, args, err := renderColumnSelectorsWhere("id", sql, prefix, labelSelector, fieldSelector, args, selectorLookupSQL, fieldContainsSQL, selectorIntegerSQL, indexFieldValues)
+	if err != nil {
+		return "", args, err
+	}
+
+	prevWhere, args, err := renderColumnSelectorsWhere("prev_revision", sql, prefix, labelSelector, fieldSelector, args, selectorLookupSQL, fieldContainsSQL, selectorIntegerSQL, indexFieldValues)
+	if err != nil {
+		return "", args, err
 	}
 
-	labelsWhere, args, err := renderLabelSelectorWhere(id, prefix, labelSelector, args, numbered)
+	return " AND ((1 = 1" + kvWhere + ") OR (created = 0" + prevWhere + "))\n", args, nil
+}
+
+// renderColumnSelectorsWhere compiles the selectors into a clause matching the rows
+// whose metadata is indexed under the kine id in column id.
+func renderColumnSelectorsWhere(id, sql, prefix, labelSelector, fieldSelector string, args []any, selectorLookupSQL, fieldContainsSQL, selectorIntegerSQL string, indexFieldValues bool) (string, []any, error) {
+	numbered := strings.Contains(sql, "$")
+
+	prefix = likeEscaper.Replace(prefix) + "%"
+
+	labelsWhere, args, err := renderLabelSelectorWhere(id, labelSelector, args, numbered, selectorIntegerSQL)
 	if err != nil {
 		return "", args, err
 	}
 
-	fieldsWhere, args, err := renderFieldSelectorWhere(id, prefix, fieldSelector, args, numbered, selectorLookupSQL)
+	var fieldsWhere string
+	if indexFieldValues {
+		fieldsWhere, args, err = renderFieldValuesWhere(id, prefix, fieldSelector, args, numbered)
+	} else {
+		fieldsWhere, args, err = renderFieldSelectorWhere(id, prefix, fieldSelector, args, numbered, selectorLookupSQL, fieldContainsSQL)
+	}
 	if err != nil {
 		return "", args, err
 	}
@@ -78,7 +159,13 @@ func renderSelectorsWhere(sql, prefix, labelSelector, fieldSelector string, args
 	return labelsWhere + fieldsWhere, args, nil
 }
 
-func renderLabelSelectorWhere(id, prefix, labelSelector string, args []any, numbered bool) (string, []any, error) {
+// renderLabelSelectorWhere compiles a label selector into one EXISTS or NOT EXISTS
+// clause per requirement, correlated on kine_labels.kine_id, so that every operator
+// has the labels.Selector semantics: != and notin also match objects without the
+// label, and > and < only match values that parse as base-10 int64.
+// selectorIntegerSQL is the dialect's expression yielding value as an integer, or
+// NULL when it is not one.
+func renderLabelSelectorWhere(id, labelSelector string, args []any, numbered bool, selectorIntegerSQL string) (string, []any, error) {
 	if labelSelector == "" {
 		return "", args, nil
 	}
@@ -99,48 +186,43 @@ func renderLabelSelectorWhere(id, prefix, labelSelector string, args []any, numb
 
 	argsN := len(args)
 
-	args = append(args, prefix)
-
 	wheres := []string{}
 	for _, req := range reqs {
 		valueList := req.Values().List()
+		args = append(args, req.Key())
 		switch req.Operator() {
+		case selection.Exists:
+			wheres = append(wheres, fmt.Sprintf(labelExists, id, ""))
 		case selection.DoesNotExist:
-			wheres = append(wheres, "(kine_id NOT IN (SELECT kine_id FROM kine_labels WHERE kine_name LIKE ? AND name = ? GROUP BY kine_id))")
-			args = append(args, prefix, req.Key())
-		case selection.DoubleEquals, selection.Equals:
-			wheres = append(wheres, "(name = ? AND value = ?)")
-			args = append(args, req.Key(), valueList[0])
-		case selection.In:
-			wheres = append(wheres, "(name = ? AND value IN ("+inGen(len(valueList))+"))")
-			args = append(args, req.Key())
+			wheres = append(wheres, "NOT "+fmt.Sprintf(labelExists, id, ""))
+		case selection.DoubleEquals, selection.Equals, selection.In:
+			wheres = append(wheres, fmt.Sprintf(labelExists, id, " AND value IN ("+inGen(len(valueList))+")"))
 			for _, v := range valueList {
 				args = append(args, v)
 			}
-		case selection.NotEquals:
-			wheres = append(wheres, "(name = ? AND value != ?)")
-			args = append(args, req.Key(), valueList[0])
-		case selection.NotIn:
-			wheres = append(wheres, "(name = ? AND value NOT IN ("+inGen(len(valueList))+"))")
-			args = append(args, req.Key())
+		case selection.NotEquals, selection.NotIn:
+			wheres = append(wheres, "NOT "+fmt.Sprintf(labelExists, id, " AND value IN ("+inGen(len(valueList))+")"))
 			for _, v := range valueList {
 				args = append(args, v)
 			}
-		case selection.Exists:
-			wheres = append(wheres, "(name IN (?))")
-			args = append(args, req.Key())
-		case selection.GreaterThan:
-			wheres = append(wheres, "(name = ? AND value > ?)")
-			args = append(args, req.Key(), valueList[0])
-		case selection.LessThan:
-			wheres = append(wheres, "(name = ? AND value < ?)")
-			args = append(args, req.Key(), valueList[0])
+		case selection.GreaterThan, selection.LessThan:
+			// the parser has already checked that the value is an int64
+			value, err := strconv.ParseInt(valueList[0], 10, 64)
+			if err != nil {
+				return "", args, err
+			}
+			op := ">"
+			if req.Operator() == selection.LessThan {
+				op = "<"
+			}
+			wheres = append(wheres, fmt.Sprintf(labelExists, id, " AND "+selectorIntegerSQL+" "+op+" ?"))
+			args = append(args, value)
+		default:
+			return "", args, fmt.Errorf("unsupported label selector operator %q", req.Operator())
 		}
 	}
 
-	args = append(args, len(reqs))
-
-	where := fmt.Sprintf(labelsSelect, id, strings.Join(wheres, " OR "))
+	where := " AND " + strings.Join(wheres, " AND ") + "\n"
 	if numbered {
 		where = replaceParamsToNumbers(where, argsN)
 	}
@@ -148,7 +230,16 @@ func renderLabelSelectorWhere(id, prefix, labelSelector string, args []any, numb
 	return where, args, nil
 }
 
-func renderFieldSelectorWhere(id, prefix, fieldSelector string, args []any, numbered bool, selectorLookupSQL string) (string, []any, error) {
+// renderFieldSelectorWhere compiles a field selector into a kine_fields subquery.
+// selectorLookupSQL is the dialect's exact-match predicate for a single field; missing
+// fields must compare as the empty string, the same way fields.Set.Get reports them,
+// so that negating the predicate yields the fields.Selector semantics of !=.
+// fieldContainsSQL, if set, is the dialect's predicate for the fields containing a
+// JSON object of field values, which can be served by an index on them. It is used
+// for the requirements on non-empty values: the = ones are matched together, and each
+// != one is matched by negating it. Requirements on the empty value also match
+// missing fields, so they are always compiled with selectorLookupSQL.
+func renderFieldSelectorWhere(id, prefix, fieldSelector string, args []any, numbered bool, selectorLookupSQL, fieldContainsSQL string) (string, []any, error) {
 	if fieldSelector == "" {
 		return "", args, nil
 	}
@@ -163,9 +254,50 @@ func renderFieldSelectorWhere(id, prefix, fieldSelector string, args []any, numb
 	args = append(args, prefix)
 
 	wheres := []string{}
-	for _, req := range selector.Requirements() {
-		req.Field = strings.ReplaceAll(req.Field, ".", "_")
+	reqs := selector.Requirements()
+	for i := range reqs {
+		reqs[i].Field = strings.ReplaceAll(reqs[i].Field, ".", "_")
+	}
+
+	lookup := reqs
+	if fieldContainsSQL != "" {
+		lookup = fields.Requirements{}
+		contains := map[string]string{}
+		notContains := []map[string]string{}
+		for _, req := range reqs {
+			switch {
+			case req.Value == "":
+				lookup = append(lookup, req)
+			case req.Operator == selection.NotEquals:
+				notContains = append(notContains, map[string]string{req.Field: req.Value})
+			case contains[req.Field] != "":
+				// a second value for the same field can never match, but is left
+				// to the lookup rather than overwriting the first one
+				lookup = append(lookup, req)
+			default:
+				contains[req.Field] = req.Value
+			}
+		}
 
+		if len(contains) > 0 {
+			jsonData, err := jsoniter.MarshalToString(contains)
+			if err != nil {
+				return "", args, err
+			}
+			wheres = append(wheres, "("+fieldContainsSQL+")")
+			args = append(args, jsonData)
+		}
+		for _, notContain := range notContains {
+			jsonData, err := jsoniter.MarshalToString(notContain)
+			if err != nil {
+				return "", args, err
+			}
+			wheres = append(wheres, "(NOT "+fieldContainsSQL+")")
+			args = append(args, jsonData)
+		}
+	}
+
+	for _, req := range lookup {
 		sl := selectorLookupSQL
 		if strings.Contains(sl, "%s") {
 			sl = fmt.Sprintf(sl, req.Field)
@@ -191,6 +323,61 @@ func renderFieldSelectorWhere(id, prefix, fieldSelector string, args []any, numb
 	return where, args, nil
 }
 
+// renderFieldValuesWhere compiles a field selector into one clause per requirement on
+// kine_field_values, for dialects that index each field value in a row of its own.
+// The requirements on non-empty values are matched by an index on the field name and
+// value; missing fields compare as the empty string, the same way fields.Set.Get
+// reports them. As with kine_fields, only objects with indexed fields are matched.
+// Each clause is limited to the rows of keys under prefix, a LIKE pattern, so that a
+// field name shared by several resources only matches those of the one listed.
+func renderFieldValuesWhere(id, prefix, fieldSelector string, args []any, numbered bool) (string, []any, error) {
+	if fieldSelector == "" {
+		return "", args, nil
+	}
+
+	selector, err := fields.ParseSelector(fieldSelector)
+	if err != nil {
+		return "", args, err
+	}
+
+	argsN := len(args)
+
+	wheres := []string{}
+	matched := false
+	for _, req := range selector.Requirements() {
+		name := strings.ReplaceAll(req.Field, ".", "_")
+
+		equals := req.Operator != selection.NotEquals
+		switch {
+		case equals && req.Value != "":
+			wheres = append(wheres, fmt.Sprintf(fieldValueIn, id, "="))
+			args = append(args, name, req.Value, prefix)
+			matched = true
+		case equals:
+			wheres = append(wheres, fmt.Sprintf(fieldValueExists, "NOT ", id, " AND name = ? AND value != ?"))
+			args = append(args, prefix, name, "")
+		case req.Value != "":
+			wheres = append(wheres, fmt.Sprintf(fieldValueExists, "NOT ", id, " AND name = ? AND value = ?"))
+			args = append(args, prefix, name, req.Value)
+		default:
+			wheres = append(wheres, fmt.Sprintf(fieldValueIn, id, "!="))
+			args = append(args, name, "", prefix)
+			matched = true
+		}
+	}
+	if !matched {
+		wheres = append(wheres, fmt.Sprintf(fieldValueExists, "", id, ""))
+		args = append(args, prefix)
+	}
+
+	where := " AND " + strings.Join(wheres, " AND ") + "\n"
+	if numbered {
+		where = replaceParamsToNumbers(where, argsN)
+	}
+
+	return where, args, nil
+}
+
 func replaceParamsToNumbers(where string, args int) string {
 	pref := "$"
 	return paramsRegex.ReplaceAllStringFunc(where, func(string) string {
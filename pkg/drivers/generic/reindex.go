@@ -0,0 +1,290 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/query"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// explicit interface check
+var _ server.Reindexer = (*Generic)(nil)
+
+// errReindexMoved is returned when the progress of a reindex has been recorded by
+// another kine sharing the datastore since it was read.
+var errReindexMoved = errors.New("reindex progress was recorded concurrently")
+
+// reindexJob is the progress of a reindex, as stored in kine_reindex. Keys under
+// prefix are reindexed in name order, at their latest revision up to revision, and
+// lastKey is the last key whose metadata has been rebuilt.
+type reindexJob struct {
+	prefix      string
+	fingerprint string
+	revision    int64
+	lastKey     string
+	finished    bool
+}
+
+// reindexRow is a row selected for reindexing.
+type reindexRow struct {
+	id      int64
+	key     string
+	deleted bool
+	value   []byte
+}
+
+// Reindex rebuilds the metadata of every key under prefix, resuming the unfinished
+// reindex of prefix if it was started with the current configuration.
+func (d *Generic) Reindex(ctx context.Context, prefix string, batchSize int64) error {
+	return d.reindex(ctx, prefix, batchSize, true)
+}
+
+// ReindexStale rebuilds the metadata of the keys under every prefix whose metadata
+// was last indexed with a different configuration than the current one, and resumes
+// the unfinished reindexes. Prefixes being reindexed by another kine are skipped.
+func (d *Generic) ReindexStale(ctx context.Context, batchSize int64) error {
+	errs := []error{}
+	for _, prefix := range util.MetadataPrefixes() {
+		if err := d.reindex(ctx, prefix, batchSize, false); errors.Is(err, errReindexMoved) {
+			logrus.Debugf("Reindex of %s is progressing elsewhere: %v", prefix, err)
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("reindex of %s: %w", prefix, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reindex runs the reindex of prefix to completion. A new one is started if there is
+// none, if it was started with a different configuration, or if it has finished and
+// force is set.
+func (d *Generic) reindex(ctx context.Context, prefix string, batchSize int64, force bool) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("reindex batch size %d must be positive", batchSize)
+	}
+
+	fingerprint := util.MetadataFingerprint(prefix)
+	job, err := d.getReindexJob(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case job == nil || job.fingerprint != fingerprint || (job.finished && force):
+		if job, err = d.startReindexJob(ctx, prefix, fingerprint); err != nil {
+			return err
+		}
+		logrus.Infof("Reindexing metadata under %s up to revision %d", prefix, job.revision)
+	case job.finished:
+		return nil
+	default:
+		logrus.Infof("Resuming metadata reindex under %s up to revision %d after %s", prefix, job.revision, job.lastKey)
+	}
+
+	likePrefix := likeEscaper.Replace(prefix) + "%"
+
+	var remaining int64
+	if err := d.queryRow(ctx, d.CountReindexSQL, job.lastKey, likePrefix, d.reindexRevision(job)).Scan(&remaining); err != nil {
+		return err
+	}
+	gauge := metrics.ReindexRemainingKeys.WithLabelValues(prefix)
+	gauge.Set(float64(remaining))
+	defer metrics.ReindexRemainingKeys.DeleteLabelValues(prefix)
+
+	for !job.finished {
+		n, err := d.reindexBatch(ctx, job, likePrefix, batchSize)
+		if err != nil {
+			return err
+		}
+		gauge.Sub(float64(n))
+	}
+
+	logrus.Infof("Reindexed metadata under %s up to revision %d", prefix, job.revision)
+	return nil
+}
+
+// getReindexJob returns the reindex of prefix, or nil if none was ever started.
+func (d *Generic) getReindexJob(ctx context.Context, prefix string) (*reindexJob, error) {
+	job := &reindexJob{prefix: prefix}
+	err := d.queryRow(ctx, d.GetReindexSQL, prefix).Scan(&job.fingerprint, &job.revision, &job.lastKey, &job.finished)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// startReindexJob replaces the reindex of prefix with a new one up to the current
+// revision. Later revisions are indexed with the current configuration as they are
+// written.
+func (d *Generic) startReindexJob(ctx context.Context, prefix, fingerprint string) (*reindexJob, error) {
+	rev, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := d.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return nil, err
+	}
+	defer t.MustRollback()
+
+	tx := t.(*Tx)
+	if _, err := tx.execute(ctx, d.DeleteReindexSQL, prefix); err != nil {
+		return nil, err
+	}
+	if _, err := tx.execute(ctx, d.StartReindexSQL, prefix, fingerprint, rev); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &reindexJob{prefix: prefix, fingerprint: fingerprint, revision: rev}, nil
+}
+
+// reindexRevision returns the revision up to which the latest revision of each key is
+// reindexed. With CurrentMetadataOnly, only the metadata of the latest revision of each
+// key may be indexed, so keys written since the job started are reindexed at their
+// latest revision too.
+func (d *Generic) reindexRevision(job *reindexJob) int64 {
+	if d.CurrentMetadataOnly {
+		return math.MaxInt64
+	}
+	return job.revision
+}
+
+// reindexBatch reads and rebuilds the metadata of the next batchSize keys of job in
+// one transaction, together with the job's progress, and returns how many keys it
+// went through. The job is finished once a batch comes up short.
+func (d *Generic) reindexBatch(ctx context.Context, job *reindexJob, likePrefix string, batchSize int64) (int, error) {
+	t, err := d.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return 0, err
+	}
+	defer t.MustRollback()
+
+	tx := t.(*Tx)
+	rows, err := tx.query(ctx, d.ReindexBatchSQL, job.lastKey, likePrefix, d.reindexRevision(job), batchSize)
+	if err != nil {
+		return 0, err
+	}
+	batch := []reindexRow{}
+	for rows.Next() {
+		row := reindexRow{}
+		if err := rows.Scan(&row.id, &row.key, &row.deleted, &row.value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	indexed, failed := 0, 0
+	for _, row := range batch {
+		if row.deleted {
+			continue
+		}
+		_, _, labels, fieldsSet, owners, _, err := decodeObject(row.key, row.value)
+		if err != nil {
+			logrus.Debugf("Not reindexing %s at revision %d: %v", row.key, row.id, err)
+			failed++
+			continue
+		}
+		if err := tx.ReplaceMetadata(ctx, row.id, row.key, labels, fieldsSet, owners); err != nil {
+			return 0, err
+		}
+		indexed++
+	}
+
+	lastKey, finished := job.lastKey, int64(len(batch)) < batchSize
+	if len(batch) > 0 {
+		lastKey = batch[len(batch)-1].key
+	}
+	finishedVal := 0
+	if finished {
+		finishedVal = 1
+	}
+	res, err := tx.execute(ctx, d.UpdateReindexSQL, lastKey, finishedVal, job.prefix, job.fingerprint, job.lastKey)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, errReindexMoved
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	metrics.ReindexKeysTotal.WithLabelValues(metrics.ResultSuccess).Add(float64(indexed))
+	metrics.ReindexKeysTotal.WithLabelValues(metrics.ResultError).Add(float64(failed))
+	job.lastKey, job.finished = lastKey, finished
+
+	return len(batch), nil
+}
+
+// ReplaceMetadata replaces the labels, fields and owners indexed for the row id of
+// key with the given ones. With CurrentMetadataOnly, the labels and fields indexed for
+// any other row of key are dropped as well.
+func (t *Tx) ReplaceMetadata(ctx context.Context, id int64, key string, labels map[string]string, fieldsSet fields.Set, owners []metav1.OwnerReference) error {
+	labelsSQL, fieldsSQL, valuesSQL, arg := t.d.DeleteLabelsSQL, t.d.DeleteFieldsSQL, t.d.DeleteFieldValuesSQL, any(id)
+	if t.d.CurrentMetadataOnly {
+		labelsSQL, fieldsSQL, valuesSQL, arg = t.d.DeleteKeyLabelsSQL, t.d.DeleteKeyFieldsSQL, t.d.DeleteKeyFieldValuesSQL, key
+	}
+	sqls := []*query.Named{labelsSQL, fieldsSQL}
+	if t.d.IndexFieldValues {
+		sqls = append(sqls, valuesSQL)
+	}
+	for _, sql := range sqls {
+		if _, err := t.execute(ctx, sql, arg); err != nil {
+			return err
+		}
+	}
+	if _, err := t.execute(ctx, t.d.DeleteOwnersSQL, id); err != nil {
+		return err
+	}
+
+	for _, owner := range owners {
+		if _, err := t.execute(ctx, t.d.InsertOwnerSQL, id, owner.UID, owner.BlockOwnerDeletion); err != nil {
+			return err
+		}
+	}
+
+	for k, v := range labels {
+		if _, err := t.execute(ctx, t.d.InsertLabelSQL, id, key, k, v); err != nil {
+			return err
+		}
+	}
+
+	if len(fieldsSet) != 0 {
+		jsonData, err := fieldsJSON(fieldsSet)
+		if err != nil {
+			return err
+		}
+		if _, err := t.execute(ctx, t.d.InsertFieldsSQL, id, key, jsonData); err != nil {
+			return err
+		}
+
+		if t.d.IndexFieldValues {
+			for k, v := range fieldValues(fieldsSet) {
+				if _, err := t.execute(ctx, t.d.InsertFieldValueSQL, id, key, k, v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package generic_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/internal/testutil"
+	"github.com/k3s-io/kine/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestReindexRebuildsMetadata(t *testing.T) {
+	ctx, backend, dialect := testutil.NewDialect(t)
+
+	listed := func(fieldSelector string) []string {
+		t.Helper()
+		_, kvs, err := backend.List(ctx, testutil.PodsPrefix, testutil.PodsEnd, 0, 0, false, "", fieldSelector)
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		keys := []string{}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		return keys
+	}
+
+	pods := []*corev1.Pod{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		pod := testutil.NewPod("default", name, "node1")
+		pod.Spec.PriorityClassName = "high"
+		pods = append(pods, pod)
+	}
+	testutil.CreatePods(ctx, t, backend, pods)
+	if _, _, _, err := backend.Delete(ctx, testutil.PodKey(pods[4]), 0); err != nil {
+		t.Fatalf("failed to delete %s: %v", testutil.PodKey(pods[4]), err)
+	}
+
+	if err := util.SetExtraFields(map[string]map[string]string{
+		testutil.PodsPrefix: {"spec.priorityClassName": "$.spec.priorityClassName"},
+	}); err != nil {
+		t.Fatalf("failed to set extra fields: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = util.SetExtraFields(nil)
+	})
+
+	if keys := listed("spec.priorityClassName=high"); len(keys) != 0 {
+		t.Fatalf("expected no pods indexed by the extra field before reindexing, got %v", keys)
+	}
+
+	// an unfinished reindex is resumed after the last key it recorded
+	rev, err := dialect.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("failed to get current revision: %v", err)
+	}
+	if _, err := dialect.DB.ExecContext(ctx, `INSERT INTO kine_reindex(prefix, fingerprint, revision, last_key, finished) VALUES(?, ?, ?, ?, 0)`,
+		testutil.PodsPrefix, util.MetadataFingerprint(testutil.PodsPrefix), rev, testutil.PodKey(pods[1])); err != nil {
+		t.Fatalf("failed to record reindex progress: %v", err)
+	}
+	if err := dialect.Reindex(ctx, testutil.PodsPrefix, 2); err != nil {
+		t.Fatalf("reindex failed: %v", err)
+	}
+	if want, got := []string{testutil.PodKey(pods[2]), testutil.PodKey(pods[3])}, listed("spec.priorityClassName=high"); !slices.Equal(want, got) {
+		t.Errorf("after resumed reindex: expected %v, got %v", want, got)
+	}
+
+	// a finished reindex is started over when asked for explicitly
+	if err := dialect.Reindex(ctx, testutil.PodsPrefix, 2); err != nil {
+		t.Fatalf("reindex failed: %v", err)
+	}
+	want := []string{testutil.PodKey(pods[0]), testutil.PodKey(pods[1]), testutil.PodKey(pods[2]), testutil.PodKey(pods[3])}
+	if got := listed("spec.priorityClassName=high"); !slices.Equal(want, got) {
+		t.Errorf("after full reindex: expected %v, got %v", want, got)
+	}
+	if got := listed("metadata.name=a"); !slices.Equal([]string{testutil.PodKey(pods[0])}, got) {
+		t.Errorf("after full reindex: expected the metadata fields to be kept, got %v", got)
+	}
+
+	var fieldRows int
+	if err := dialect.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM kine_fields WHERE kine_name = ?`, testutil.PodKey(pods[0])).Scan(&fieldRows); err != nil {
+		t.Fatalf("failed to count fields rows: %v", err)
+	}
+	if fieldRows != 1 {
+		t.Errorf("expected the fields of %s to be replaced, got %d rows", testutil.PodKey(pods[0]), fieldRows)
+	}
+
+	// stale prefixes are the ones indexed with another configuration, or never
+	if err := dialect.ReindexStale(ctx, 2); err != nil {
+		t.Fatalf("reindex of stale prefixes failed: %v", err)
+	}
+	rows, err := dialect.DB.QueryContext(ctx, `SELECT prefix, fingerprint, finished FROM kine_reindex ORDER BY prefix`)
+	if err != nil {
+		t.Fatalf("failed to list reindex jobs: %v", err)
+	}
+	defer rows.Close()
+	jobs := []string{}
+	for rows.Next() {
+		var prefix, fingerprint string
+		var finished bool
+		if err := rows.Scan(&prefix, &fingerprint, &finished); err != nil {
+			t.Fatalf("failed to scan reindex job: %v", err)
+		}
+		if fingerprint != util.MetadataFingerprint(prefix) || !finished {
+			t.Errorf("expected reindex of %s to be finished with the current configuration", prefix)
+		}
+		jobs = append(jobs, prefix)
+	}
+	if want := []string{"/", testutil.PodsPrefix}; !slices.Equal(want, jobs) {
+		t.Errorf("expected reindex jobs %v, got %v", want, jobs)
+	}
+}
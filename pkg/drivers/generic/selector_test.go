@@ -0,0 +1,574 @@
+package generic_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/internal/testutil"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// sqliteFieldContainsSQL emulates JSONB containment with json_each, so that field
+// selectors can be compiled the way they are for postgres.
+const sqliteFieldContainsSQL = `NOT EXISTS (
+	SELECT 1 FROM json_each(?) AS want
+	WHERE json_extract(kine_fields.value, '$."' || want.key || '"') IS NOT want.value
+)`
+
+func TestFieldSelectorsMatchExactly(t *testing.T) {
+	testFieldSelectorsMatchExactly(t, true, "")
+}
+
+func TestFieldSelectorsMatchExactlyByLookup(t *testing.T) {
+	testFieldSelectorsMatchExactly(t, false, "")
+}
+
+func TestFieldSelectorsMatchExactlyByContainment(t *testing.T) {
+	testFieldSelectorsMatchExactly(t, false, sqliteFieldContainsSQL)
+}
+
+func testFieldSelectorsMatchExactly(t *testing.T, indexFieldValues bool, fieldContainsSQL string) {
+	ctx, backend, dialect := testutil.NewDialect(t)
+	dialect.IndexFieldValues = indexFieldValues
+	dialect.FieldContainsSQL = fieldContainsSQL
+
+	pods := []*corev1.Pod{
+		testutil.NewPod("default", "web", "node1"),
+		testutil.NewPod("default", "web-2", "node10"),
+		testutil.NewPod("default", "w_b", "node1"),
+		testutil.NewPod("default", "wxb", "node2"),
+		testutil.NewPod("default", "we%b", ""),
+		testutil.NewPod("kube-system", "web", "node1"),
+		testutil.NewPod("kube-system", "node1", "xnode1x"),
+	}
+
+	selectors := []string{
+		"metadata.name=web",
+		"metadata.name==web",
+		"metadata.name!=web",
+		"metadata.name=w_b",
+		"metadata.name=we%b",
+		"metadata.name=we",
+		"spec.nodeName=node1",
+		"spec.nodeName==node1",
+		"spec.nodeName!=node1",
+		"spec.nodeName=node",
+		"spec.nodeName=",
+		"spec.nodeName!=",
+		"metadata.namespace=default,spec.nodeName!=node1",
+		"metadata.namespace!=default,metadata.name=web",
+		"metadata.name=web,spec.nodeName=node10",
+		"metadata.name=web,metadata.name=w_b",
+		"metadata.name=web,metadata.name=web",
+		"metadata.name!=web,metadata.name!=w_b,spec.nodeName=",
+	}
+
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("failed to get current revision: %v", err)
+	}
+
+	watches := map[string]server.WatchResult{}
+	for _, selector := range selectors {
+		watches[selector] = backend.Watch(ctx, testutil.PodsPrefix, testutil.PodsEnd, rev+1, "", selector)
+	}
+
+	testutil.CreatePods(ctx, t, backend, pods)
+
+	for _, selector := range selectors {
+		t.Run(selector, func(t *testing.T) {
+			fs, err := fields.ParseSelector(selector)
+			if err != nil {
+				t.Fatalf("failed to parse selector: %v", err)
+			}
+
+			want := []string{}
+			for _, pod := range pods {
+				if fs.Matches(fields.Set{
+					"metadata.name":      pod.Name,
+					"metadata.namespace": pod.Namespace,
+					"spec.nodeName":      pod.Spec.NodeName,
+				}) {
+					want = append(want, testutil.PodKey(pod))
+				}
+			}
+			slices.Sort(want)
+
+			_, kvs, err := backend.List(ctx, testutil.PodsPrefix, testutil.PodsEnd, 0, 0, false, "", selector)
+			if err != nil {
+				t.Fatalf("list failed: %v", err)
+			}
+			listed := []string{}
+			for _, kv := range kvs {
+				listed = append(listed, kv.Key)
+			}
+			if !slices.Equal(want, listed) {
+				t.Errorf("list: expected %v, got %v", want, listed)
+			}
+
+			_, count, err := backend.Count(ctx, testutil.PodsPrefix, testutil.PodsEnd, 0, "", selector)
+			if err != nil {
+				t.Fatalf("count failed: %v", err)
+			}
+			if count != int64(len(want)) {
+				t.Errorf("count: expected %d, got %d", len(want), count)
+			}
+
+			watched := testutil.CollectWatch(t, watches[selector], len(want))
+			slices.Sort(watched)
+			if !slices.Equal(want, watched) {
+				t.Errorf("watch: expected %v, got %v", want, watched)
+			}
+		})
+	}
+}
+
+// TestLabelSelectorsMatchRandomly lists pods with random labels through random
+// selectors and compares the results against labels.Selector.Matches.
+func TestLabelSelectorsMatchRandomly(t *testing.T) {
+	ctx, backend := testutil.NewBackend(t)
+
+	keys := []string{"app", "tier", "example.com/rank", "version"}
+	values := []string{"a", "B", "b", "web", "0", "1", "9", "10", "010", "9223372036854775807", "0009223372036854775807", "9223372036854775808", "99999999999999999999"}
+	integers := []string{"0", "1", "9", "10", "9223372036854775806"}
+
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	rnd := rand.New(rand.NewPCG(uint64(seed), 0)) //nolint:gosec
+
+	pick := func(from []string) string {
+		return from[rnd.IntN(len(from))]
+	}
+
+	pods := []*corev1.Pod{}
+	podLabels := map[string]labels.Set{}
+	for i := range 60 {
+		pod := testutil.NewPod("default", fmt.Sprintf("pod-%d", i), "")
+		pod.Labels = map[string]string{}
+		for _, key := range keys {
+			if rnd.IntN(3) > 0 {
+				pod.Labels[key] = pick(values)
+			}
+		}
+		pods = append(pods, pod)
+		podLabels[testutil.PodKey(pod)] = pod.Labels
+	}
+	testutil.CreatePods(ctx, t, backend, pods)
+
+	requirement := func() string {
+		key := pick(keys)
+		switch rnd.IntN(9) {
+		case 0:
+			return key + "=" + pick(values)
+		case 1:
+			return key + "==" + pick(values)
+		case 2:
+			return key + "!=" + pick(values)
+		case 3:
+			return key + " in (" + pick(values) + "," + pick(values) + ")"
+		case 4:
+			return key + " notin (" + pick(values) + "," + pick(values) + ")"
+		case 5:
+			return key
+		case 6:
+			return "!" + key
+		case 7:
+			return key + ">" + pick(integers)
+		default:
+			return key + "<" + pick(integers)
+		}
+	}
+
+	for range 300 {
+		reqs := []string{}
+		for range 1 + rnd.IntN(3) {
+			reqs = append(reqs, requirement())
+		}
+		selector := strings.Join(reqs, ",")
+
+		ls, err := labels.Parse(selector)
+		if err != nil {
+			t.Fatalf("failed to parse selector %q: %v", selector, err)
+		}
+
+		want := []string{}
+		for _, pod := range pods {
+			if ls.Matches(podLabels[testutil.PodKey(pod)]) {
+				want = append(want, testutil.PodKey(pod))
+			}
+		}
+		slices.Sort(want)
+
+		_, kvs, err := backend.List(ctx, testutil.PodsPrefix, testutil.PodsEnd, 0, 0, false, selector, "")
+		if err != nil {
+			t.Fatalf("list %q failed: %v", selector, err)
+		}
+		listed := []string{}
+		for _, kv := range kvs {
+			listed = append(listed, kv.Key)
+		}
+		if !slices.Equal(want, listed) {
+			t.Errorf("list %q: expected %v, got %v", selector, want, listed)
+		}
+
+		_, count, err := backend.Count(ctx, testutil.PodsPrefix, testutil.PodsEnd, 0, selector, "")
+		if err != nil {
+			t.Fatalf("count %q failed: %v", selector, err)
+		}
+		if count != int64(len(want)) {
+			t.Errorf("count %q: expected %d, got %d", selector, len(want), count)
+		}
+	}
+}
+
+func TestProtobufObjectsAreIndexed(t *testing.T) {
+	ctx, backend := testutil.NewBackend(t)
+
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("failed to get current revision: %v", err)
+	}
+	wr := backend.Watch(ctx, "/registry/", "/registry0", rev+1, "app=web", "")
+
+	pod := testutil.NewPod("default", "web", "node1")
+	pod.Labels = map[string]string{"app": "web"}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "web",
+			Labels:    map[string]string{"app": "web"},
+		},
+		Data: map[string]string{"key": "value"},
+	}
+	values := map[string][]byte{
+		testutil.PodKey(pod):                 testutil.ProtobufValue(t, "v1", "Pod", pod),
+		"/registry/configmaps/default/web":   testutil.ProtobufValue(t, "v1", "ConfigMap", configMap),
+		"/registry/configmaps/default/other": testutil.ProtobufValue(t, "v1", "ConfigMap", &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other"}}),
+	}
+	for key, value := range values {
+		if _, err := backend.Create(ctx, key, value, 0); err != nil {
+			t.Fatalf("failed to create %s: %v", key, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		prefix, end, labelSelector, fieldSelector string
+		want                                      []string
+	}{
+		{testutil.PodsPrefix, testutil.PodsEnd, "", "spec.nodeName=node1", []string{testutil.PodKey(pod)}},
+		{testutil.PodsPrefix, testutil.PodsEnd, "app=web", "metadata.name=web", []string{testutil.PodKey(pod)}},
+		{"/registry/configmaps/", "/registry/configmaps0", "app=web", "", []string{"/registry/configmaps/default/web"}},
+		{"/registry/configmaps/", "/registry/configmaps0", "", "metadata.name=other", []string{"/registry/configmaps/default/other"}},
+	} {
+		_, kvs, err := backend.List(ctx, tc.prefix, tc.end, 0, 0, false, tc.labelSelector, tc.fieldSelector)
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		listed := []string{}
+		for _, kv := range kvs {
+			listed = append(listed, kv.Key)
+		}
+		if !slices.Equal(tc.want, listed) {
+			t.Errorf("list %q %q: expected %v, got %v", tc.labelSelector, tc.fieldSelector, tc.want, listed)
+		}
+	}
+
+	watched := testutil.CollectWatch(t, wr, 2)
+	slices.Sort(watched)
+	if want := []string{"/registry/configmaps/default/web", testutil.PodKey(pod)}; !slices.Equal(want, watched) {
+		t.Errorf("watch: expected %v, got %v", want, watched)
+	}
+}
+
+func TestEncryptedValuesAreIndexedByKey(t *testing.T) {
+	ctx, backend := testutil.NewBackend(t)
+
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("failed to get current revision: %v", err)
+	}
+	wr := backend.Watch(ctx, "/registry/", "/registry0", rev+1, "", "metadata.namespace=default")
+
+	keys := []string{
+		"/registry/secrets/default/token",
+		"/registry/secrets/kube-system/token",
+		"/registry/example.com/widgets/default/widget",
+		"/registry/example.com/clusterwidgets/widget",
+	}
+	for i, key := range keys {
+		value := append([]byte("k8s:enc:aescbc:v1:key1:"), byte(i), 0xff, 0x00, '{')
+		if _, err := backend.Create(ctx, key, value, 0); err != nil {
+			t.Fatalf("failed to create %s: %v", key, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		labelSelector, fieldSelector string
+		want                         []string
+	}{
+		{"", "metadata.namespace=default", []string{"/registry/example.com/widgets/default/widget", "/registry/secrets/default/token"}},
+		{"", "metadata.name=token", []string{"/registry/secrets/default/token", "/registry/secrets/kube-system/token"}},
+		{"", "metadata.name=widget,metadata.namespace=", []string{"/registry/example.com/clusterwidgets/widget"}},
+		{"", "metadata.namespace=kube-system,type=Opaque", []string{}},
+		{"app", "", []string{}},
+		{"!app", "metadata.namespace=kube-system", []string{"/registry/secrets/kube-system/token"}},
+	} {
+		_, kvs, err := backend.List(ctx, "/registry/", "/registry0", 0, 0, false, tc.labelSelector, tc.fieldSelector)
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		listed := []string{}
+		for _, kv := range kvs {
+			listed = append(listed, kv.Key)
+		}
+		if !slices.Equal(tc.want, listed) {
+			t.Errorf("list %q %q: expected %v, got %v", tc.labelSelector, tc.fieldSelector, tc.want, listed)
+		}
+	}
+
+	watched := testutil.CollectWatch(t, wr, 2)
+	slices.Sort(watched)
+	if want := []string{"/registry/example.com/widgets/default/widget", "/registry/secrets/default/token"}; !slices.Equal(want, watched) {
+		t.Errorf("watch: expected %v, got %v", want, watched)
+	}
+}
+
+func TestExtraFieldsAreIndexed(t *testing.T) {
+	ctx, backend, dialect := testutil.NewDialect(t)
+
+	withPriority := func(pod *corev1.Pod, priorityClassName string) *corev1.Pod {
+		pod.Spec.PriorityClassName = priorityClassName
+		return pod
+	}
+
+	// written before the extra field is configured, so not indexed by it
+	testutil.CreatePods(ctx, t, backend, []*corev1.Pod{withPriority(testutil.NewPod("default", "before", "node1"), "high")})
+
+	if err := util.SetExtraFields(map[string]map[string]string{
+		testutil.PodsPrefix: {"spec.priorityClassName": "$.spec.priorityClassName"},
+	}); err != nil {
+		t.Fatalf("failed to set extra fields: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = util.SetExtraFields(nil)
+	})
+
+	testutil.CreatePods(ctx, t, backend, []*corev1.Pod{
+		withPriority(testutil.NewPod("default", "high", "node1"), "high"),
+		withPriority(testutil.NewPod("default", "low", "node1"), "low"),
+		testutil.NewPod("default", "none", "node1"),
+	})
+	protobufPod := withPriority(testutil.NewPod("default", "protobuf", "node1"), "high")
+	if _, err := backend.Create(ctx, testutil.PodKey(protobufPod), testutil.ProtobufValue(t, "v1", "Pod", protobufPod), 0); err != nil {
+		t.Fatalf("failed to create %s: %v", testutil.PodKey(protobufPod), err)
+	}
+
+	for _, tc := range []struct {
+		fieldSelector string
+		want          []string
+	}{
+		{"spec.priorityClassName=high", []string{"/registry/pods/default/high", "/registry/pods/default/protobuf"}},
+		{"spec.priorityClassName=low,spec.nodeName=node1", []string{"/registry/pods/default/low"}},
+		{"spec.priorityClassName=", []string{"/registry/pods/default/before", "/registry/pods/default/none"}},
+	} {
+		_, kvs, err := backend.List(ctx, testutil.PodsPrefix, testutil.PodsEnd, 0, 0, false, "", tc.fieldSelector)
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		listed := []string{}
+		for _, kv := range kvs {
+			listed = append(listed, kv.Key)
+		}
+		if !slices.Equal(tc.want, listed) {
+			t.Errorf("list %q: expected %v, got %v", tc.fieldSelector, tc.want, listed)
+		}
+	}
+
+	missing, err := dialect.CountMissingField(ctx, testutil.PodsPrefix, "spec.priorityClassName")
+	if err != nil {
+		t.Fatalf("failed to count missing field: %v", err)
+	}
+	if missing != 1 {
+		t.Errorf("expected 1 row missing the extra field, got %d", missing)
+	}
+
+	if err := util.SetExtraFields(map[string]map[string]string{
+		testutil.PodsPrefix: {"spec.containers[0].image": "$.spec.containers[0].image"},
+	}); err == nil {
+		t.Errorf("expected an error for a field name that is not a dotted path")
+	}
+}
+
+func TestFieldValuesAreIndexed(t *testing.T) {
+	ctx, backend, dialect := testutil.NewDialect(t)
+
+	valueRows := func(key string) map[string]string {
+		t.Helper()
+		rows, err := dialect.DB.QueryContext(ctx, `SELECT name, value FROM kine_field_values WHERE kine_name = ?`, key)
+		if err != nil {
+			t.Fatalf("failed to query field values: %v", err)
+		}
+		defer rows.Close()
+		values := map[string]string{}
+		for rows.Next() {
+			var name, value string
+			if err := rows.Scan(&name, &value); err != nil {
+				t.Fatalf("failed to scan field value: %v", err)
+			}
+			values[name] = value
+		}
+		return values
+	}
+
+	pod := testutil.NewPod("default", "web", "node1")
+	testutil.CreatePods(ctx, t, backend, []*corev1.Pod{pod})
+
+	values := valueRows(testutil.PodKey(pod))
+	for name, want := range map[string]string{
+		"metadata_name":      "web",
+		"metadata_namespace": "default",
+		"spec_nodeName":      "node1",
+	} {
+		if values[name] != want {
+			t.Errorf("expected field value %s=%q, got %q", name, want, values[name])
+		}
+	}
+
+	// rows indexed before field values were are filled in by a reindex
+	if _, err := dialect.DB.ExecContext(ctx, `DELETE FROM kine_field_values`); err != nil {
+		t.Fatalf("failed to delete field values: %v", err)
+	}
+	if err := dialect.Reindex(ctx, testutil.PodsPrefix, 100); err != nil {
+		t.Fatalf("reindex failed: %v", err)
+	}
+	if got := valueRows(testutil.PodKey(pod)); !maps.Equal(values, got) {
+		t.Errorf("after reindexing: expected field values %v, got %v", values, got)
+	}
+
+	rows, err := dialect.DB.QueryContext(ctx, `EXPLAIN QUERY PLAN SELECT kine_id FROM kine_field_values WHERE name = ? AND value = ? AND kine_name LIKE ? ESCAPE '!'`, "spec_nodeName", "node1", testutil.PodsPrefix+"%")
+	if err != nil {
+		t.Fatalf("explain failed: %v", err)
+	}
+	defer rows.Close()
+	plan := []string{}
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatalf("failed to scan plan: %v", err)
+		}
+		plan = append(plan, detail)
+	}
+	if !strings.Contains(strings.Join(plan, "\n"), "kine_field_values_name_index") {
+		t.Errorf("expected the field value lookup to use kine_field_values_name_index, got plan:\n%s", strings.Join(plan, "\n"))
+	}
+}
+
+func TestCurrentMetadataOnly(t *testing.T) {
+	ctx, backend, dialect := testutil.NewDialect(t)
+	dialect.CurrentMetadataOnly = true
+
+	metadataRows := func(key string) (labelRows, fieldRows int) {
+		t.Helper()
+		if err := dialect.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM kine_labels WHERE kine_name = ?`, key).Scan(&labelRows); err != nil {
+			t.Fatalf("failed to count labels rows: %v", err)
+		}
+		if err := dialect.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM kine_fields WHERE kine_name = ?`, key).Scan(&fieldRows); err != nil {
+			t.Fatalf("failed to count fields rows: %v", err)
+		}
+		return labelRows, fieldRows
+	}
+	listed := func(revision, limit int64, labelSelector, fieldSelector string) []string {
+		t.Helper()
+		_, kvs, err := backend.List(ctx, testutil.PodsPrefix, testutil.PodsEnd, limit, revision, false, labelSelector, fieldSelector)
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		keys := []string{}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		return keys
+	}
+
+	a, b := testutil.NewPod("default", "a", "node1"), testutil.NewPod("default", "b", "node1")
+	a.Labels = map[string]string{"app": "web"}
+	b.Labels = map[string]string{"app": "web"}
+	testutil.CreatePods(ctx, t, backend, []*corev1.Pod{a, b})
+
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("failed to get current revision: %v", err)
+	}
+
+	a.Spec.NodeName = "node2"
+	value, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("failed to marshal pod: %v", err)
+	}
+	_, kv, err := backend.Get(ctx, testutil.PodKey(a), 0, false)
+	if err != nil {
+		t.Fatalf("failed to get %s: %v", testutil.PodKey(a), err)
+	}
+	if _, _, updated, err := backend.Update(ctx, testutil.PodKey(a), value, kv.ModRevision, 0); err != nil || !updated {
+		t.Fatalf("failed to update %s: updated=%v, err=%v", testutil.PodKey(a), updated, err)
+	}
+	if _, _, _, err := backend.Delete(ctx, testutil.PodKey(b), 0); err != nil {
+		t.Fatalf("failed to delete %s: %v", testutil.PodKey(b), err)
+	}
+
+	// one set of rows per key, dropped when the key is deleted
+	if labelRows, fieldRows := metadataRows(testutil.PodKey(a)); labelRows != 1 || fieldRows != 1 {
+		t.Errorf("expected one labels and one fields row for %s, got %d and %d", testutil.PodKey(a), labelRows, fieldRows)
+	}
+	if labelRows, fieldRows := metadataRows(testutil.PodKey(b)); labelRows != 0 || fieldRows != 0 {
+		t.Errorf("expected no labels or fields rows for deleted %s, got %d and %d", testutil.PodKey(b), labelRows, fieldRows)
+	}
+
+	for _, tc := range []struct {
+		revision      int64
+		limit         int64
+		labelSelector string
+		fieldSelector string
+		want          []string
+	}{
+		{0, 0, "", "spec.nodeName=node2", []string{testutil.PodKey(a)}},
+		{0, 0, "", "spec.nodeName=node1", []string{}},
+		{0, 0, "app=web", "", []string{testutil.PodKey(a)}},
+		{rev, 0, "", "spec.nodeName=node1", []string{testutil.PodKey(a), testutil.PodKey(b)}},
+		{rev, 0, "", "spec.nodeName=node2", []string{}},
+		{rev, 0, "app=web", "", []string{testutil.PodKey(a), testutil.PodKey(b)}},
+		{rev, 1, "app=web", "", []string{testutil.PodKey(a)}},
+	} {
+		if got := listed(tc.revision, tc.limit, tc.labelSelector, tc.fieldSelector); !slices.Equal(tc.want, got) {
+			t.Errorf("list at revision %d, limit %d, %q %q: expected %v, got %v", tc.revision, tc.limit, tc.labelSelector, tc.fieldSelector, tc.want, got)
+		}
+	}
+
+	if _, count, err := backend.Count(ctx, testutil.PodsPrefix, testutil.PodsEnd, rev, "", "spec.nodeName=node1"); err != nil {
+		t.Fatalf("count failed: %v", err)
+	} else if count != 2 {
+		t.Errorf("expected 2 pods on node1 at revision %d, got %d", rev, count)
+	}
+
+	if err := dialect.Reindex(ctx, testutil.PodsPrefix, 1); err != nil {
+		t.Fatalf("reindex failed: %v", err)
+	}
+	if labelRows, fieldRows := metadataRows(testutil.PodKey(a)); labelRows != 1 || fieldRows != 1 {
+		t.Errorf("expected one labels and one fields row for %s after reindexing, got %d and %d", testutil.PodKey(a), labelRows, fieldRows)
+	}
+	if got := listed(0, 0, "", "spec.nodeName=node2"); !slices.Equal([]string{testutil.PodKey(a)}, got) {
+		t.Errorf("after reindexing: expected %v, got %v", []string{testutil.PodKey(a)}, got)
+	}
+}
@@ -4,17 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"strings"
 	"sync"
 	"time"
 
-	jsoniter "github.com/json-iterator/go"
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/query"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -24,6 +21,7 @@ type contextKey int
 
 const (
 	txKey contextKey = iota
+	gcKey
 )
 
 // explicit interface check
@@ -94,11 +92,7 @@ func (t *Tx) SetCompactRevision(ctx context.Context, revision int64) error {
 
 func (t *Tx) Compact(ctx context.Context, revision int64) (int64, error) {
 	logrus.Tracef("TX COMPACT %v", revision)
-	res, err := t.execute(ctx, t.d.CompactSQL, revision, revision)
-	if err != nil {
-		return 0, err
-	}
-	return res.RowsAffected()
+	return compact(ctx, t.d, t, revision)
 }
 
 func (t *Tx) DeleteRevision(ctx context.Context, revision int64) error {
@@ -154,21 +148,34 @@ func (t *Tx) InsertMetadata(ctx context.Context, id int64, key string, createRev
 		args []any
 	}{}
 
+	if t.d.CurrentMetadataOnly {
+		// only the latest revision of each key is indexed, so the labels and fields of
+		// the previous one are replaced, or dropped when the key is deleted
+		sqls := []*query.Named{t.d.DeleteKeyLabelsSQL, t.d.DeleteKeyFieldsSQL}
+		if t.d.IndexFieldValues {
+			sqls = append(sqls, t.d.DeleteKeyFieldValuesSQL)
+		}
+		for _, sql := range sqls {
+			if _, err := t.execute(ctx, sql, key); err != nil {
+				return err
+			}
+		}
+	}
+
 	foreground := len(finalizers) == 1 && finalizers[0] == metav1.FinalizerDeleteDependents
 	foregroundGCNeeded := map[string]bool{}
 
 	if !delete {
-		var prevValueObj *unstructured.Unstructured = nil
+		var prevValueObj metav1.Object = nil
 		prevValueDecodeOnce := sync.Once{}
-		prevValueDecode := func() (*unstructured.Unstructured, error) {
+		prevValueDecode := func() (metav1.Object, error) {
 			if len(prevValue) == 0 {
 				return nil, nil
 			}
 
 			prevValueDecodeOnce.Do(func() {
-				prevValueObj = &unstructured.Unstructured{}
-				if _, _, err := unstructuredDecoder.Decode(prevValue, nil, prevValueObj); err != nil {
-					prevValueObj = nil
+				if obj, err := objectMeta(key, prevValue); err == nil {
+					prevValueObj = obj
 				}
 			})
 
@@ -180,7 +187,7 @@ func (t *Tx) InsertMetadata(ctx context.Context, id int64, key string, createRev
 		}
 
 		for _, owner := range owners {
-			if _, ok := labels["skip-controller-manager-metadata-caching"]; ok && (owner.BlockOwnerDeletion == nil || !*owner.BlockOwnerDeletion) {
+			if _, ok := labels[gcLabel]; ok && (owner.BlockOwnerDeletion == nil || !*owner.BlockOwnerDeletion) {
 				if prevValueObj, err := prevValueDecode(); err != nil {
 					return err
 				} else if prevValueObj != nil {
@@ -216,13 +223,8 @@ func (t *Tx) InsertMetadata(ctx context.Context, id int64, key string, createRev
 		}
 
 		if len(fieldsSet) != 0 {
-			fieldsMap := map[string]string{}
-			for k, v := range fieldsSet {
-				fieldsMap[strings.ReplaceAll(k, ".", "_")] = v
-			}
-
 			var jsonData string
-			if jsonData, err = jsoniter.MarshalToString(fieldsMap); err != nil {
+			if jsonData, err = fieldsJSON(fieldsSet); err != nil {
 				return err
 			}
 
@@ -233,12 +235,24 @@ func (t *Tx) InsertMetadata(ctx context.Context, id int64, key string, createRev
 				sql:  t.d.InsertFieldsSQL.String(),
 				args: []any{id, key, jsonData},
 			})
+
+			if t.d.IndexFieldValues {
+				for k, v := range fieldValues(fieldsSet) {
+					metadataSQLs = append(metadataSQLs, struct {
+						sql  string
+						args []any
+					}{
+						sql:  t.d.InsertFieldValueSQL.String(),
+						args: []any{id, key, k, v},
+					})
+				}
+			}
 		}
 
 		if foreground {
 			delete = true
 		}
-	} else if _, ok := labels["skip-controller-manager-metadata-caching"]; ok && delete {
+	} else if _, ok := labels[gcLabel]; ok && delete {
 		for _, owner := range owners {
 			metadataSQLs = append(metadataSQLs, struct {
 				sql  string
@@ -250,108 +264,16 @@ func (t *Tx) InsertMetadata(ctx context.Context, id int64, key string, createRev
 		}
 	}
 
-	if _, ok := labels["skip-controller-manager-metadata-caching"]; ok && delete {
-
+	// the dependents are collected by the garbage collector, apart from this write
+	if _, ok := labels[gcLabel]; ok && delete {
 		orphan := len(finalizers) == 1 && finalizers[0] == metav1.FinalizerOrphanDependents
-
-		rows, err := t.query(ctx, t.d.GetOwnedSQL, uid)
-		if err != nil {
-			if err != sql.ErrNoRows {
-				return err
-			}
-		}
-		defer rows.Close()
-
-		foregroundDeletionBlocked := false
-		ownedCount := 0
-		for rows.Next() {
-			ownedCount++
-			var ownedKey, ownedUID string
-			var ownedValue []byte
-			var ownedId, ownedCreateRevision int64
-			var ownedBlockOwnerDeletion bool
-			if err = rows.Scan(&ownedId, &ownedKey, &ownedUID, &ownedCreateRevision, &ownedValue, &ownedBlockOwnerDeletion); err != nil {
-				return err
-			} else if ownedId == 0 {
-				continue
-			}
-
-			ownedObj := &unstructured.Unstructured{}
-			if _, _, err := unstructuredDecoder.Decode(ownedValue, nil, ownedObj); err != nil {
-				return err
-			}
-
-			if orphan {
-				ownersToDelete := []int{}
-				for i := range ownedObj.GetOwnerReferences() {
-					if ownedObj.GetOwnerReferences()[i].UID == uid {
-						ownersToDelete = append(ownersToDelete, i)
-					}
-				}
-
-				for _, i := range ownersToDelete {
-					ownedObj.SetOwnerReferences(append(ownedObj.GetOwnerReferences()[:i], ownedObj.GetOwnerReferences()[i+1:]...))
-				}
-
-				ownedNewValue, err := jsoniter.Marshal(ownedObj)
-				if err != nil {
-					return err
-				}
-
-				if t.d.LastInsertID {
-					metadataSQLs = append(metadataSQLs, struct {
-						sql  string
-						args []any
-					}{
-						sql:  t.d.InsertLastInsertIDSQL.String(),
-						args: []any{ownedKey, ownedUID, 0, 0, ownedCreateRevision, ownedId, 0, ownedNewValue, ownedValue},
-					})
-				} else {
-					if err := t.queryRow(ctx, t.d.InsertSQL, ownedKey, ownedUID, 0, 0, ownedCreateRevision, ownedId, 0, ownedNewValue, ownedValue).Err(); err != nil {
-						return err
-					}
-				}
-			} else if len(ownedObj.GetFinalizers()) == 0 {
-				if _, err := t.d.Insert(context.WithValue(ctx, txKey, t), ownedKey, false, true, ownedCreateRevision, ownedId, 0, nil, ownedValue); err != nil {
-					return err
-				}
-			} else if ownedObj.GetDeletionTimestamp() != nil && foreground && ownedBlockOwnerDeletion {
-				foregroundDeletionBlocked = true
-			} else if ownedObj.GetDeletionTimestamp() == nil {
-				if foreground && ownedBlockOwnerDeletion {
-					foregroundDeletionBlocked = true
-				}
-
-				ownedObj.SetDeletionTimestamp(&metav1.Time{Time: time.Now()})
-
-				ownedNewValue, err := jsoniter.Marshal(ownedObj)
-				if err != nil {
-					return err
-				}
-
-				if t.d.LastInsertID {
-					metadataSQLs = append(metadataSQLs, struct {
-						sql  string
-						args []any
-					}{
-						sql:  t.d.InsertLastInsertIDSQL.String(),
-						args: []any{ownedKey, ownedUID, 0, 0, ownedCreateRevision, ownedId, 0, ownedNewValue, ownedValue},
-					})
-				} else {
-					if err := t.queryRow(ctx, t.d.InsertSQL, ownedKey, ownedUID, 0, 0, ownedCreateRevision, ownedId, 0, ownedNewValue, ownedValue).Err(); err != nil {
-						return err
-					}
-				}
-			}
-		}
-
-		if foreground && !foregroundDeletionBlocked {
-			if _, err := t.d.Insert(context.WithValue(ctx, txKey, t), key, false, true, createRevision, id, 0, nil, value); err != nil {
-				return err
-			}
+		if err := t.enqueueGC(ctx, uid, orphan, foreground); err != nil {
+			return err
 		}
 
-		if !foreground || (foreground && !foregroundDeletionBlocked) {
+		// owners waiting for their dependents to be deleted are checked once this
+		// object is gone
+		if !foreground {
 			for _, owner := range owners {
 				foregroundGCNeeded[string(owner.UID)] = true
 			}
@@ -364,75 +286,16 @@ func (t *Tx) InsertMetadata(ctx context.Context, id int64, key string, createRev
 		}
 	}
 
+	// the owners being collected by this transaction are checked by it
+	gc, _ := ctx.Value(gcKey).(*gcState)
 	for ownerUID := range foregroundGCNeeded {
-		rows, err := t.query(ctx, t.d.GetUIDSQL, ownerUID)
-		if err != nil {
-			if err != sql.ErrNoRows {
-				return err
-			}
+		if gc != nil && gc.visited[types.UID(ownerUID)] {
+			continue
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var ownerId int64
-			var ownerKey string
-			var ownerDeleted bool
-			var ownerCreateRev int64
-			var ownerValue []byte
-			if err = rows.Scan(&ownerId, &ownerKey, &ownerDeleted, &ownerCreateRev, &ownerValue); err != nil {
-				return err
-			} else if ownerDeleted {
-				continue
-			}
-
-			ownerObj := &unstructured.Unstructured{}
-			if _, _, err := unstructuredDecoder.Decode(ownerValue, nil, ownerObj); err != nil {
-				return err
-			}
-
-			if len(ownerObj.GetFinalizers()) != 1 || ownerObj.GetFinalizers()[0] != metav1.FinalizerDeleteDependents {
-				continue
-			}
-
-			ownedRows, err := t.query(ctx, t.d.GetOwnedSQL, ownerUID)
-			if err != nil {
-				if err != sql.ErrNoRows {
-					return err
-				}
-			}
-			defer ownedRows.Close()
-
-			foregroundDeletionUnblocked := true
-			for rows.Next() {
-				var ownedKey, ownedUID string
-				var ownedValue []byte
-				var ownedId, ownedCreateRevision int64
-				var ownedBlockOwnerDeletion bool
-				if err = rows.Scan(&ownedId, &ownedKey, &ownedUID, &ownedCreateRevision, &ownedValue, &ownedBlockOwnerDeletion); err != nil {
-					return err
-				} else if ownedId == 0 {
-					continue
-				}
-
-				ownedObj := &unstructured.Unstructured{}
-				if _, _, err := unstructuredDecoder.Decode(ownedValue, nil, ownedObj); err != nil {
-					return err
-				}
-
-				for _, ownerRef := range ownedObj.GetOwnerReferences() {
-					if string(ownerRef.UID) == ownerUID && ownerRef.BlockOwnerDeletion != nil && *ownerRef.BlockOwnerDeletion {
-						foregroundDeletionUnblocked = false
-					}
-				}
-			}
-
-			if foregroundDeletionUnblocked {
-				if _, err := t.d.Insert(context.WithValue(ctx, txKey, t), ownerKey, false, true, ownerCreateRev, ownerId, 0, nil, ownerValue); err != nil {
-					return err
-				}
-			}
+		if err := t.enqueueGC(ctx, types.UID(ownerUID), false, true); err != nil {
+			return err
 		}
 	}
 
-	return
+	return nil
 }
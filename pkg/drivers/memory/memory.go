@@ -9,6 +9,7 @@ import (
 	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/ttl"
+	"github.com/k3s-io/kine/pkg/util"
 	"github.com/sirupsen/logrus"
 	"github.com/tidwall/btree"
 )
@@ -36,6 +37,7 @@ type entry struct {
 	created        bool
 	deleted        bool
 	prev           *entry
+	meta           *util.CachedMetadata
 }
 
 func (e *entry) toKeyValue() *server.KeyValue {
@@ -49,6 +51,12 @@ func (e *entry) toKeyValue() *server.KeyValue {
 	}
 }
 
+// matches reports whether meta satisfies sel. The metadata is only decoded when
+// there is a selector to evaluate.
+func matches(sel *util.Selectors, meta *util.CachedMetadata) bool {
+	return sel.Empty() || sel.Matches(meta.Get())
+}
+
 type Memory struct {
 	mu              sync.RWMutex
 	currentRevision atomic.Int64
@@ -217,6 +225,7 @@ func (m *Memory) Create(ctx context.Context, key string, value []byte, lease int
 		prevRevision:   prevRev,
 		lease:          lease,
 		created:        true,
+		meta:           util.NewCachedMetadata(key, value),
 	})
 	return rev, nil
 }
@@ -242,6 +251,7 @@ func (m *Memory) Update(ctx context.Context, key string, value []byte, revision,
 		version:        latest.version + 1,
 		prevRevision:   latest.revision,
 		lease:          lease,
+		meta:           util.NewCachedMetadata(key, value),
 	}
 	m.appendEntry(e)
 	return rev, e.toKeyValue(), true, nil
@@ -269,15 +279,21 @@ func (m *Memory) Delete(ctx context.Context, key string, revision int64) (int64,
 		prevRevision:   latest.revision,
 		lease:          latest.lease,
 		deleted:        true,
+		meta:           latest.meta,
 	})
 	return rev, latest.toKeyValue(), true, nil
 }
 
-func (m *Memory) List(ctx context.Context, key, end string, limit, revision int64, keysOnly bool, _, _ string) (int64, []*server.KeyValue, error) {
+func (m *Memory) List(ctx context.Context, key, end string, limit, revision int64, keysOnly bool, labelSelector, fieldSelector string) (int64, []*server.KeyValue, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	rev := m.currentRevision.Load()
+	sel, err := util.ParseSelectors(labelSelector, fieldSelector)
+	if err != nil {
+		return rev, nil, err
+	}
+
 	if revision > 0 {
 		if revision > rev {
 			return rev, nil, server.ErrFutureRev
@@ -307,7 +323,7 @@ func (m *Memory) List(ctx context.Context, key, end string, limit, revision int6
 			e = m.latest(k)
 		}
 
-		if e != nil && !e.deleted {
+		if e != nil && !e.deleted && matches(sel, e.meta) {
 			kv := e.toKeyValue()
 			if keysOnly {
 				kv.Value = nil
@@ -326,15 +342,15 @@ func (m *Memory) List(ctx context.Context, key, end string, limit, revision int6
 	return rev, kvs, nil
 }
 
-func (m *Memory) Count(ctx context.Context, key, end string, revision int64, _, _ string) (int64, int64, error) {
-	rev, kvs, err := m.List(ctx, key, end, 0, revision, true, "", "")
+func (m *Memory) Count(ctx context.Context, key, end string, revision int64, labelSelector, fieldSelector string) (int64, int64, error) {
+	rev, kvs, err := m.List(ctx, key, end, 0, revision, true, labelSelector, fieldSelector)
 	if err != nil {
 		return rev, 0, err
 	}
 	return rev, int64(len(kvs)), nil
 }
 
-func (m *Memory) Watch(ctx context.Context, key, end string, startRevision int64, _, _ string) server.WatchResult {
+func (m *Memory) Watch(ctx context.Context, key, end string, startRevision int64, labelSelector, fieldSelector string) server.WatchResult {
 	m.mu.RLock()
 	compactRev := m.compactRevision
 	m.mu.RUnlock()
@@ -342,6 +358,18 @@ func (m *Memory) Watch(ctx context.Context, key, end string, startRevision int64
 
 	events := make(chan []*server.Event, 100)
 
+	sel, err := util.ParseSelectors(labelSelector, fieldSelector)
+	if err != nil {
+		errc := make(chan error, 1)
+		errc <- err
+		close(events)
+		return server.WatchResult{
+			CurrentRevision: rev,
+			Events:          events,
+			Errorc:          errc,
+		}
+	}
+
 	if startRevision > 0 && startRevision <= compactRev {
 		close(events)
 		return server.WatchResult{
@@ -370,7 +398,10 @@ func (m *Memory) Watch(ctx context.Context, key, end string, startRevision int64
 			var batch []*server.Event
 			for i := m.logIndexAfter(lastSeen); i < len(m.log); i++ {
 				e := m.log[i]
-				if key == "" || (end != "" && e.key >= key && e.key < end) || e.key == key {
+				// like the SQL drivers, an event is sent if either the new or the
+				// previous value matches, so that watchers see objects leave
+				inRange := key == "" || (end != "" && e.key >= key && e.key < end) || e.key == key
+				if inRange && (matches(sel, e.meta) || (!e.created && e.prev != nil && matches(sel, e.prev.meta))) {
 					event := &server.Event{
 						Create: e.created,
 						Delete: e.deleted,
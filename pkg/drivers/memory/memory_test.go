@@ -2,6 +2,7 @@ package memory
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/ttl"
+	"github.com/k3s-io/kine/pkg/util"
 	"github.com/sirupsen/logrus"
 	"github.com/tidwall/btree"
 )
@@ -327,6 +329,149 @@ func TestCount(t *testing.T) {
 	expEqual(t, int64(2), count)
 }
 
+func objectValue(t *testing.T, namespace, name string, labels map[string]string) []byte {
+	t.Helper()
+	value, err := json.Marshal(map[string]any{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]any{
+			"namespace": namespace,
+			"name":      name,
+			"labels":    labels,
+		},
+	})
+	noErr(t, err)
+	return value
+}
+
+func TestListSelectors(t *testing.T) {
+	b, ctx := setupBackend(t)
+
+	b.Create(ctx, "/registry/configmaps/default/a", objectValue(t, "default", "a", map[string]string{"app": "web"}), 0)
+	b.Create(ctx, "/registry/configmaps/default/b", objectValue(t, "default", "b", map[string]string{"app": "db"}), 0)
+	b.Create(ctx, "/registry/configmaps/default/c", objectValue(t, "default", "c", nil), 0)
+	b.Create(ctx, "/registry/configmaps/other/a", objectValue(t, "other", "a", map[string]string{"app": "web"}), 0)
+	b.Create(ctx, "/registry/configmaps/other/raw", []byte("not an object"), 0)
+
+	_, ents, err := b.List(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, 0, false, "app=web", "")
+	noErr(t, err)
+	expEqualKeys(t, []string{"/registry/configmaps/default/a", "/registry/configmaps/other/a"}, ents)
+
+	// != also matches objects without the label, but never values that are not objects.
+	_, ents, err = b.List(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, 0, false, "app!=web", "")
+	noErr(t, err)
+	expEqualKeys(t, []string{"/registry/configmaps/default/b", "/registry/configmaps/default/c"}, ents)
+
+	_, ents, err = b.List(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, 0, false, "", "metadata.namespace=other")
+	noErr(t, err)
+	expEqualKeys(t, []string{"/registry/configmaps/other/a"}, ents)
+
+	_, ents, err = b.List(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, 0, false, "app", "metadata.name!=b")
+	noErr(t, err)
+	expEqualKeys(t, []string{"/registry/configmaps/default/a", "/registry/configmaps/other/a"}, ents)
+
+	// The limit applies to matching keys.
+	_, ents, err = b.List(ctx, "/registry/configmaps/", "/registry/configmaps0", 1, 0, false, "app=web", "")
+	noErr(t, err)
+	expEqualKeys(t, []string{"/registry/configmaps/default/a"}, ents)
+
+	_, _, err = b.List(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, 0, false, "app in (", "")
+	if err == nil {
+		t.Fatal("expected error for invalid label selector")
+	}
+}
+
+func TestListSelectorsAtRevision(t *testing.T) {
+	b, ctx := setupBackend(t)
+
+	rev, _ := b.Create(ctx, "/registry/configmaps/default/a", objectValue(t, "default", "a", map[string]string{"app": "web"}), 0)
+	b.Update(ctx, "/registry/configmaps/default/a", objectValue(t, "default", "a", map[string]string{"app": "db"}), rev, 0)
+
+	_, ents, err := b.List(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, rev, false, "app=web", "")
+	noErr(t, err)
+	expEqualKeys(t, []string{"/registry/configmaps/default/a"}, ents)
+
+	_, ents, err = b.List(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, 0, false, "app=web", "")
+	noErr(t, err)
+	expEqualKeys(t, nil, ents)
+}
+
+func TestCountSelectors(t *testing.T) {
+	b, ctx := setupBackend(t)
+
+	b.Create(ctx, "/registry/configmaps/default/a", objectValue(t, "default", "a", map[string]string{"app": "web"}), 0)
+	b.Create(ctx, "/registry/configmaps/default/b", objectValue(t, "default", "b", map[string]string{"app": "db"}), 0)
+	b.Create(ctx, "/registry/configmaps/other/a", objectValue(t, "other", "a", map[string]string{"app": "web"}), 0)
+
+	_, count, err := b.Count(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, "app=web", "")
+	noErr(t, err)
+	expEqual(t, int64(2), count)
+
+	_, count, err = b.Count(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, "app=web", "metadata.namespace=default")
+	noErr(t, err)
+	expEqual(t, int64(1), count)
+}
+
+func TestListSelectorsFollowCustomResourceDefinitions(t *testing.T) {
+	b, ctx := setupBackend(t)
+	t.Cleanup(func() {
+		_ = util.ResetCustomResourceDefinitions(nil)
+	})
+
+	for _, color := range []string{"red", "blue"} {
+		value := `{"apiVersion":"example.com/v1","kind":"Gizmo","metadata":{"namespace":"default","name":"` + color + `"},"spec":{"color":"` + color + `"}}`
+		_, err := b.Create(ctx, "/registry/example.com/gizmos/default/"+color, []byte(value), 0)
+		noErr(t, err)
+	}
+
+	_, ents, err := b.List(ctx, "/registry/example.com/gizmos/", "/registry/example.com/gizmos0", 0, 0, false, "", "spec.color=red")
+	noErr(t, err)
+	expEqualKeys(t, nil, ents)
+
+	// The entries written before the field became selectable are decoded again.
+	crd := `{"apiVersion":"apiextensions.k8s.io/v1","kind":"CustomResourceDefinition",` +
+		`"metadata":{"name":"gizmos.example.com"},` +
+		`"spec":{"group":"example.com","names":{"plural":"gizmos","kind":"Gizmo"},` +
+		`"versions":[{"name":"v1","served":true,"storage":true,"selectableFields":[{"jsonPath":".spec.color"}]}]}}`
+	noErr(t, util.RegisterCustomResourceDefinition([]byte(crd)))
+
+	_, ents, err = b.List(ctx, "/registry/example.com/gizmos/", "/registry/example.com/gizmos0", 0, 0, false, "", "spec.color=red")
+	noErr(t, err)
+	expEqualKeys(t, []string{"/registry/example.com/gizmos/default/red"}, ents)
+}
+
+func TestWatchSelectors(t *testing.T) {
+	b, ctx := setupBackend(t)
+
+	wctx, cancel := context.WithCancel(ctx)
+	wr := b.Watch(wctx, "/registry/configmaps/", "/registry/configmaps0", 1, "app=web", "")
+
+	rev, _ := b.Create(ctx, "/registry/configmaps/default/a", objectValue(t, "default", "a", map[string]string{"app": "web"}), 0)
+	b.Create(ctx, "/registry/configmaps/default/b", objectValue(t, "default", "b", map[string]string{"app": "db"}), 0)
+	// leaving the selector is still sent, with the matching previous value
+	rev, _, _, _ = b.Update(ctx, "/registry/configmaps/default/a", objectValue(t, "default", "a", map[string]string{"app": "db"}), rev, 0)
+	b.Delete(ctx, "/registry/configmaps/default/a", rev)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	var events []*server.Event
+	for es := range wr.Events {
+		events = append(events, es...)
+	}
+	expEqual(t, 2, len(events))
+	expEqual(t, true, events[0].Create)
+	expEqual(t, int64(1), events[0].KV.ModRevision)
+	expEqual(t, int64(3), events[1].KV.ModRevision)
+
+	wr = b.Watch(ctx, "/registry/configmaps/", "/registry/configmaps0", 1, "", "metadata.name")
+	for range wr.Events {
+		t.Fatal("expected no events for invalid watch")
+	}
+	if err := <-wr.Errorc; err == nil {
+		t.Fatal("expected error for invalid field selector")
+	}
+}
+
 func TestWatch(t *testing.T) {
 	b, ctx := setupBackend(t)
 
@@ -42,6 +42,7 @@ var (
 				lease INTEGER,
 				value MEDIUMBLOB,
 				old_value MEDIUMBLOB,
+				committed BIGINT,
 				PRIMARY KEY (id)
 			) ENGINE=InnoDB;`,
 		`CREATE INDEX kine_name_index ON kine (name)`,
@@ -50,15 +51,17 @@ var (
 		`CREATE INDEX kine_id_deleted_index ON kine (id,deleted)`,
 		`CREATE INDEX kine_prev_revision_index ON kine (prev_revision)`,
 		`CREATE UNIQUE INDEX kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+		`CREATE INDEX kine_committed_index ON kine (committed, id)`,
 		`CREATE TABLE IF NOT EXISTS kine_labels
 			(
 				kine_id BIGINT UNSIGNED,
 				kine_name VARCHAR(253) CHARACTER SET ascii,
-				name VARCHAR(63),
-				value VARCHAR(63),
+				name VARCHAR(63) CHARACTER SET ascii COLLATE ascii_bin,
+				value VARCHAR(63) CHARACTER SET ascii COLLATE ascii_bin,
 				FOREIGN KEY (kine_id) REFERENCES kine(id) ON DELETE CASCADE
 			) ENGINE=InnoDB;`,
 		`CREATE INDEX kine_labels_name_index ON kine_labels (kine_name, name, value)`,
+		`CREATE INDEX kine_labels_kine_id_index ON kine_labels (kine_id, name, value)`,
 		`CREATE TABLE IF NOT EXISTS kine_fields
 			(
 				kine_id BIGINT UNSIGNED,
@@ -82,9 +85,84 @@ var (
 		// with each other for a give value of KINE_SCHEMA_MIGRATION env var
 		``,
 	}
+	// upgrades bring the tables of existing databases up to the schema. Unlike the
+	// schemaMigrations they are not opt-in, as the queries need what they add, so each
+	// is run on every startup and must be safe to run again. An upgrade whose check
+	// returns a row is skipped.
+	upgrades = []upgrade{
+		// Labels are matched case-sensitively, as Kubernetes does.
+		{
+			check: `SELECT 1 FROM information_schema.COLUMNS WHERE table_schema = DATABASE() AND table_name = 'kine_labels' AND column_name = 'value' AND collation_name = 'ascii_bin'`,
+			stmt:  `ALTER TABLE kine_labels MODIFY COLUMN name VARCHAR(63) CHARACTER SET ascii COLLATE ascii_bin, MODIFY COLUMN value VARCHAR(63) CHARACTER SET ascii COLLATE ascii_bin`,
+		},
+		{
+			check: `SELECT 1 FROM information_schema.STATISTICS WHERE table_schema = DATABASE() AND table_name = 'kine_labels' AND index_name = 'kine_labels_kine_id_index'`,
+			stmt:  `CREATE INDEX kine_labels_kine_id_index ON kine_labels (kine_id, name, value)`,
+		},
+		{stmt: `CREATE TABLE IF NOT EXISTS kine_reindex
+			(
+				prefix VARCHAR(630) CHARACTER SET ascii PRIMARY KEY,
+				fingerprint VARCHAR(64) CHARACTER SET ascii,
+				revision BIGINT UNSIGNED,
+				last_key VARCHAR(630) CHARACTER SET ascii,
+				finished INTEGER DEFAULT 0
+			) ENGINE=InnoDB;`},
+		// The current row of each key is filled from the existing rows on startup.
+		{stmt: `CREATE TABLE IF NOT EXISTS kine_current
+			(
+				name VARCHAR(630) CHARACTER SET ascii PRIMARY KEY,
+				id BIGINT UNSIGNED,
+				INDEX kine_current_id_index (id)
+			) ENGINE=InnoDB;`},
+		// The values of the selectable fields are filled by the metadata reindex.
+		{stmt: `CREATE TABLE IF NOT EXISTS kine_field_values
+			(
+				kine_id BIGINT UNSIGNED,
+				kine_name VARCHAR(630) CHARACTER SET ascii,
+				name VARCHAR(253) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin,
+				value TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_bin,
+				INDEX kine_field_values_name_index (name, value(255), kine_name, kine_id),
+				INDEX kine_field_values_kine_id_index (kine_id, name),
+				INDEX kine_field_values_kine_name_index (kine_name),
+				FOREIGN KEY (kine_id) REFERENCES kine(id) ON DELETE CASCADE
+			) ENGINE=InnoDB;`},
+		// The owners whose dependents are to be collected, and the leases of the workers
+		// collecting them.
+		{stmt: `CREATE TABLE IF NOT EXISTS kine_gc_queue
+			(
+				id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+				owner VARCHAR(36),
+				orphan INTEGER DEFAULT 0,
+				foreground INTEGER DEFAULT 0,
+				enqueued BIGINT,
+				INDEX kine_gc_queue_owner_index (owner)
+			) ENGINE=InnoDB;`},
+		{stmt: `CREATE TABLE IF NOT EXISTS kine_leases
+			(
+				name VARCHAR(63) CHARACTER SET ascii PRIMARY KEY,
+				holder VARCHAR(255),
+				expires BIGINT
+			) ENGINE=InnoDB;`},
+		// Rows written before the commit time was recorded have none.
+		{
+			check: `SELECT 1 FROM information_schema.COLUMNS WHERE table_schema = DATABASE() AND table_name = 'kine' AND column_name = 'committed'`,
+			stmt:  `ALTER TABLE kine ADD COLUMN committed BIGINT, ADD INDEX kine_committed_index (committed, id)`,
+		},
+		// The revisions that key prefixes were compacted to.
+		{stmt: `CREATE TABLE IF NOT EXISTS kine_compact_prefixes
+			(
+				prefix VARCHAR(630) CHARACTER SET ascii PRIMARY KEY,
+				revision BIGINT UNSIGNED
+			) ENGINE=InnoDB;`},
+	}
 	createDB = "CREATE DATABASE IF NOT EXISTS `%s`;"
 )
 
+type upgrade struct {
+	check string
+	stmt  string
+}
+
 func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, server.Backend, error) {
 	tlsConfig, err := cfg.BackendTLSConfig.ClientConfig()
 	if err != nil {
@@ -114,8 +192,33 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 		return false, nil, err
 	}
 
-	dialect.SelectorLookupSQL = "JSON_UNQUOTE(JSON_EXTRACT(value, '$.%s')) LIKE CONCAT('%%', ?, '%%')"
+	dialect.SelectorLookupSQL = "COALESCE(JSON_UNQUOTE(JSON_EXTRACT(value, '$.%s')), '') = ?"
+	dialect.FieldExistsSQL = "JSON_CONTAINS_PATH(value, 'one', '$.%s')"
+	dialect.CurrentMetadataOnly = cfg.CurrentMetadataOnly
+	dialect.GCMaxObjects = cfg.GCMaxObjects
+	dialect.IndexFieldValues = true
+	dialect.SelectorIntegerSQL = `CASE WHEN value REGEXP '^[0-9]+$' AND (
+		LENGTH(TRIM(LEADING '0' FROM value)) < 19 OR
+		(LENGTH(TRIM(LEADING '0' FROM value)) = 19 AND TRIM(LEADING '0' FROM value) <= '9223372036854775807')
+	) THEN CAST(value AS SIGNED) END`
 	dialect.LastInsertID = true
+	dialect.RepairCurrentSQL = query.New(`
+		INSERT INTO kine_current(name, id)
+		SELECT name, MAX(id) FROM kine WHERE id > ? AND id <= ? GROUP BY name
+		ON DUPLICATE KEY UPDATE id = GREATEST(id, VALUES(id))`,
+		"?", false, "RepairCurrent")
+	dialect.UpdatePrefixCompactSQL = query.New(`
+		INSERT INTO kine_compact_prefixes(prefix, revision)
+		VALUES(?, ?)
+		ON DUPLICATE KEY UPDATE revision = VALUES(revision)`,
+		"?", false, "UpdatePrefixCompact")
+	dialect.InsertLeaseSQL = query.New(`INSERT IGNORE INTO kine_leases(name, holder, expires)
+		values(?, '', 0)`,
+		"?", false, "InsertLease")
+	// the owners are not stored in the character set of kine.uid, which its index
+	// could not be looked up with
+	dialect.DanglingOwnersSQL = query.New(fmt.Sprintf(generic.DanglingOwnersSQL, "CONVERT(ko.owner USING ascii)"),
+		"?", false, "DanglingOwners")
 	dialect.GetSizeSQL = query.New(`
 		SELECT SUM(data_length + index_length)
 		FROM information_schema.TABLES
@@ -139,6 +242,25 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 		) AS ks
 		ON kv.id = ks.id`,
 		"?", false, "Compact")
+	dialect.CompactPrefixSQL = query.New(`
+		DELETE kv FROM kine AS kv
+		INNER JOIN (
+			SELECT kp.prev_revision AS id
+			FROM kine AS kp
+			WHERE
+				kp.name LIKE ? ESCAPE '!' AND
+				kp.prev_revision != 0 AND
+				kp.id <= ?
+			UNION
+			SELECT kd.id AS id
+			FROM kine AS kd
+			WHERE
+				kd.name LIKE ? ESCAPE '!' AND
+				kd.deleted != 0 AND
+				kd.id <= ?
+		) AS ks
+		ON kv.id = ks.id`,
+		"?", false, "CompactPrefix")
 	dialect.TranslateErr = func(err error) error {
 		if err, ok := err.(*mysql.MySQLError); ok && err.Number == 1062 {
 			return server.ErrKeyExists
@@ -164,9 +286,21 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 	if err := setup(dialect.DB); err != nil {
 		return false, nil, err
 	}
+	if err := createCurrentTrigger(dialect.DB); err != nil {
+		// Creating triggers needs the SUPER privilege when the binary log is enabled,
+		// unless log_bin_trust_function_creators is set.
+		logrus.Warnf("Failed to create trigger recording the current row of each key, recording it in the transaction of each write instead: %v", err)
+		dialect.InsertCurrentSQL = query.New(`
+			INSERT INTO kine_current(name, id)
+			SELECT name, id FROM kine WHERE id = LAST_INSERT_ID()
+			ON DUPLICATE KEY UPDATE id = VALUES(id)`,
+			"?", false, "InsertCurrent")
+	}
 
 	dialect.Migrate(context.Background())
-	return true, logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)), nil
+	dialect.MigrateCurrent(context.Background())
+	dialect.CheckExtraFields(ctx)
+	return true, logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactRetainDuration, cfg.CompactRetainPrefixes, cfg.CompactBatchSize, cfg.PollBatchSize)), nil
 }
 
 func setup(db *sql.DB) error {
@@ -188,6 +322,22 @@ func setup(db *sql.DB) error {
 		}
 	}
 
+	for _, u := range upgrades {
+		if u.check != "" {
+			err := db.QueryRow(u.check).Scan(&exists)
+			if err == nil {
+				continue
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+		}
+		logrus.Tracef("SETUP EXEC UPGRADE: %v", query.Strip(u.stmt))
+		if _, err := db.Exec(u.stmt); err != nil {
+			return err
+		}
+	}
+
 	// Run enabled schama migrations.
 	// Note that the schema created by the `schema` var is always the latest revision;
 	// migrations should handle deltas between prior schema versions.
@@ -211,6 +361,21 @@ func setup(db *sql.DB) error {
 	return nil
 }
 
+// createCurrentTrigger creates the trigger recording each row inserted as the current
+// row of its key, unless it exists.
+func createCurrentTrigger(db *sql.DB) error {
+	var exists bool
+	err := db.QueryRow("SELECT 1 FROM information_schema.TRIGGERS WHERE trigger_schema = DATABASE() AND trigger_name = ?", "kine_current_insert").Scan(&exists)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TRIGGER kine_current_insert AFTER INSERT ON kine FOR EACH ROW
+		INSERT INTO kine_current(name, id) VALUES (NEW.name, NEW.id)
+		ON DUPLICATE KEY UPDATE id = GREATEST(id, VALUES(id))`)
+	return err
+}
+
 func createDBIfNotExist(ctx context.Context, config *mysql.Config, connector driver.Connector) error {
 	dbName := config.DBName
 	db := sql.OpenDB(connector)
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/sirupsen/logrus"
@@ -145,8 +146,13 @@ func (b *Backend) CurrentRevision(ctx context.Context) (int64, error) {
 }
 
 // Count returns an exact count of the number of matching keys and the current revision of the database.
-func (b *Backend) Count(ctx context.Context, key, end string, revision int64, _, _ string) (int64, int64, error) {
-	count, err := b.kv.Count(ctx, key, end, revision)
+func (b *Backend) Count(ctx context.Context, key, end string, revision int64, labelSelector, fieldSelector string) (int64, int64, error) {
+	sel, err := util.ParseSelectors(labelSelector, fieldSelector)
+	if err != nil {
+		return b.kv.BucketRevision(), 0, err
+	}
+
+	count, err := b.kv.Count(ctx, key, end, revision, sel)
 	if err != nil {
 		return b.kv.BucketRevision(), 0, err
 	}
@@ -388,8 +394,13 @@ func (b *Backend) Update(ctx context.Context, key string, value []byte, revision
 // that are alphanumerically equal to or greater than the startKey.
 // If limit is provided, the maximum set of matches is limited.
 // If revision is provided, this indicates the maximum revision to return.
-func (b *Backend) List(ctx context.Context, key, end string, limit, maxRevision int64, keysOnly bool, _, _ string) (int64, []*server.KeyValue, error) {
-	matches, err := b.kv.List(ctx, key, end, limit, maxRevision, keysOnly)
+func (b *Backend) List(ctx context.Context, key, end string, limit, maxRevision int64, keysOnly bool, labelSelector, fieldSelector string) (int64, []*server.KeyValue, error) {
+	sel, err := util.ParseSelectors(labelSelector, fieldSelector)
+	if err != nil {
+		return b.kv.BucketRevision(), nil, err
+	}
+
+	matches, err := b.kv.List(ctx, key, end, limit, maxRevision, keysOnly, sel)
 	if err != nil {
 		return b.kv.BucketRevision(), nil, err
 	}
@@ -415,9 +426,21 @@ func (b *Backend) List(ctx context.Context, key, end string, limit, maxRevision
 	return rev, kvs, nil
 }
 
-func (b *Backend) Watch(ctx context.Context, key, end string, startRevision int64, _, _ string) server.WatchResult {
+func (b *Backend) Watch(ctx context.Context, key, end string, startRevision int64, labelSelector, fieldSelector string) server.WatchResult {
 	events := make(chan []*server.Event, 32)
 
+	sel, err := util.ParseSelectors(labelSelector, fieldSelector)
+	if err != nil {
+		errc := make(chan error, 1)
+		errc <- err
+		close(events)
+		return server.WatchResult{
+			Events:          events,
+			CurrentRevision: b.kv.BucketRevision(),
+			Errorc:          errc,
+		}
+	}
+
 	if startRevision > 0 && startRevision <= b.kv.compactRev.Load() {
 		return server.WatchResult{
 			Events:          events,
@@ -498,6 +521,10 @@ func (b *Backend) Watch(ctx context.Context, key, end string, startRevision int6
 					}
 				}
 
+				if !b.matches(sel, &event) {
+					continue
+				}
+
 				events <- []*server.Event{&event}
 			}
 		}
@@ -514,6 +541,30 @@ func (b *Backend) Watch(ctx context.Context, key, end string, startRevision int6
 	}
 }
 
+// matches reports whether a watch event passes the selectors. Like the SQL drivers,
+// an event is sent if either the new or the previous value matches, so that
+// watchers see objects leave the selection.
+func (b *Backend) matches(sel *util.Selectors, event *server.Event) bool {
+	if sel.Empty() {
+		return true
+	}
+
+	if sel.Matches(b.metadata(event.KV)) {
+		return true
+	}
+
+	return !event.Create && event.PrevKV != nil && sel.Matches(b.metadata(event.PrevKV))
+}
+
+// metadata returns the selectable metadata of kv from the btree index, decoding the
+// value only if the index does not have that revision.
+func (b *Backend) metadata(kv *server.KeyValue) *util.Metadata {
+	if meta, ok := b.kv.getMetadata(kv.Key, kv.ModRevision); ok {
+		return meta
+	}
+	return util.DecodeMetadata(kv.Key, kv.Value)
+}
+
 // Compact is a no-op / not implemented. Revision history is managed by the jetstream bucket.
 func (b *Backend) Compact(ctx context.Context, revision int64) (int64, error) {
 	b.l.Debugf("compact: compacting to revision: %d", revision)
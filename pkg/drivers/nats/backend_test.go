@@ -459,3 +459,120 @@ func TestBackend_Watch(t *testing.T) {
 
 	expEqual(t, 2, len(events))
 }
+
+func TestBackend_ListSelectors(t *testing.T) {
+	logrus.SetLevel(logrus.TraceLevel)
+	logrus.SetOutput(t.Output())
+
+	ctx, cancel := context.WithCancel(t.Context())
+	wg := &sync.WaitGroup{}
+
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	ns, nc, b := setupBackend(ctx, wg, t)
+	defer ns.Shutdown()
+	defer nc.Drain()
+	defer os.RemoveAll(ns.StoreDir())
+
+	prefix := func(key string) string {
+		return "/registry/configmaps" + key
+	}
+
+	rev, _ := b.Create(ctx, prefix("/default/a"), objectValue(t, "default", "a", map[string]string{"app": "web"}), 0)
+	_, _ = b.Create(ctx, prefix("/default/b"), objectValue(t, "default", "b", map[string]string{"app": "db"}), 0)
+	_, _ = b.Create(ctx, prefix("/default/c"), objectValue(t, "default", "c", nil), 0)
+	_, _ = b.Create(ctx, prefix("/other/a"), objectValue(t, "other", "a", map[string]string{"app": "web"}), 0)
+	_, _ = b.Create(ctx, prefix("/other/raw"), []byte("not an object"), 0)
+
+	_, ents, err := b.List(ctx, prefix("/"), prefix("0"), 0, 0, false, "app=web", "")
+	noErr(t, err)
+	expEqualKeys(t, []string{prefix("/default/a"), prefix("/other/a")}, ents)
+
+	// != also matches objects without the label, but never values that are not objects.
+	_, ents, err = b.List(ctx, prefix("/"), prefix("0"), 0, 0, false, "app!=web", "")
+	noErr(t, err)
+	expEqualKeys(t, []string{prefix("/default/b"), prefix("/default/c")}, ents)
+
+	_, ents, err = b.List(ctx, prefix("/"), prefix("0"), 0, 0, false, "app", "metadata.namespace=other")
+	noErr(t, err)
+	expEqualKeys(t, []string{prefix("/other/a")}, ents)
+
+	// The limit applies to matching keys.
+	_, ents, err = b.List(ctx, prefix("/"), prefix("0"), 1, 0, false, "app=web", "")
+	noErr(t, err)
+	expEqualKeys(t, []string{prefix("/default/a")}, ents)
+
+	_, count, err := b.Count(ctx, prefix("/"), prefix("0"), 0, "app=web", "metadata.namespace=default")
+	noErr(t, err)
+	expEqual(t, int64(1), count)
+
+	// Selectors are evaluated against the value at the requested revision.
+	_, _, _, err = b.Update(ctx, prefix("/default/a"), objectValue(t, "default", "a", map[string]string{"app": "db"}), rev, 0)
+	noErr(t, err)
+
+	_, ents, err = b.List(ctx, prefix("/"), prefix("0"), 0, 0, false, "app=web", "")
+	noErr(t, err)
+	expEqualKeys(t, []string{prefix("/other/a")}, ents)
+
+	_, ents, err = b.List(ctx, prefix("/"), prefix("0"), 0, rev, false, "app=web", "")
+	noErr(t, err)
+	expEqualKeys(t, []string{prefix("/default/a")}, ents)
+
+	_, _, err = b.List(ctx, prefix("/"), prefix("0"), 0, 0, false, "app in (", "")
+	expErr(t, err)
+}
+
+func TestBackend_WatchSelectors(t *testing.T) {
+	logrus.SetLevel(logrus.TraceLevel)
+	logrus.SetOutput(t.Output())
+
+	ctx, cancel := context.WithCancel(t.Context())
+	wg := &sync.WaitGroup{}
+
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	ns, nc, b := setupBackend(ctx, wg, t)
+	defer ns.Shutdown()
+	defer nc.Drain()
+	defer os.RemoveAll(ns.StoreDir())
+
+	prefix := func(key string) string {
+		return "/registry/configmaps" + key
+	}
+
+	baseRev, err := b.CurrentRevision(ctx)
+	noErr(t, err)
+
+	cctx, cancel := context.WithCancel(ctx)
+
+	rev1, _ := b.Create(ctx, prefix("/default/a"), objectValue(t, "default", "a", map[string]string{"app": "web"}), 0)
+	_, _ = b.Create(ctx, prefix("/default/b"), objectValue(t, "default", "b", map[string]string{"app": "db"}), 0)
+	// Leaving the selection is still sent, with the matching previous value.
+	rev3, _, _, _ := b.Update(ctx, prefix("/default/a"), objectValue(t, "default", "a", map[string]string{"app": "db"}), rev1, 0)
+	_, _, _, _ = b.Delete(ctx, prefix("/default/a"), rev3)
+
+	wr := b.Watch(cctx, prefix("/"), prefix("0"), baseRev+1, "app=web", "")
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	var events []*kserver.Event
+	for es := range wr.Events {
+		events = append(events, es...)
+	}
+
+	expEqual(t, 2, len(events))
+	expEqual(t, rev1, events[0].KV.ModRevision)
+	expEqual(t, rev3, events[1].KV.ModRevision)
+
+	wr = b.Watch(ctx, prefix("/"), prefix("0"), baseRev+1, "", "metadata.name")
+	for range wr.Events {
+		t.Fatal("expected no events for invalid watch")
+	}
+	expErr(t, <-wr.Errorc)
+}
@@ -1,6 +1,7 @@
 package nats
 
 import (
+	"encoding/json"
 	"errors"
 	"testing"
 
@@ -55,3 +56,18 @@ func expEqualKeys(t *testing.T, want []string, got []*kserver.KeyValue) {
 		expEqual(t, k, got[i].Key)
 	}
 }
+
+func objectValue(t *testing.T, namespace, name string, labels map[string]string) []byte {
+	t.Helper()
+	value, err := json.Marshal(map[string]any{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]any{
+			"namespace": namespace,
+			"name":      name,
+			"labels":    labels,
+		},
+	})
+	noErr(t, err)
+	return value
+}
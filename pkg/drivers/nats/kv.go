@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/sirupsen/logrus"
@@ -57,9 +58,11 @@ func (e *entry) Delta() uint64                   { return e.entry.Delta() }
 func (e *entry) Operation() jetstream.KeyValueOp { return e.entry.Operation() }
 
 type seqOp struct {
-	seq uint64
-	op  jetstream.KeyValueOp
-	ex  time.Time
+	seq        uint64
+	op         jetstream.KeyValueOp
+	ex         time.Time
+	meta       *util.Metadata // selectable labels and fields of the value, nil for non-objects
+	generation int64          // metadata generation meta was decoded under
 }
 
 type streamWatcher struct {
@@ -449,12 +452,18 @@ func (e *KeyValue) BucketRevision() int64 {
 	return int64(e.lastSeq.Load())
 }
 
-func (e *KeyValue) List(ctx context.Context, key, end string, limit, revision int64, keysOnly bool) ([]jetstream.KeyValueEntry, error) {
+func (e *KeyValue) List(ctx context.Context, key, end string, limit, revision int64, keysOnly bool, sel *util.Selectors) ([]jetstream.KeyValueEntry, error) {
 	err := e.checkRevision("", revision)
 	if err != nil {
 		return nil, err
 	}
 
+	if !sel.Empty() {
+		if err := e.refreshMetadata(ctx, key, end, revision); err != nil {
+			return nil, err
+		}
+	}
+
 	it := e.bt.Iter()
 	if key != "" {
 		if ok := it.Seek(key); !ok {
@@ -474,7 +483,7 @@ func (e *KeyValue) List(ctx context.Context, key, end string, limit, revision in
 		v := it.Value()
 
 		// Get the latest update for the key.
-		if op := getSeqOp(v, revision, false); op != nil {
+		if op := getSeqOp(v, revision, false); op != nil && sel.Matches(op.meta) {
 			matches = append(matches, &keySeq{key: k, seq: op.seq})
 		}
 
@@ -504,8 +513,8 @@ func (e *KeyValue) List(ctx context.Context, key, end string, limit, revision in
 	return entries, nil
 }
 
-func (e *KeyValue) Count(ctx context.Context, key, end string, revision int64) (int64, error) {
-	matches, err := e.getListOps(key, end, revision)
+func (e *KeyValue) Count(ctx context.Context, key, end string, revision int64, sel *util.Selectors) (int64, error) {
+	matches, err := e.getListOps(ctx, key, end, revision, sel)
 	if err != nil {
 		return 0, err
 	}
@@ -679,6 +688,8 @@ func (e *KeyValue) btreeWatcher(ctx context.Context, hsize int) error {
 			key := x.Key()
 
 			var ex time.Time
+			var meta *util.Metadata
+			generation := util.MetadataGeneration()
 			if op == jetstream.KeyValuePut {
 				var nd natsData
 				err = nd.Decode(x)
@@ -686,6 +697,12 @@ func (e *KeyValue) btreeWatcher(ctx context.Context, hsize int) error {
 					continue
 				}
 
+				// Index the selectable metadata of every revision, so List and Count
+				// can filter without fetching values. Tombstones carry the deleted value.
+				if nd.KV != nil {
+					meta = util.DecodeMetadata(key, nd.KV.Value)
+				}
+
 				if nd.Delete {
 					op = jetstream.KeyValueDelete
 				} else if nd.KV.Lease > 0 {
@@ -706,9 +723,11 @@ func (e *KeyValue) btreeWatcher(ctx context.Context, hsize int) error {
 			}
 
 			val = append(val, &seqOp{
-				seq: seq,
-				op:  op,
-				ex:  ex,
+				seq:        seq,
+				op:         op,
+				ex:         ex,
+				meta:       meta,
+				generation: generation,
 			})
 
 			e.bt.Set(key, val)
@@ -731,12 +750,73 @@ func (e *KeyValue) btreeWatcher(ctx context.Context, hsize int) error {
 	}
 }
 
-func (e *KeyValue) getListOps(key, end string, revision int64) ([]*keySeq, error) {
+// refreshMetadata decodes again the metadata of the keys in range that was indexed
+// before the selectable fields last changed, so that List and Count filter on the
+// fields that are selectable now.
+func (e *KeyValue) refreshMetadata(ctx context.Context, key, end string, revision int64) error {
+	generation := util.MetadataGeneration()
+
+	var stale []*keySeq
+	e.btm.RLock()
+	it := e.bt.Iter()
+	if key == "" || it.Seek(key) {
+		for {
+			k := it.Key()
+			if (end == "" && k != key) || (end != "" && k >= end) {
+				break
+			}
+			if op := getSeqOp(it.Value(), revision, false); op != nil && op.generation != generation {
+				stale = append(stale, &keySeq{key: k, seq: op.seq})
+			}
+			if !it.Next() {
+				break
+			}
+		}
+	}
+	e.btm.RUnlock()
+
+	for _, ks := range stale {
+		var meta *util.Metadata
+		valueEntry, err := e.getRevision(ctx, ks.key, int64(ks.seq))
+		if err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+			return err
+		}
+		if err == nil {
+			var nd natsData
+			if err := nd.Decode(valueEntry); err != nil {
+				return err
+			}
+			if nd.KV != nil {
+				meta = util.DecodeMetadata(ks.key, nd.KV.Value)
+			}
+		}
+
+		e.btm.Lock()
+		val, _ := e.bt.Get(ks.key)
+		for _, op := range val {
+			if op.seq == ks.seq {
+				op.meta = meta
+				op.generation = generation
+			}
+		}
+		e.btm.Unlock()
+	}
+
+	return nil
+}
+
+func (e *KeyValue) getListOps(ctx context.Context, key, end string, revision int64, sel *util.Selectors) ([]*keySeq, error) {
 	err := e.checkRevision("", revision)
 	if err != nil {
 		return nil, err
 	}
 
+	if !sel.Empty() {
+		if err := e.refreshMetadata(ctx, key, end, revision); err != nil {
+			return nil, err
+		}
+	}
+
 	it := e.bt.Iter()
 	if key != "" {
 		if ok := it.Seek(key); !ok {
@@ -756,7 +836,7 @@ func (e *KeyValue) getListOps(key, end string, revision int64) ([]*keySeq, error
 		v := it.Value()
 
 		// Get the latest update for the key.
-		if op := getSeqOp(v, revision, false); op != nil {
+		if op := getSeqOp(v, revision, false); op != nil && sel.Matches(op.meta) {
 			matches = append(matches, &keySeq{key: k, seq: op.seq})
 		}
 
@@ -769,6 +849,26 @@ func (e *KeyValue) getListOps(key, end string, revision int64) ([]*keySeq, error
 	return matches, nil
 }
 
+// getMetadata returns the indexed metadata of key at exactly the given revision.
+// The second return value is false if the btree watcher has not indexed that
+// revision, either because it is lagging or because it was trimmed from history,
+// or if the selectable fields changed since it was indexed.
+func (e *KeyValue) getMetadata(key string, revision int64) (*util.Metadata, bool) {
+	e.btm.RLock()
+	defer e.btm.RUnlock()
+
+	val, _ := e.bt.Get(key)
+	for i := len(val) - 1; i >= 0; i-- {
+		if op := val[i]; op.seq == uint64(revision) {
+			return op.meta, op.generation == util.MetadataGeneration()
+		} else if op.seq < uint64(revision) {
+			break
+		}
+	}
+
+	return nil, false
+}
+
 // getRevisionOp returns the latest btree operation for the requested revision
 func (e *KeyValue) getRevisionOp(key string, revision int64, allowDeleted bool) (*seqOp, error) {
 	e.btm.RLock()
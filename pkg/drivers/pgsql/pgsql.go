@@ -45,8 +45,12 @@ var (
 				prev_revision BIGINT,
  				lease INTEGER,
  				value bytea,
- 				old_value bytea
+ 				old_value bytea,
+				committed BIGINT
  			);`,
+		// The schema is applied to existing databases too, which need the commit time
+		// of each row added. Rows written before it was added have none.
+		`ALTER TABLE kine ADD COLUMN IF NOT EXISTS committed BIGINT`,
 
 		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
 		`CREATE INDEX IF NOT EXISTS kine_uid_index ON kine (uid)`,
@@ -55,6 +59,7 @@ var (
 		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
 		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
 		`CREATE INDEX IF NOT EXISTS kine_list_query_index on kine(name, id DESC, deleted)`,
+		`CREATE INDEX IF NOT EXISTS kine_committed_index ON kine (committed, id)`,
 		`CREATE TABLE IF NOT EXISTS kine_labels
 			(
 				kine_id BIGINT,
@@ -64,6 +69,7 @@ var (
 				FOREIGN KEY (kine_id) REFERENCES kine(id) ON DELETE CASCADE
 			)`,
 		`CREATE INDEX IF NOT EXISTS kine_labels_name_index ON kine_labels (kine_name, name, value)`,
+		`CREATE INDEX IF NOT EXISTS kine_labels_kine_id_index ON kine_labels (kine_id, name, value)`,
 		`CREATE TABLE IF NOT EXISTS kine_fields
 			(
 				kine_id BIGINT,
@@ -81,6 +87,40 @@ var (
 				FOREIGN KEY (kine_id) REFERENCES kine(id) ON DELETE CASCADE
 			)`,
 		`CREATE INDEX IF NOT EXISTS kine_owners_owner_index ON kine_owners (owner)`,
+		`CREATE TABLE IF NOT EXISTS kine_reindex
+			(
+				prefix TEXT COLLATE "C" PRIMARY KEY,
+				fingerprint VARCHAR(64),
+				revision BIGINT,
+				last_key TEXT COLLATE "C",
+				finished INTEGER DEFAULT 0
+			)`,
+		`CREATE TABLE IF NOT EXISTS kine_current
+			(
+				name TEXT COLLATE "C" PRIMARY KEY,
+				id BIGINT
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_current_id_index ON kine_current (id)`,
+		`CREATE TABLE IF NOT EXISTS kine_gc_queue
+			(
+				id BIGSERIAL PRIMARY KEY,
+				owner VARCHAR(36),
+				orphan INTEGER DEFAULT 0,
+				foreground INTEGER DEFAULT 0,
+				enqueued BIGINT
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_gc_queue_owner_index ON kine_gc_queue (owner)`,
+		`CREATE TABLE IF NOT EXISTS kine_leases
+			(
+				name TEXT COLLATE "C" PRIMARY KEY,
+				holder TEXT,
+				expires BIGINT
+			)`,
+		`CREATE TABLE IF NOT EXISTS kine_compact_prefixes
+			(
+				prefix TEXT COLLATE "C" PRIMARY KEY,
+				revision BIGINT
+			)`,
 	}
 	schemaMigrations = []string{
 		`ALTER TABLE kine ALTER COLUMN id SET DATA TYPE BIGINT, ALTER COLUMN create_revision SET DATA TYPE BIGINT, ALTER COLUMN prev_revision SET DATA TYPE BIGINT; ALTER SEQUENCE kine_id_seq AS BIGINT`,
@@ -125,16 +165,15 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 				kd.id <= $2
 		) AS ks
 		WHERE kv.id = ks.id`, "$", true, "Compact")
-	dialect.SelectorLookupSQL = "value->>? LIKE CONCAT('%%', ?::TEXT, '%%')"
-	dialect.GetOwnedSQL = query.New(`
-		SELECT s.id, s.name, s.create_revision, s.value FROM (
-			SELECT DISTINCT ON (k.name)
-				k.id, k.name, k.create_revision, k.value, k.deleted
-			FROM kine_owners AS ko
-			LEFT JOIN kine AS k ON k.id = ko.kine_id
-			WHERE ko.owner = $1
-			ORDER BY k.name, k.id DESC
-		) AS s WHERE s.deleted = 0`, "$", true, "GetOwned")
+	dialect.SelectorLookupSQL = "COALESCE(value->>?, '') = ?::TEXT"
+	dialect.FieldExistsSQL = "(value->?::TEXT) IS NOT NULL"
+	dialect.FieldContainsSQL = "value @> ?::JSONB"
+	dialect.CurrentMetadataOnly = cfg.CurrentMetadataOnly
+	dialect.GCMaxObjects = cfg.GCMaxObjects
+	dialect.SelectorIntegerSQL = `CASE WHEN value ~ '^[0-9]+$' AND (
+		LENGTH(LTRIM(value, '0')) < 19 OR
+		(LENGTH(LTRIM(value, '0')) = 19 AND LTRIM(value, '0') COLLATE "C" <= '9223372036854775807')
+	) THEN CAST(value AS BIGINT) END`
 	dialect.FillRetryDuration = time.Millisecond + 5
 	dialect.InsertRetry = func(err error) bool {
 		if err, ok := err.(*pgconn.PgError); ok && err.Code == pgerrcode.UniqueViolation && err.ConstraintName == "kine_pkey" {
@@ -169,7 +208,9 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 	}
 
 	dialect.Migrate(context.Background())
-	return true, logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)), nil
+	dialect.MigrateCurrent(context.Background())
+	dialect.CheckExtraFields(ctx)
+	return true, logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactRetainDuration, cfg.CompactRetainPrefixes, cfg.CompactBatchSize, cfg.PollBatchSize)), nil
 }
 
 func setup(db *sql.DB) error {
@@ -0,0 +1,159 @@
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testDSNEnv names the environment variable holding the address of a postgres server
+// to run the tests against, in the form accepted by --endpoint without the scheme, for
+// instance postgres:postgres@localhost:5432/?sslmode=disable. The tests are skipped
+// when it is not set.
+const testDSNEnv = "KINE_TEST_POSTGRES_DSN"
+
+// setupBackend starts a backend on a new database of the test server, and returns a
+// connection to that database as well.
+func setupBackend(t *testing.T) (context.Context, server.Backend, *sql.DB) {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	dsn = strings.TrimPrefix(dsn, "postgres://")
+
+	path, query, _ := strings.Cut(dsn, "?")
+	host, _, _ := strings.Cut(path, "/")
+	dsn = fmt.Sprintf("%s/kine_test_%d?%s", host, time.Now().UnixNano(), query)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	wg := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	_, backend, err := New(ctx, wg, &drivers.Config{
+		DataSourceName:   dsn,
+		CompactTimeout:   5 * time.Second,
+		CompactMinRetain: 1000,
+		CompactBatchSize: 1000,
+		PollBatchSize:    500,
+	})
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatalf("failed to start backend: %v", err)
+	}
+
+	config, err := prepareConfig(dsn, tls.Config{})
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", testDSNEnv, err)
+	}
+	db := sql.OpenDB(stdlib.GetConnector(*config))
+	t.Cleanup(func() { db.Close() })
+
+	return ctx, backend, db
+}
+
+func TestFieldSelectorsUseContainmentIndex(t *testing.T) {
+	ctx, backend, db := setupBackend(t)
+
+	keys := map[string]string{}
+	for i := range 20 {
+		pod := &corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: fmt.Sprintf("pod-%02d", i)},
+			Spec:       corev1.PodSpec{NodeName: fmt.Sprintf("node%d", i%4)},
+		}
+		value, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatalf("failed to marshal pod: %v", err)
+		}
+		key := "/registry/pods/default/" + pod.Name
+		if _, err := backend.Create(ctx, key, value, 0); err != nil {
+			t.Fatalf("failed to create %s: %v", key, err)
+		}
+		keys[key] = pod.Spec.NodeName
+	}
+
+	for _, tc := range []struct {
+		selector string
+		matches  func(nodeName string) bool
+	}{
+		{"spec.nodeName=node1", func(n string) bool { return n == "node1" }},
+		{"spec.nodeName!=node1", func(n string) bool { return n != "node1" }},
+		{"spec.nodeName=node1,metadata.namespace=default", func(n string) bool { return n == "node1" }},
+		{"spec.nodeName=node1,spec.nodeName=node2", func(string) bool { return false }},
+		{"spec.nodeName=", func(n string) bool { return n == "" }},
+	} {
+		want := []string{}
+		for key, nodeName := range keys {
+			if tc.matches(nodeName) {
+				want = append(want, key)
+			}
+		}
+		slices.Sort(want)
+
+		_, kvs, err := backend.List(ctx, "/registry/pods/", "/registry/pods0", 0, 0, false, "", tc.selector)
+		if err != nil {
+			t.Fatalf("list %q failed: %v", tc.selector, err)
+		}
+		listed := []string{}
+		for _, kv := range kvs {
+			listed = append(listed, kv.Key)
+		}
+		if !slices.Equal(want, listed) {
+			t.Errorf("list %q: expected %v, got %v", tc.selector, want, listed)
+		}
+	}
+
+	// the table is too small for the planner to prefer an index on its own
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("failed to get connection: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SET enable_seqscan = off`); err != nil {
+		t.Fatalf("failed to disable sequential scans: %v", err)
+	}
+	rows, err := conn.QueryContext(ctx, `
+		EXPLAIN SELECT kine_id
+		FROM kine_fields
+		WHERE kine_name LIKE $1 ESCAPE '!' AND (value @> $2::JSONB)`,
+		"/registry/pods/%", `{"spec_nodeName":"node1"}`)
+	if err != nil {
+		t.Fatalf("explain failed: %v", err)
+	}
+	defer rows.Close()
+	plan := []string{}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			t.Fatalf("failed to scan plan: %v", err)
+		}
+		plan = append(plan, line)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("failed to read plan: %v", err)
+	}
+	if !strings.Contains(strings.Join(plan, "\n"), "kine_fields_value_index") {
+		t.Errorf("expected the containment lookup to use kine_fields_value_index, got plan:\n%s", strings.Join(plan, "\n"))
+	}
+}
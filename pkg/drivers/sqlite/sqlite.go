@@ -34,7 +34,8 @@ var (
 				prev_revision INTEGER,
 				lease INTEGER,
 				value BLOB,
-				old_value BLOB
+				old_value BLOB,
+				committed INTEGER
 			)`,
 		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
 		`CREATE INDEX IF NOT EXISTS kine_uid_index ON kine (uid)`,
@@ -52,6 +53,7 @@ var (
 				FOREIGN KEY (kine_id) REFERENCES kine(id) ON DELETE CASCADE
 			)`,
 		`CREATE INDEX IF NOT EXISTS kine_labels_name_index ON kine_labels (kine_name, name, value)`,
+		`CREATE INDEX IF NOT EXISTS kine_labels_kine_id_index ON kine_labels (kine_id, name, value)`,
 		`CREATE TABLE IF NOT EXISTS kine_fields
 			(
 				kine_id INTEGER,
@@ -60,6 +62,17 @@ var (
 				FOREIGN KEY (kine_id) REFERENCES kine(id) ON DELETE CASCADE
 			)`,
 		`CREATE INDEX IF NOT EXISTS kine_fields_name_index ON kine_fields (kine_name)`,
+		`CREATE TABLE IF NOT EXISTS kine_field_values
+			(
+				kine_id INTEGER,
+				kine_name TEXT,
+				name TEXT,
+				value TEXT,
+				FOREIGN KEY (kine_id) REFERENCES kine(id) ON DELETE CASCADE
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_field_values_name_index ON kine_field_values (name, value, kine_name, kine_id)`,
+		`CREATE INDEX IF NOT EXISTS kine_field_values_kine_id_index ON kine_field_values (kine_id, name, value)`,
+		`CREATE INDEX IF NOT EXISTS kine_field_values_kine_name_index ON kine_field_values (kine_name)`,
 		`CREATE TABLE IF NOT EXISTS kine_owners
 			(
 				kine_id INTEGER,
@@ -68,6 +81,62 @@ var (
 				FOREIGN KEY (kine_id) REFERENCES kine(id) ON DELETE CASCADE
 			)`,
 		`CREATE INDEX IF NOT EXISTS kine_owners_owner_index ON kine_owners (owner)`,
+		`CREATE TABLE IF NOT EXISTS kine_reindex
+			(
+				prefix TEXT PRIMARY KEY,
+				fingerprint TEXT,
+				revision INTEGER,
+				last_key TEXT,
+				finished INTEGER DEFAULT 0
+			)`,
+		`CREATE TABLE IF NOT EXISTS kine_current
+			(
+				name TEXT PRIMARY KEY,
+				id INTEGER
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_current_id_index ON kine_current (id)`,
+		// Each row is recorded as the current row of its key by the statement inserting
+		// it, so that writes without metadata do not need a transaction.
+		`CREATE TRIGGER IF NOT EXISTS kine_current_insert AFTER INSERT ON kine
+			BEGIN
+				INSERT INTO kine_current(name, id) VALUES (NEW.name, NEW.id)
+				ON CONFLICT (name) DO UPDATE SET id = excluded.id WHERE excluded.id > kine_current.id;
+			END`,
+		`CREATE TABLE IF NOT EXISTS kine_gc_queue
+			(
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				owner TEXT,
+				orphan INTEGER DEFAULT 0,
+				foreground INTEGER DEFAULT 0,
+				enqueued INTEGER
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_gc_queue_owner_index ON kine_gc_queue (owner)`,
+		`CREATE TABLE IF NOT EXISTS kine_leases
+			(
+				name TEXT PRIMARY KEY,
+				holder TEXT,
+				expires INTEGER
+			)`,
+		`CREATE TABLE IF NOT EXISTS kine_compact_prefixes
+			(
+				prefix TEXT PRIMARY KEY,
+				revision INTEGER
+			)`,
+	}
+
+	// migrationColumns are the columns of the kine table added after it was first
+	// created, with the indexes on them.
+	migrationColumns = []struct {
+		name       string
+		definition string
+		indexes    []string
+	}{
+		// Rows written before the commit time was added have none.
+		{
+			name:       "committed",
+			definition: "INTEGER",
+			indexes:    []string{`CREATE INDEX IF NOT EXISTS kine_committed_index ON kine (committed, id)`},
+		},
 	}
 )
 
@@ -110,7 +179,15 @@ func NewVariant(ctx context.Context, wg *sync.WaitGroup, driverName string, cfg
 		return nil, nil, err
 	}
 
-	dialect.SelectorLookupSQL = "json_extract(value, '$.%s') LIKE CONCAT('%%', ?, '%%')"
+	dialect.SelectorLookupSQL = "COALESCE(json_extract(value, '$.%s'), '') = ?"
+	dialect.FieldExistsSQL = "json_type(value, '$.%s') IS NOT NULL"
+	dialect.CurrentMetadataOnly = cfg.CurrentMetadataOnly
+	dialect.GCMaxObjects = cfg.GCMaxObjects
+	dialect.IndexFieldValues = true
+	dialect.SelectorIntegerSQL = `CASE WHEN value != '' AND value NOT GLOB '*[^0-9]*' AND (
+		LENGTH(LTRIM(value, '0')) < 19 OR
+		(LENGTH(LTRIM(value, '0')) = 19 AND LTRIM(value, '0') <= '9223372036854775807')
+	) THEN CAST(value AS INTEGER) END`
 	dialect.LastInsertID = true
 	dialect.GetSizeSQL = query.New(`
 		SELECT (page_count - freelist_count) * page_size
@@ -145,7 +222,9 @@ func NewVariant(ctx context.Context, wg *sync.WaitGroup, driverName string, cfg
 	}
 
 	dialect.Migrate(context.Background())
-	return logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)), dialect, nil
+	dialect.MigrateCurrent(context.Background())
+	dialect.CheckExtraFields(ctx)
+	return logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactRetainDuration, cfg.CompactRetainPrefixes, cfg.CompactBatchSize, cfg.PollBatchSize)), dialect, nil
 }
 
 func setup(db *sql.DB, noCheckpointing, noAutoCheckpoint, noStartupVacuum bool) error {
@@ -169,6 +248,10 @@ func setup(db *sql.DB, noCheckpointing, noAutoCheckpoint, noStartupVacuum bool)
 		}
 	}
 
+	if err := migrate(db); err != nil {
+		return err
+	}
+
 	logrus.Infof("Database tables and indexes are up to date")
 
 	if noStartupVacuum {
@@ -186,6 +269,32 @@ func setup(db *sql.DB, noCheckpointing, noAutoCheckpoint, noStartupVacuum bool)
 	return nil
 }
 
+// migrate adds the columns that the kine table of existing databases lacks, as SQLite
+// cannot add a column only if it does not exist, and indexes them.
+func migrate(db *sql.DB) error {
+	for _, column := range migrationColumns {
+		var exists int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('kine') WHERE name = ?`, column.name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			stmt := fmt.Sprintf(`ALTER TABLE kine ADD COLUMN %s %s`, column.name, column.definition)
+			logrus.Tracef("SETUP EXEC MIGRATION: %v", stmt)
+			if _, err := db.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		for _, stmt := range column.indexes {
+			logrus.Tracef("SETUP EXEC : %v", query.Strip(stmt))
+			if _, err := db.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func init() {
 	drivers.Register("sqlite", New)
 	drivers.Register("litestream", NewWithLitestream)
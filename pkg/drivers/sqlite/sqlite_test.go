@@ -149,3 +149,31 @@ func TestSetupVacuumDisabledPreservesFileSize(t *testing.T) {
 
 	t.Logf("No VACUUM: freelist pages before=%d, after=%d", freelistBefore, freelistAfter)
 }
+
+func TestSetupAddsCommittedColumn(t *testing.T) {
+	db := createBloatedDB(t, 1)
+	defer db.Close()
+
+	// Run setup twice, as on consecutive startups of an existing database.
+	for range 2 {
+		if err := setup(db, false, false, true); err != nil {
+			t.Fatalf("setup() failed: %v", err)
+		}
+	}
+
+	var columns int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('kine') WHERE name = 'committed'`).Scan(&columns); err != nil {
+		t.Fatalf("failed to query table info: %v", err)
+	}
+	if columns != 1 {
+		t.Errorf("expected the committed column to be added once, found %d", columns)
+	}
+
+	var indexes int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_index_list('kine') WHERE name = 'kine_committed_index'`).Scan(&indexes); err != nil {
+		t.Fatalf("failed to query index list: %v", err)
+	}
+	if indexes != 1 {
+		t.Errorf("expected the committed column to be indexed, found %d indexes", indexes)
+	}
+}
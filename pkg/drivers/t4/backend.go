@@ -10,13 +10,19 @@ import (
 
 	kserver "github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/ttl"
+	"github.com/k3s-io/kine/pkg/util"
 	"github.com/sirupsen/logrus"
 	"github.com/t4db/t4"
 )
 
+// selectorPageSize is the number of keys read from the node per page when a List or
+// Count with selectors has to scan past non-matching keys.
+const selectorPageSize = 500
+
 // backend implements kine's server.Backend using a *t4.Node.
 type backend struct {
-	node *t4.Node
+	node  *t4.Node
+	index *metaIndex
 }
 
 // Start blocks until the t4 node is ready to serve writes, retrying
@@ -37,6 +43,7 @@ func (b *backend) Start(ctx context.Context) error {
 		_, err := b.node.Create(ctx, kserver.HealthKey, []byte(kserver.HealthVal), 0)
 		if err == nil || errors.Is(err, t4.ErrKeyExists) {
 			if err = b.refreshHealthKey(ctx); err == nil {
+				go b.index.run(ctx, b.node)
 				go ttl.Run(ctx, b)
 				return nil
 			}
@@ -130,7 +137,7 @@ func (b *backend) Delete(ctx context.Context, key string, revision int64) (int64
 	return newRev, toServerKV(oldKV, false), deleted, nil
 }
 
-func (b *backend) List(ctx context.Context, key, end string, limit, revision int64, keysOnly bool, _, _ string) (int64, []*kserver.KeyValue, error) {
+func (b *backend) List(ctx context.Context, key, end string, limit, revision int64, keysOnly bool, labelSelector, fieldSelector string) (int64, []*kserver.KeyValue, error) {
 	curRev := b.node.CurrentRevision()
 	if revision > 0 && revision > curRev {
 		return curRev, nil, kserver.ErrFutureRev
@@ -138,7 +145,22 @@ func (b *backend) List(ctx context.Context, key, end string, limit, revision int
 	if revision > 0 && revision < b.node.CompactRevision() {
 		return curRev, nil, kserver.ErrCompacted
 	}
+	sel, err := util.ParseSelectors(labelSelector, fieldSelector)
+	if err != nil {
+		return curRev, nil, err
+	}
 	prefix, startKey := translateRange(key, end)
+	if !sel.Empty() {
+		var out []*kserver.KeyValue
+		err := b.scanSelected(ctx, prefix, startKey, revision, sel, func(kv *t4.KeyValue) bool {
+			out = append(out, toServerKV(kv, keysOnly))
+			return limit <= 0 || int64(len(out)) < limit
+		})
+		if err != nil {
+			return curRev, nil, translateErr(err)
+		}
+		return curRev, out, nil
+	}
 	opts := readOpts(revision)
 	if startKey != "" {
 		opts = append(opts, t4.WithFromKey(startKey))
@@ -157,7 +179,7 @@ func (b *backend) List(ctx context.Context, key, end string, limit, revision int
 	return curRev, out, nil
 }
 
-func (b *backend) Count(ctx context.Context, key, end string, revision int64, _, _ string) (int64, int64, error) {
+func (b *backend) Count(ctx context.Context, key, end string, revision int64, labelSelector, fieldSelector string) (int64, int64, error) {
 	curRev := b.node.CurrentRevision()
 	if revision > 0 && revision > curRev {
 		return curRev, 0, kserver.ErrFutureRev
@@ -165,7 +187,22 @@ func (b *backend) Count(ctx context.Context, key, end string, revision int64, _,
 	if revision > 0 && revision < b.node.CompactRevision() {
 		return curRev, 0, kserver.ErrCompacted
 	}
+	sel, err := util.ParseSelectors(labelSelector, fieldSelector)
+	if err != nil {
+		return curRev, 0, err
+	}
 	prefix, startKey := translateRange(key, end)
+	if !sel.Empty() {
+		var count int64
+		err := b.scanSelected(ctx, prefix, startKey, revision, sel, func(*t4.KeyValue) bool {
+			count++
+			return true
+		})
+		if err != nil {
+			return curRev, 0, translateErr(err)
+		}
+		return curRev, count, nil
+	}
 	opts := readOpts(revision)
 	if key != "" {
 		opts = append(opts, t4.WithFromKey(startKey))
@@ -177,6 +214,52 @@ func (b *backend) Count(ctx context.Context, key, end string, revision int64, _,
 	return curRev, count, nil
 }
 
+// scanSelected pages through the keys under prefix at revision and calls fn for each
+// one matching sel, until fn returns false. A HEAD read is pinned to the revision the
+// node has reached after syncing with the leader, so that all pages come from the
+// same snapshot.
+func (b *backend) scanSelected(ctx context.Context, prefix, startKey string, revision int64, sel *util.Selectors, fn func(*t4.KeyValue) bool) error {
+	if revision <= 0 {
+		if _, err := b.node.LinearizableExists(ctx, prefix); err != nil {
+			return err
+		}
+		revision = b.node.CurrentRevision()
+	}
+
+	for {
+		opts := []t4.ReadOption{t4.WithRevision(revision), t4.WithLimit(selectorPageSize)}
+		if startKey != "" {
+			opts = append(opts, t4.WithFromKey(startKey))
+		}
+		kvs, err := b.node.List(prefix, opts...)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			if sel.Matches(b.index.get(kv)) && !fn(kv) {
+				return nil
+			}
+		}
+		if len(kvs) < selectorPageSize {
+			return nil
+		}
+		startKey = kvs[len(kvs)-1].Key + "\x00"
+	}
+}
+
+// matches reports whether a watch event passes the selectors. Like the SQL drivers,
+// an event is sent if either the new or the previous value matches, so that
+// watchers see objects leave the selection.
+func (b *backend) matches(sel *util.Selectors, ev *t4.Event) bool {
+	if sel.Empty() {
+		return true
+	}
+	if ev.Type == t4.EventPut && sel.Matches(b.index.get(ev.KV)) {
+		return true
+	}
+	return ev.PrevKV != nil && sel.Matches(b.index.get(ev.PrevKV))
+}
+
 func (b *backend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *kserver.KeyValue, bool, error) {
 	newRev, oldKV, updated, err := b.node.Update(ctx, key, value, revision, lease)
 	if err != nil {
@@ -185,7 +268,7 @@ func (b *backend) Update(ctx context.Context, key string, value []byte, revision
 	return newRev, toServerKV(oldKV, false), updated, nil
 }
 
-func (b *backend) Watch(ctx context.Context, key, end string, revision int64, _, _ string) kserver.WatchResult {
+func (b *backend) Watch(ctx context.Context, key, end string, revision int64, labelSelector, fieldSelector string) kserver.WatchResult {
 	curRev := b.node.CurrentRevision()
 	compactRev := b.node.CompactRevision()
 
@@ -199,6 +282,14 @@ func (b *backend) Watch(ctx context.Context, key, end string, revision int64, _,
 		return kserver.WatchResult{CurrentRevision: curRev, CompactRevision: compactRev, Events: eventCh, Errorc: errCh}
 	}
 
+	sel, err := util.ParseSelectors(labelSelector, fieldSelector)
+	if err != nil {
+		errCh <- err
+		close(errCh)
+		close(eventCh)
+		return kserver.WatchResult{CurrentRevision: curRev, Events: eventCh, Errorc: errCh}
+	}
+
 	prefix, _ := translateRange(key, end)
 	go func() {
 		defer close(eventCh)
@@ -218,7 +309,10 @@ func (b *backend) Watch(ctx context.Context, key, end string, revision int64, _,
 		// loop only takes immediately available events.
 		const maxBatch = 64
 		for ev := range ch {
-			batch := []*kserver.Event{toServerEvent(&ev)}
+			var batch []*kserver.Event
+			if b.matches(sel, &ev) {
+				batch = append(batch, toServerEvent(&ev))
+			}
 		drain:
 			for len(batch) < maxBatch {
 				select {
@@ -226,11 +320,16 @@ func (b *backend) Watch(ctx context.Context, key, end string, revision int64, _,
 					if !ok {
 						break drain
 					}
-					batch = append(batch, toServerEvent(&ev2))
+					if b.matches(sel, &ev2) {
+						batch = append(batch, toServerEvent(&ev2))
+					}
 				default:
 					break drain
 				}
 			}
+			if len(batch) == 0 {
+				continue
+			}
 			select {
 			case eventCh <- batch:
 			case <-ctx.Done():
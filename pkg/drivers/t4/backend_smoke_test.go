@@ -2,7 +2,9 @@ package t4
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -164,6 +166,154 @@ func TestT4Backend_ListAndCount(t *testing.T) {
 	}
 }
 
+func objectValue(t *testing.T, namespace, name string, labels map[string]string) []byte {
+	t.Helper()
+	value, err := json.Marshal(map[string]any{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]any{
+			"namespace": namespace,
+			"name":      name,
+			"labels":    labels,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	return value
+}
+
+func listKeys(ctx context.Context, t *testing.T, b kserver.Backend, limit, revision int64, labelSelector, fieldSelector string) []string {
+	t.Helper()
+	_, kvs, err := b.List(ctx, "/registry/configmaps/", "/registry/configmaps0", limit, revision, false, labelSelector, fieldSelector)
+	if err != nil {
+		t.Fatalf("List %q %q: %v", labelSelector, fieldSelector, err)
+	}
+	keys := []string{}
+	for _, kv := range kvs {
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+func TestT4Backend_ListAndCountSelectors(t *testing.T) {
+	b, ctx := newLocalBackend(t)
+
+	rev, err := b.Create(ctx, "/registry/configmaps/default/a", objectValue(t, "default", "a", map[string]string{"app": "web"}), 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for _, obj := range []struct {
+		namespace, name string
+		labels          map[string]string
+	}{
+		{"default", "b", map[string]string{"app": "db"}},
+		{"default", "c", nil},
+		{"other", "a", map[string]string{"app": "web"}},
+	} {
+		if _, err := b.Create(ctx, "/registry/configmaps/"+obj.namespace+"/"+obj.name, objectValue(t, obj.namespace, obj.name, obj.labels), 0); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	if _, err := b.Create(ctx, "/registry/configmaps/other/raw", []byte("not an object"), 0); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	for _, tc := range []struct {
+		labelSelector, fieldSelector string
+		limit                        int64
+		want                         []string
+	}{
+		{"app=web", "", 0, []string{"/registry/configmaps/default/a", "/registry/configmaps/other/a"}},
+		{"app!=web", "", 0, []string{"/registry/configmaps/default/b", "/registry/configmaps/default/c"}},
+		{"app", "metadata.namespace=other", 0, []string{"/registry/configmaps/other/a"}},
+		{"app=web", "", 1, []string{"/registry/configmaps/default/a"}},
+	} {
+		got := listKeys(ctx, t, b, tc.limit, 0, tc.labelSelector, tc.fieldSelector)
+		if !slices.Equal(tc.want, got) {
+			t.Fatalf("List %q %q limit=%d = %v, want %v", tc.labelSelector, tc.fieldSelector, tc.limit, got, tc.want)
+		}
+	}
+
+	// Selectors are evaluated against the values at the requested revision.
+	if _, _, _, err := b.Update(ctx, "/registry/configmaps/default/a", objectValue(t, "default", "a", map[string]string{"app": "db"}), rev, 0); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got, want := listKeys(ctx, t, b, 0, 0, "app=web", ""), []string{"/registry/configmaps/other/a"}; !slices.Equal(want, got) {
+		t.Fatalf("List at HEAD = %v, want %v", got, want)
+	}
+	if got, want := listKeys(ctx, t, b, 0, rev, "app=web", ""), []string{"/registry/configmaps/default/a"}; !slices.Equal(want, got) {
+		t.Fatalf("List at %d = %v, want %v", rev, got, want)
+	}
+
+	_, count, err := b.Count(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, "app=db", "")
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("Count app=db = %d, want 2", count)
+	}
+	_, count, err = b.Count(ctx, "/registry/configmaps/", "/registry/configmaps0", rev, "app=db", "")
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("Count app=db at %d = %d, want 0", rev, count)
+	}
+
+	if _, _, err := b.List(ctx, "/registry/configmaps/", "/registry/configmaps0", 0, 0, false, "app in (", ""); err == nil {
+		t.Fatal("List with invalid selector: want error")
+	}
+}
+
+func TestT4Backend_WatchSelectors(t *testing.T) {
+	b, ctx := newLocalBackend(t)
+
+	startRev, err := b.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("CurrentRevision: %v", err)
+	}
+
+	wr := b.Watch(ctx, "/registry/configmaps/", "/registry/configmaps0", startRev+1, "app=web", "")
+
+	rev1, err := b.Create(ctx, "/registry/configmaps/default/a", objectValue(t, "default", "a", map[string]string{"app": "web"}), 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := b.Create(ctx, "/registry/configmaps/default/b", objectValue(t, "default", "b", map[string]string{"app": "db"}), 0); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// Leaving the selection is still sent, with the matching previous value.
+	rev3, _, _, err := b.Update(ctx, "/registry/configmaps/default/a", objectValue(t, "default", "a", map[string]string{"app": "db"}), rev1, 0)
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, _, _, err := b.Delete(ctx, "/registry/configmaps/default/a", rev3); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	// The last event is matched, to flush the ones before it.
+	rev5, err := b.Create(ctx, "/registry/configmaps/default/z", objectValue(t, "default", "z", map[string]string{"app": "web"}), 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	var got []int64
+	timeout := time.After(5 * time.Second)
+	for len(got) == 0 || got[len(got)-1] != rev5 {
+		select {
+		case batch := <-wr.Events:
+			for _, ev := range batch {
+				got = append(got, ev.KV.ModRevision)
+			}
+		case <-timeout:
+			t.Fatalf("Watch timeout, got revisions %v", got)
+		}
+	}
+	if want := []int64{rev1, rev3, rev5}; !slices.Equal(want, got) {
+		t.Fatalf("Watch revisions = %v, want %v", got, want)
+	}
+}
+
 func TestT4Backend_Watch(t *testing.T) {
 	b, ctx := newLocalBackend(t)
 
@@ -0,0 +1,183 @@
+package t4
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+	"github.com/t4db/t4"
+)
+
+// metaRev is the selectable metadata of a key at one modification revision.
+type metaRev struct {
+	revision   int64
+	meta       *util.Metadata
+	generation int64 // metadata generation meta was decoded under
+	deleted    bool
+}
+
+// metaIndex caches the selectable labels and fields of every key by modification
+// revision, kept in sync from the node's event stream and warmed by reads.
+//
+// It is only a cache: selector reads look up the revision of each value returned by
+// the node and decode the value when the index does not have it, so results are
+// correct at any revision the node can still serve, including ones from before the
+// index started. Entries decoded before the selectable fields last changed are
+// decoded again on read.
+type metaIndex struct {
+	mu        sync.RWMutex
+	keys      map[string][]metaRev
+	revision  int64 // last revision applied from the event stream
+	compacted int64 // compact revision the index was last pruned to
+}
+
+func newMetaIndex() *metaIndex {
+	return &metaIndex{
+		keys: map[string][]metaRev{},
+	}
+}
+
+// run applies the node's events to the index until ctx is done, re-establishing the
+// watch if the node closes it. If the node has compacted past the last applied
+// revision the index is cleared, as it can no longer tell which entries are stale.
+func (x *metaIndex) run(ctx context.Context, node *t4.Node) {
+	for ctx.Err() == nil {
+		x.mu.RLock()
+		startRev := x.revision
+		x.mu.RUnlock()
+		if startRev > 0 {
+			startRev++
+		}
+
+		ch, err := node.Watch(ctx, "", startRev)
+		if errors.Is(err, t4.ErrCompacted) {
+			logrus.Warnf("t4: metadata index fell behind compaction at revision %d, resetting", startRev)
+			x.reset()
+			continue
+		}
+		if errors.Is(err, t4.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logrus.Warnf("t4: metadata index watch failed: %v", err)
+		} else {
+			for ev := range ch {
+				x.apply(&ev, node.CompactRevision())
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (x *metaIndex) reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.keys = map[string][]metaRev{}
+	x.revision = 0
+}
+
+// apply records the metadata of the value written by ev, and prunes the index when
+// the node's compact revision has advanced.
+func (x *metaIndex) apply(ev *t4.Event, compactRev int64) {
+	if ev.KV == nil {
+		return
+	}
+
+	mr := metaRev{revision: ev.KV.Revision, generation: util.MetadataGeneration(), deleted: ev.Type == t4.EventDelete}
+	if !mr.deleted {
+		mr.meta = util.DecodeMetadata(ev.KV.Key, ev.KV.Value)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.insert(ev.KV.Key, mr)
+	if ev.KV.Revision > x.revision {
+		x.revision = ev.KV.Revision
+	}
+	if compactRev > x.compacted {
+		x.prune(compactRev)
+	}
+}
+
+// get returns the selectable metadata of kv, decoding and caching its value if the
+// index does not have that revision yet, or has it from an older generation.
+func (x *metaIndex) get(kv *t4.KeyValue) *util.Metadata {
+	generation := util.MetadataGeneration()
+
+	x.mu.RLock()
+	for _, mr := range x.keys[kv.Key] {
+		if mr.revision == kv.Revision && mr.generation == generation {
+			x.mu.RUnlock()
+			return mr.meta
+		}
+	}
+	x.mu.RUnlock()
+
+	meta := util.DecodeMetadata(kv.Key, kv.Value)
+	if len(kv.Value) > 0 && kv.Revision > x.compactedRevision() {
+		x.mu.Lock()
+		x.insert(kv.Key, metaRev{revision: kv.Revision, meta: meta, generation: generation})
+		x.mu.Unlock()
+	}
+	return meta
+}
+
+func (x *metaIndex) compactedRevision() int64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.compacted
+}
+
+// insert adds mr to the key's history, keeping it ordered by revision. An entry
+// for the same revision is replaced if mr was decoded under a newer generation.
+// Caller must hold x.mu (write).
+func (x *metaIndex) insert(key string, mr metaRev) {
+	hist := x.keys[key]
+	i, found := slices.BinarySearchFunc(hist, mr.revision, func(e metaRev, rev int64) int {
+		return cmp.Compare(e.revision, rev)
+	})
+	if found {
+		if mr.generation > hist[i].generation {
+			mr.deleted = mr.deleted || hist[i].deleted
+			hist[i] = mr
+		}
+		return
+	}
+	x.keys[key] = slices.Insert(hist, i, mr)
+}
+
+// prune drops the history that can no longer be read at or after compactRev: for
+// each key only the newest entry at or below compactRev is kept, and keys whose
+// newest such entry is a deletion are dropped entirely.
+// Caller must hold x.mu (write).
+func (x *metaIndex) prune(compactRev int64) {
+	for key, hist := range x.keys {
+		floor := -1
+		for i, mr := range hist {
+			if mr.revision > compactRev {
+				break
+			}
+			floor = i
+		}
+		switch {
+		case floor < 0:
+		case hist[floor].deleted && floor == len(hist)-1:
+			delete(x.keys, key)
+		case hist[floor].deleted:
+			x.keys[key] = slices.Clone(hist[floor+1:])
+		default:
+			x.keys[key] = slices.Clone(hist[floor:])
+		}
+	}
+	x.compacted = compactRev
+}
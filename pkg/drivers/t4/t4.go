@@ -136,7 +136,7 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (leaderEl
 
 	// t4 is shared-storage and supports multi-server clusters, so kubernetes
 	// components (apiserver, controller-manager) need leader election enabled.
-	return true, &backend{node: node}, nil
+	return true, &backend{node: node, index: newMetaIndex()}, nil
 }
 
 // parseConfig translates the DSN (everything after "t4://") and the
@@ -12,9 +12,12 @@ import (
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/k3s-io/kine/pkg/crds"
 	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/gc"
 	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/reindex"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/tls"
 	"github.com/k3s-io/kine/pkg/util"
@@ -31,6 +34,7 @@ import (
 const (
 	KineSocket          = "unix://kine.sock"
 	GracefulStopTimeout = 2 * time.Second
+	DefaultGCInterval   = time.Second
 
 	grpcOverheadBytes = 512 * 1024
 	maxSendBytes      = math.MaxInt32
@@ -51,8 +55,19 @@ type Config struct {
 	CompactIntervalJitter int
 	CompactTimeout        time.Duration
 	CompactMinRetain      int64
+	CompactRetainDuration time.Duration
+	CompactRetainPrefixes map[string]time.Duration
 	CompactBatchSize      int64
 	PollBatchSize         int64
+	ExtraFieldsFile       string
+	ReindexInterval       time.Duration
+	ReindexBatchSize      int64
+	GCInterval            time.Duration
+	GCDisabled            bool
+	GCSweepInterval       time.Duration
+	GCSweepDryRun         bool
+	CurrentMetadataOnly   bool
+	GCMaxObjects          int64
 	LogFormat             string
 	PeerConfig            drivers.PeerConfig
 	S3Config              drivers.S3Config
@@ -73,30 +88,9 @@ func Listen(ctx context.Context, config Config) (etcd ETCDConfig, rerr error) {
 		}
 	}()
 
-	leaderElect, backend, err := drivers.New(bctx, wg, &drivers.Config{
-		MetricsRegisterer:     config.MetricsRegisterer,
-		Endpoint:              config.Endpoint,
-		BackendTLSConfig:      config.BackendTLSConfig,
-		ConnectionPoolConfig:  config.ConnectionPoolConfig,
-		CompactInterval:       config.CompactInterval,
-		CompactIntervalJitter: config.CompactIntervalJitter,
-		CompactTimeout:        config.CompactTimeout,
-		CompactMinRetain:      config.CompactMinRetain,
-		CompactBatchSize:      config.CompactBatchSize,
-		PollBatchSize:         config.PollBatchSize,
-		PeerConfig:            config.PeerConfig,
-		S3Config:              config.S3Config,
-	})
-
+	leaderElect, backend, err := newBackend(bctx, wg, config)
 	if err != nil {
-		// Don't print the endpoint string in the error message as it may contain
-		// credentials - but we do want to indicate whether the failure was in the
-		// default or provided value.
-		epType := "default endpoint"
-		if config.Endpoint != "" {
-			epType = "configured endpoint"
-		}
-		return ETCDConfig{}, fmt.Errorf("failed to create driver for %s: %w", epType, err)
+		return ETCDConfig{}, err
 	}
 
 	if backend == nil {
@@ -114,6 +108,12 @@ func Listen(ctx context.Context, config Config) (etcd ETCDConfig, rerr error) {
 			metrics.SQLTime,
 			metrics.CompactTotal,
 			metrics.InsertErrorsTotal,
+			metrics.ReindexKeysTotal,
+			metrics.ReindexRemainingKeys,
+			metrics.GCQueueDepth,
+			metrics.GCTotal,
+			metrics.GCLatency,
+			metrics.GCDanglingOwners,
 		)
 	}
 
@@ -135,6 +135,31 @@ func Listen(ctx context.Context, config Config) (etcd ETCDConfig, rerr error) {
 		return ETCDConfig{}, fmt.Errorf("starting kine backend: %w", err)
 	}
 
+	// the selectable fields of custom resources must be known before they are written
+	crdRev, err := crds.Load(bctx, backend)
+	if err != nil {
+		return ETCDConfig{}, fmt.Errorf("loading custom resource definitions: %w", err)
+	}
+	go crds.Run(bctx, backend, crdRev)
+
+	if r, ok := backend.(server.Reindexer); ok && config.ReindexInterval > 0 {
+		go reindex.Run(bctx, r, config.ReindexInterval, config.ReindexBatchSize)
+	}
+
+	// garbage is collected unless it is explicitly left to other kines sharing the
+	// datastore, as the dependents of deleted owners are otherwise never deleted
+	if c, ok := backend.(server.GarbageCollector); ok && !config.GCDisabled {
+		interval := config.GCInterval
+		if interval <= 0 {
+			interval = DefaultGCInterval
+		}
+		go gc.Run(bctx, c, interval)
+	}
+
+	if c, ok := backend.(server.GarbageCollector); ok && config.GCSweepInterval > 0 {
+		go gc.RunSweeper(bctx, c, config.GCSweepInterval, config.GCSweepDryRun)
+	}
+
 	// set up GRPC server and register services
 	b := server.New(backend, endpointScheme(config), config.NotifyInterval, config.EmulatedETCDVersion)
 	b.Register(grpcServer)
@@ -165,6 +190,76 @@ func Listen(ctx context.Context, config Config) (etcd ETCDConfig, rerr error) {
 	}, nil
 }
 
+// Reindex rebuilds the metadata of the latest revision of every key under prefix in
+// the configured datastore, without serving it, and returns once it is done.
+func Reindex(ctx context.Context, config Config, prefix string) error {
+	wg := waitGroup(config)
+	bctx, bcancel := context.WithCancel(ctx)
+	defer bcancel()
+
+	_, backend, err := newBackend(bctx, wg, config)
+	if err != nil {
+		return err
+	}
+	r, ok := backend.(server.Reindexer)
+	if !ok {
+		return server.ErrReindexNotSupported
+	}
+
+	if err := backend.Start(bctx); err != nil {
+		return fmt.Errorf("starting kine backend: %w", err)
+	}
+
+	// custom resources are indexed by the selectable fields of their CRDs
+	if _, err := crds.Load(bctx, backend); err != nil {
+		return fmt.Errorf("loading custom resource definitions: %w", err)
+	}
+
+	return r.Reindex(bctx, prefix, config.ReindexBatchSize)
+}
+
+// newBackend loads the extra fields to index, and creates the driver for the
+// configured endpoint. The backend is nil if the endpoint is served by etcd itself.
+func newBackend(ctx context.Context, wg *sync.WaitGroup, config Config) (bool, server.Backend, error) {
+	if config.ExtraFieldsFile != "" {
+		if err := util.LoadExtraFields(config.ExtraFieldsFile); err != nil {
+			return false, nil, fmt.Errorf("failed to load extra fields: %w", err)
+		}
+	}
+
+	leaderElect, backend, err := drivers.New(ctx, wg, &drivers.Config{
+		MetricsRegisterer:     config.MetricsRegisterer,
+		Endpoint:              config.Endpoint,
+		BackendTLSConfig:      config.BackendTLSConfig,
+		ConnectionPoolConfig:  config.ConnectionPoolConfig,
+		CompactInterval:       config.CompactInterval,
+		CompactIntervalJitter: config.CompactIntervalJitter,
+		CompactTimeout:        config.CompactTimeout,
+		CompactMinRetain:      config.CompactMinRetain,
+		CompactRetainDuration: config.CompactRetainDuration,
+		CompactRetainPrefixes: config.CompactRetainPrefixes,
+		CompactBatchSize:      config.CompactBatchSize,
+		PollBatchSize:         config.PollBatchSize,
+		CurrentMetadataOnly:   config.CurrentMetadataOnly,
+		GCMaxObjects:          config.GCMaxObjects,
+		PeerConfig:            config.PeerConfig,
+		S3Config:              config.S3Config,
+	})
+
+	if err != nil {
+		// Don't print the endpoint string in the error message as it may contain
+		// credentials - but we do want to indicate whether the failure was in the
+		// default or provided value.
+		epType := "default endpoint"
+		if config.Endpoint != "" {
+			epType = "configured endpoint"
+		}
+		return false, nil, fmt.Errorf("failed to create driver for %s: %w", epType, err)
+	}
+
+	return leaderElect, backend, nil
+}
+
 // endpointURL returns a URI string suitable for use as a local etcd endpoint.
 // For TCP sockets, it is assumed that the port can be reached via the loopback address.
 func endpointURL(config Config, listener net.Listener) string {
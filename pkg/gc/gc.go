@@ -0,0 +1,54 @@
+// Package gc runs the garbage collection of the dependents of deleted objects for a
+// server.GarbageCollector.
+//
+// Objects labelled to skip the controller manager's metadata caching are garbage
+// collected by kine. Deleting such an object only queues it, in the same transaction
+// as the delete; Run collects the dependents of the queued owners in the background,
+// in transactions of their own, so that deleting an owner with many dependents does
+// not make its delete conflict with every other write.
+//
+// Owners that vanished without being queued, while kine was down or before their
+// dependents were labelled, are found by RunSweeper, which queues them as if they had
+// been deleted in the background.
+package gc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// Run collects the dependents of the owners queued in c every interval, until ctx is
+// done.
+func Run(ctx context.Context, c server.GarbageCollector, interval time.Duration) {
+	for {
+		if err := c.CollectGarbage(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logrus.Errorf("Garbage collection failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// RunSweeper sweeps c for dangling owners every interval, until ctx is done. With
+// dryRun, the dangling owners are only reported.
+func RunSweeper(ctx context.Context, c server.GarbageCollector, interval time.Duration, dryRun bool) {
+	for {
+		if _, err := c.SweepDanglingOwners(ctx, dryRun); err != nil && !errors.Is(err, context.Canceled) {
+			logrus.Errorf("Sweep for dangling owners failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Package testutil holds the fixtures of the tests that run against a sqlite backend.
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/drivers/sqlite"
+	"github.com/k3s-io/kine/pkg/server"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	PodsPrefix = "/registry/pods/"
+	PodsEnd    = "/registry/pods0"
+)
+
+// StartBackend starts a sqlite backend with cfg in a temporary directory, and returns
+// its dialect as well.
+func StartBackend(t *testing.T, cfg *drivers.Config) (context.Context, server.Backend, *generic.Generic) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	wg := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	cfg.DataSourceName = filepath.Join(t.TempDir(), "state.db") + "?" + sqlite.DefaultParams
+	backend, dialect, err := sqlite.NewVariant(ctx, wg, "sqlite3", cfg)
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+
+	if err := backend.Start(ctx); err != nil {
+		t.Fatalf("failed to start backend: %v", err)
+	}
+
+	return ctx, backend, dialect
+}
+
+// NewBackend starts a sqlite backend in a temporary directory.
+func NewBackend(t *testing.T) (context.Context, server.Backend) {
+	t.Helper()
+
+	ctx, backend, _ := NewDialect(t)
+	return ctx, backend
+}
+
+// NewDialect starts a sqlite backend in a temporary directory, and returns its
+// dialect as well.
+func NewDialect(t *testing.T) (context.Context, server.Backend, *generic.Generic) {
+	t.Helper()
+
+	return StartBackend(t, &drivers.Config{
+		CompactTimeout:   5 * time.Second,
+		CompactMinRetain: 1000,
+		CompactBatchSize: 1000,
+		PollBatchSize:    500,
+	})
+}
+
+// NewPod returns a pod scheduled to nodeName.
+func NewPod(namespace, name, nodeName string) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Spec: corev1.PodSpec{
+			NodeName: nodeName,
+		},
+	}
+}
+
+// PodKey returns the key the apiserver stores pod under.
+func PodKey(pod *corev1.Pod) string {
+	return PodsPrefix + pod.Namespace + "/" + pod.Name
+}
+
+// CreatePods writes pods to backend as JSON.
+func CreatePods(ctx context.Context, t *testing.T, backend server.Backend, pods []*corev1.Pod) {
+	t.Helper()
+
+	for _, pod := range pods {
+		value, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatalf("failed to marshal pod: %v", err)
+		}
+		if _, err := backend.Create(ctx, PodKey(pod), value, 0); err != nil {
+			t.Fatalf("failed to create %s: %v", PodKey(pod), err)
+		}
+	}
+}
+
+// CollectWatch reads keys from a watch until want events have arrived, then waits a
+// short grace period to catch any events that should have been filtered out.
+func CollectWatch(t *testing.T, wr server.WatchResult, want int) []string {
+	t.Helper()
+
+	keys := []string{}
+	timeout := time.After(5 * time.Second)
+	for {
+		grace := time.After(250 * time.Millisecond)
+		if len(keys) < want {
+			grace = nil
+		}
+
+		select {
+		case events, ok := <-wr.Events:
+			if !ok {
+				return keys
+			}
+			for _, event := range events {
+				keys = append(keys, event.KV.Key)
+			}
+		case <-grace:
+			return keys
+		case <-timeout:
+			t.Errorf("timed out waiting for watch events: got %d, want %d", len(keys), want)
+			return keys
+		}
+	}
+}
+
+// ProtobufValue encodes obj the way the apiserver stores it with the protobuf storage
+// media type.
+func ProtobufValue(t *testing.T, apiVersion, kind string, obj interface{ Marshal() ([]byte, error) }) []byte {
+	t.Helper()
+
+	raw, err := obj.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal %s: %v", kind, err)
+	}
+	envelope, err := (&runtime.Unknown{
+		TypeMeta:    runtime.TypeMeta{APIVersion: apiVersion, Kind: kind},
+		Raw:         raw,
+		ContentType: runtime.ContentTypeProtobuf,
+	}).Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal envelope: %v", err)
+	}
+	return append([]byte("k8s\x00"), envelope...)
+}
@@ -3,6 +3,7 @@ package logstructured
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -16,7 +17,7 @@ type Log interface {
 	CurrentRevision(ctx context.Context) (int64, error)
 	List(ctx context.Context, key, end string, limit, revision int64, includeDeletes, keysOnly bool, labelSelector, fieldSelector string) (int64, server.Events, error)
 	Count(ctx context.Context, key, end string, revision int64, labelSelector, fieldSelector string) (int64, int64, error)
-	After(ctx context.Context, key, end string, revision, limit int64) (int64, server.Events, error)
+	After(ctx context.Context, key, end string, revision, limit int64, labelSelector, fieldSelector string) (int64, server.Events, error)
 	Watch(ctx context.Context, key, end string, labelSelector, fieldSelector string) <-chan server.Events
 	Append(ctx context.Context, event *server.Event) (int64, error)
 	DbSize(ctx context.Context) (int64, error)
@@ -233,7 +234,7 @@ func (l *LogStructured) Watch(ctx context.Context, key, end string, revision int
 		revision--
 	}
 
-	rev, kvs, err := l.log.After(ctx, key, end, revision, 0)
+	rev, kvs, err := l.log.After(ctx, key, end, revision, 0, labelSelector, fieldSelector)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
 			logrus.Errorf("Failed to list %s for revision %d: %v", key, revision, err)
@@ -294,3 +295,43 @@ func (l *LogStructured) Compact(ctx context.Context, revision int64) (int64, err
 func (l *LogStructured) WaitForSyncTo(revision int64) {
 	l.log.WaitForSyncTo(revision)
 }
+
+func (l *LogStructured) Reindex(ctx context.Context, prefix string, batchSize int64) error {
+	r, ok := l.log.(server.Reindexer)
+	if !ok {
+		return server.ErrReindexNotSupported
+	}
+	return r.Reindex(ctx, prefix, batchSize)
+}
+
+func (l *LogStructured) ReindexStale(ctx context.Context, batchSize int64) error {
+	r, ok := l.log.(server.Reindexer)
+	if !ok {
+		return server.ErrReindexNotSupported
+	}
+	return r.ReindexStale(ctx, batchSize)
+}
+
+func (l *LogStructured) CollectGarbage(ctx context.Context) error {
+	c, ok := l.log.(server.GarbageCollector)
+	if !ok {
+		return server.ErrGarbageCollectionNotSupported
+	}
+	return c.CollectGarbage(ctx)
+}
+
+func (l *LogStructured) SweepDanglingOwners(ctx context.Context, dryRun bool) (int, error) {
+	c, ok := l.log.(server.GarbageCollector)
+	if !ok {
+		return 0, server.ErrGarbageCollectionNotSupported
+	}
+	return c.SweepDanglingOwners(ctx, dryRun)
+}
+
+func (l *LogStructured) RevisionAt(ctx context.Context, t time.Time) (int64, error) {
+	r, ok := l.log.(server.RevisionResolver)
+	if !ok {
+		return 0, server.ErrRevisionAtNotSupported
+	}
+	return r.RevisionAt(ctx, t)
+}
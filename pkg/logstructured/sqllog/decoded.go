@@ -0,0 +1,85 @@
+package sqllog
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+)
+
+// decodedPageSize is the number of keys read at a time when selectors are matched by
+// decoding values.
+const decodedPageSize = 500
+
+// scanDecoded calls fn with the event of each key from key to end at revision whose
+// value matches the selectors, in key order, until fn returns false. The values are
+// decoded to match them, for dialects that only index the metadata of the latest
+// revision of each key. It returns the current and compact revisions read with the
+// first page, which are zero if there were no keys at all.
+func (s *SQLLog) scanDecoded(ctx context.Context, key, end string, revision int64, includeDeleted bool, labelSelector, fieldSelector string, fn func(*server.Event) bool) (int64, int64, error) {
+	sel, err := util.ParseSelectors(labelSelector, fieldSelector)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rev, compact int64
+	for {
+		rows, err := s.d.List(ctx, s.d.TranslateStartKey(key), end, decodedPageSize, revision, includeDeleted, false, "", "")
+		if err != nil {
+			return 0, 0, err
+		}
+
+		pageRev, pageCompact, events, err := RowsToEvents(rows, true, false)
+		if err != nil {
+			return 0, 0, err
+		}
+		if rev == 0 {
+			rev, compact = pageRev, pageCompact
+		}
+
+		for _, event := range events {
+			// deletions have no metadata, so they never match selectors
+			if event.Delete || !sel.Matches(util.DecodeMetadata(event.KV.Key, event.KV.Value)) {
+				continue
+			}
+			if !fn(event) {
+				return rev, compact, nil
+			}
+		}
+
+		if end == "" || len(events) < decodedPageSize {
+			return rev, compact, nil
+		}
+		key = events[len(events)-1].KV.Key + "\x00"
+	}
+}
+
+// countDecoded counts the keys from key to end at revision whose value matches the
+// selectors, decoding the values to match them.
+func (s *SQLLog) countDecoded(ctx context.Context, key, end string, revision int64, labelSelector, fieldSelector string) (int64, int64, error) {
+	var count int64
+	rev, compact, err := s.scanDecoded(ctx, key, end, revision, false, labelSelector, fieldSelector, func(*server.Event) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if rev == 0 {
+		if rev, err = s.CurrentRevision(ctx); err != nil {
+			return 0, 0, err
+		}
+		if compact, err = s.d.GetCompactRevision(ctx); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if revision > rev {
+		return rev, 0, server.ErrFutureRev
+	}
+	if revision < compact {
+		return rev, 0, server.ErrCompacted
+	}
+	return rev, count, nil
+}
@@ -5,7 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"maps"
 	"math/rand/v2"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +16,7 @@ import (
 	"github.com/k3s-io/kine/pkg/broadcaster"
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,6 +27,7 @@ type SQLLog struct {
 
 	d                     server.Dialect
 	broadcaster           broadcaster.Broadcaster
+	watchers              watchers
 	ctx                   context.Context
 	notify                chan int64
 	currentRev            atomic.Int64
@@ -32,11 +37,13 @@ type SQLLog struct {
 	compactIntervalJitter int
 	compactTimeout        time.Duration
 	compactMinRetain      int64
+	compactRetainDuration time.Duration
+	compactRetainPrefixes map[string]time.Duration
 	compactBatchSize      int64
 	pollBatchSize         int64
 }
 
-func New(d server.Dialect, compactInterval time.Duration, compactIntervalJitter int, compactTimeout time.Duration, compactMinRetain int64, compactBatchSize int64, pollBatchSize int64) *SQLLog {
+func New(d server.Dialect, compactInterval time.Duration, compactIntervalJitter int, compactTimeout time.Duration, compactMinRetain int64, compactRetainDuration time.Duration, compactRetainPrefixes map[string]time.Duration, compactBatchSize int64, pollBatchSize int64) *SQLLog {
 	l := &SQLLog{
 		d:                     d,
 		notify:                make(chan int64, 1024),
@@ -44,6 +51,8 @@ func New(d server.Dialect, compactInterval time.Duration, compactIntervalJitter
 		compactIntervalJitter: compactIntervalJitter,
 		compactTimeout:        compactTimeout,
 		compactMinRetain:      compactMinRetain,
+		compactRetainDuration: compactRetainDuration,
+		compactRetainPrefixes: compactRetainPrefixes,
 		compactBatchSize:      compactBatchSize,
 		pollBatchSize:         pollBatchSize,
 	}
@@ -63,7 +72,7 @@ func (s *SQLLog) Start(ctx context.Context) error {
 func (s *SQLLog) compactStart(ctx context.Context) error {
 	logrus.Tracef("COMPACTSTART")
 
-	rows, err := s.d.After(ctx, "compact_rev_key", "", 0, 0)
+	rows, err := s.d.After(ctx, "compact_rev_key", "", 0, 0, "", "")
 	if err != nil {
 		return err
 	}
@@ -124,6 +133,9 @@ func (s *SQLLog) compactStart(ctx context.Context) error {
 // Any API call for the older versions of keys will return error.
 // Interval is the time interval between each compaction. The first compaction happens after "interval".
 // This logic is directly cribbed from k8s.io/apiserver/pkg/storage/etcd3/compact.go
+//
+// With a retain duration, each compaction instead compacts the revisions committed
+// more than that duration ago, whatever the interval.
 func (s *SQLLog) compactor(interval time.Duration) {
 	t := time.NewTicker(interval)
 	defer t.Stop()
@@ -136,10 +148,106 @@ func (s *SQLLog) compactor(interval time.Duration) {
 			return
 		case <-t.C:
 		}
+		if s.compactRetainDuration > 0 {
+			retainedRev, err := s.RevisionAt(s.ctx, time.Now().Add(-s.compactRetainDuration))
+			if err != nil {
+				logrus.Errorf("Failed to get the revision committed %s ago: %v", s.compactRetainDuration, err)
+				continue
+			}
+			targetCompactRev = retainedRev
+		}
 		compactRev, targetCompactRev = s.compactIter(compactRev, targetCompactRev)
+		if len(s.compactRetainPrefixes) > 0 {
+			s.compactPrefixes()
+		}
+	}
+}
+
+// compactPrefixes compacts the keys under each prefix with a retain duration of its
+// own to the last revision committed before it. The prefixes never keep more history
+// than the other keys, as the revisions compacted for every key are gone for them too,
+// and are not held to the compactMinRetain revisions the other keys keep, as their
+// retain duration is what bounds their history.
+func (s *SQLLog) compactPrefixes() {
+	c, ok := s.d.(server.PrefixCompactor)
+	if !ok {
+		logrus.Errorf("Compact prefixes failed: dialect does not compact key prefixes")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.compactTimeout)
+	defer cancel()
+
+	compactRev, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		logrus.Errorf("Compact prefixes failed to get compact revision: %v", err)
+		return
+	}
+	currentRev, err := s.CurrentRevision(ctx)
+	if err != nil {
+		logrus.Errorf("Compact prefixes failed to get current revision: %v", err)
+		return
+	}
+
+	for _, prefix := range slices.Sorted(maps.Keys(s.compactRetainPrefixes)) {
+		retain := s.compactRetainPrefixes[prefix]
+		targetCompactRev, err := s.RevisionAt(ctx, time.Now().Add(-retain))
+		if err != nil {
+			logrus.Errorf("Compact %s failed to get the revision committed %s ago: %v", prefix, retain, err)
+			continue
+		}
+		// Revisions are not compacted before they are polled, so that no watch
+		// misses them, however short the retain duration.
+		targetCompactRev = min(targetCompactRev, s.polledRev.Load())
+		if targetCompactRev <= compactRev {
+			continue
+		}
+
+		start := time.Now()
+		deletedRows, err := c.CompactPrefix(ctx, prefix, targetCompactRev)
+		if err != nil {
+			if err != server.ErrCompacted {
+				logrus.Errorf("Compact %s failed: %v", prefix, err)
+			}
+			continue
+		}
+		logrus.Infof("COMPACT deleted %d rows under %s in %s - compacted to %d/%d", deletedRows, prefix, time.Since(start), targetCompactRev, currentRev)
 	}
 }
 
+// rangeCompactRevision returns the revision that the keys from key to end were
+// compacted to: compact, or the revision that the keys under a prefix among them were
+// compacted to past it.
+func (s *SQLLog) rangeCompactRevision(ctx context.Context, key, end string, compact int64) (int64, error) {
+	c, ok := s.d.(server.PrefixCompactor)
+	if !ok {
+		return compact, nil
+	}
+
+	revisions, err := c.PrefixCompactRevisions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for prefix, revision := range revisions {
+		if revision > compact && overlapsPrefix(key, end, prefix) {
+			compact = revision
+		}
+	}
+	return compact, nil
+}
+
+// overlapsPrefix reports whether the keys from key to end include keys starting with
+// prefix. An empty end is the single key, and an end of "\x00" every key from key on.
+func overlapsPrefix(key, end, prefix string) bool {
+	if end == "" {
+		return strings.HasPrefix(key, prefix)
+	}
+	if limit := prefixEnd(prefix); limit != "\x00" && key >= limit {
+		return false
+	}
+	return end == "\x00" || prefix < end
+}
+
 func (s *SQLLog) compactIter(compactRev, targetCompactRev int64) (int64, int64) {
 	logrus.Tracef("COMPACT running compactRev=%d targetCompactRev=%d", compactRev, targetCompactRev)
 	// Break up the compaction into smaller batches to avoid locking the database with excessively
@@ -311,13 +419,31 @@ func (s *SQLLog) CompactRevision(ctx context.Context) (int64, error) {
 	return s.d.GetCompactRevision(ctx)
 }
 
-func (s *SQLLog) After(ctx context.Context, key, end string, revision, limit int64) (int64, server.Events, error) {
-	rows, err := s.d.After(ctx, key, end, revision, limit)
+// After returns the events after revision of the keys from key to end that match the
+// selectors, as they are filtered for a watch. The selectors are matched by the dialect
+// if it indexes the metadata of every revision, and by decoding values otherwise.
+func (s *SQLLog) After(ctx context.Context, key, end string, revision, limit int64, labelSelector, fieldSelector string) (int64, server.Events, error) {
+	decoded := (labelSelector != "" || fieldSelector != "") && !s.d.IndexesRevisionMetadata()
+
+	var rows *sql.Rows
+	var err error
+	if decoded {
+		rows, err = s.d.After(ctx, key, end, revision, limit, "", "")
+	} else {
+		rows, err = s.d.After(ctx, key, end, revision, limit, labelSelector, fieldSelector)
+	}
 	if err != nil {
 		return 0, nil, err
 	}
 
 	rev, compact, result, err := RowsToEvents(rows, true, true)
+	if err == nil && decoded {
+		var sel *util.Selectors
+		if sel, err = util.ParseSelectors(labelSelector, fieldSelector); err != nil {
+			return 0, nil, err
+		}
+		result, _ = filter(result, key, end, sel)
+	}
 
 	if revision > 0 && len(result) == 0 {
 		// a zero length result won't have the compact or current revisions so get them manually
@@ -331,6 +457,14 @@ func (s *SQLLog) After(ctx context.Context, key, end string, revision, limit int
 		}
 	}
 
+	if revision > 0 && revision >= compact {
+		rangeCompact, cerr := s.rangeCompactRevision(ctx, key, end, compact)
+		if cerr != nil {
+			return 0, nil, cerr
+		}
+		compact = rangeCompact
+	}
+
 	if revision > 0 && revision < compact {
 		return rev, nil, server.ErrCompacted
 	}
@@ -344,20 +478,38 @@ func (s *SQLLog) List(ctx context.Context, key, end string, limit, revision int6
 		err  error
 	)
 
-	key = s.d.TranslateStartKey(key)
+	var (
+		rev, compact int64
+		result       server.Events
+	)
 
-	if revision == 0 {
-		rows, err = s.d.ListCurrent(ctx, key, end, limit, includeDeleted, keysOnly, labelSelector, fieldSelector)
+	if revision > 0 && (labelSelector != "" || fieldSelector != "") && !s.d.IndexesRevisionMetadata() {
+		rev, compact, err = s.scanDecoded(ctx, key, end, revision, includeDeleted, labelSelector, fieldSelector, func(event *server.Event) bool {
+			if keysOnly {
+				event.KV.Value = nil
+			}
+			result = append(result, event)
+			return limit <= 0 || int64(len(result)) < limit
+		})
+		if err != nil {
+			return 0, nil, err
+		}
 	} else {
-		rows, err = s.d.List(ctx, key, end, limit, revision, includeDeleted, keysOnly, labelSelector, fieldSelector)
-	}
-	if err != nil {
-		return 0, nil, err
-	}
+		key = s.d.TranslateStartKey(key)
 
-	rev, compact, result, err := RowsToEvents(rows, !keysOnly, false)
-	if err != nil {
-		return 0, nil, err
+		if revision == 0 {
+			rows, err = s.d.ListCurrent(ctx, key, end, limit, includeDeleted, keysOnly, labelSelector, fieldSelector)
+		} else {
+			rows, err = s.d.List(ctx, key, end, limit, revision, includeDeleted, keysOnly, labelSelector, fieldSelector)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		rev, compact, result, err = RowsToEvents(rows, !keysOnly, false)
+		if err != nil {
+			return 0, nil, err
+		}
 	}
 
 	if len(result) == 0 {
@@ -376,6 +528,14 @@ func (s *SQLLog) List(ctx context.Context, key, end string, limit, revision int6
 		return rev, nil, server.ErrFutureRev
 	}
 
+	if revision > 0 && revision >= compact {
+		rangeCompact, cerr := s.rangeCompactRevision(ctx, key, end, compact)
+		if cerr != nil {
+			return 0, nil, cerr
+		}
+		compact = rangeCompact
+	}
+
 	if revision > 0 && revision < compact {
 		return rev, nil, server.ErrCompacted
 	}
@@ -412,39 +572,47 @@ func RowsToEvents(rows *sql.Rows, val, prev bool) (int64, int64, server.Events,
 
 func (s *SQLLog) Watch(ctx context.Context, key, end string, labelSelector, fieldSelector string) <-chan server.Events {
 	res := make(chan server.Events, 100)
-	values, err := s.broadcaster.Subscribe(ctx, s.startWatch)
+	sel, err := util.ParseSelectors(labelSelector, fieldSelector)
+	if err != nil {
+		logrus.Debugf("Watching %s without invalid selectors %q %q: %v", key, labelSelector, fieldSelector, err)
+	}
+	values, err := s.watchers.subscribe(ctx, key, end, sel, func() (<-chan server.Events, error) {
+		return s.broadcaster.Subscribe(s.ctx, s.startWatch)
+	})
 	if err != nil {
 		return nil
 	}
 
 	go func() {
 		defer close(res)
-		for i := range values {
-			events, ok := filter(i, key, end, labelSelector, fieldSelector)
-			if ok {
-				res <- events
-			}
+		for events := range values {
+			res <- events
 		}
 	}()
 
 	return res
 }
 
-func filter(eventList server.Events, key, end string, labelSelector, fieldSelector string) (server.Events, bool) {
+func filter(eventList server.Events, key, end string, sel *util.Selectors) (server.Events, bool) {
 	filteredEventList := make(server.Events, 0, len(eventList))
 	for _, event := range eventList {
-		if key == "" || (end != "" && event.KV.Key >= key && event.KV.Key < end) || event.KV.Key == key {
-			if filterEventBySelectors(event.KV, labelSelector, fieldSelector) {
-				filteredEventList = append(filteredEventList, event)
-			} else if event.PrevKV != nil && filterEventBySelectors(event.PrevKV, labelSelector, fieldSelector) {
-				filteredEventList = append(filteredEventList, event)
-			}
+		if matches(event, key, end, sel) {
+			filteredEventList = append(filteredEventList, event)
 		}
 	}
 
 	return filteredEventList, len(filteredEventList) > 0
 }
 
+// matches reports whether event is sent to a watch on the keys from key to end with
+// sel: its key must be in the range, and it or the revision it replaces must match sel.
+func matches(event *server.Event, key, end string, sel *util.Selectors) bool {
+	if key != "" && (end == "" || event.KV.Key < key || event.KV.Key >= end) && event.KV.Key != key {
+		return false
+	}
+	return matchesSelectors(event.KV, sel) || (event.PrevKV != nil && matchesSelectors(event.PrevKV, sel))
+}
+
 func (s *SQLLog) startWatch() (chan server.Events, error) {
 	pollStart, err := s.d.CurrentRevision(s.ctx)
 	if err != nil {
@@ -503,7 +671,7 @@ func (s *SQLLog) poll(result chan server.Events, pollStart int64) {
 		s.polled.Broadcast()
 		s.Unlock()
 
-		rows, err := s.d.After(s.ctx, "", "", pollRevision, s.pollBatchSize)
+		rows, err := s.d.After(s.ctx, "", "", pollRevision, s.pollBatchSize, "", "")
 		if err != nil {
 			if !errors.Is(err, context.Canceled) {
 				logrus.Errorf("Failed to list latest changes: %v", err)
@@ -519,6 +687,15 @@ func (s *SQLLog) poll(result chan server.Events, pollStart int64) {
 
 		logrus.Tracef("POLL AFTER %d, limit=%d, events=%d", pollRevision, s.pollBatchSize, len(events))
 
+		// the events are shared by every watcher, which match selectors against the
+		// same decoded metadata
+		for _, event := range events {
+			event.KV.MemoizeMetadata()
+			if event.PrevKV != nil {
+				event.PrevKV.MemoizeMetadata()
+			}
+		}
+
 		if len(events) == 0 {
 			continue
 		}
@@ -601,6 +778,10 @@ func canSkipRevision(rev, skip int64, skipTime time.Time) bool {
 }
 
 func (s *SQLLog) Count(ctx context.Context, key, end string, revision int64, labelSelector, fieldSelector string) (int64, int64, error) {
+	if revision > 0 && (labelSelector != "" || fieldSelector != "") && !s.d.IndexesRevisionMetadata() {
+		return s.countDecoded(ctx, key, end, revision, labelSelector, fieldSelector)
+	}
+
 	key = s.d.TranslateStartKey(key)
 
 	if revision == 0 {
@@ -614,6 +795,13 @@ func (s *SQLLog) Count(ctx context.Context, key, end string, revision int64, lab
 	if revision > rev {
 		return rev, 0, server.ErrFutureRev
 	}
+	if revision >= compact {
+		rangeCompact, cerr := s.rangeCompactRevision(ctx, key, end, compact)
+		if cerr != nil {
+			return 0, 0, cerr
+		}
+		compact = rangeCompact
+	}
 	if revision < compact {
 		return rev, 0, server.ErrCompacted
 	}
@@ -738,3 +926,43 @@ func (s *SQLLog) WaitForSyncTo(revision int64) {
 	}
 	s.polled.L.Unlock()
 }
+
+func (s *SQLLog) Reindex(ctx context.Context, prefix string, batchSize int64) error {
+	r, ok := s.d.(server.Reindexer)
+	if !ok {
+		return server.ErrReindexNotSupported
+	}
+	return r.Reindex(ctx, prefix, batchSize)
+}
+
+func (s *SQLLog) ReindexStale(ctx context.Context, batchSize int64) error {
+	r, ok := s.d.(server.Reindexer)
+	if !ok {
+		return server.ErrReindexNotSupported
+	}
+	return r.ReindexStale(ctx, batchSize)
+}
+
+func (s *SQLLog) CollectGarbage(ctx context.Context) error {
+	c, ok := s.d.(server.GarbageCollector)
+	if !ok {
+		return server.ErrGarbageCollectionNotSupported
+	}
+	return c.CollectGarbage(ctx)
+}
+
+func (s *SQLLog) SweepDanglingOwners(ctx context.Context, dryRun bool) (int, error) {
+	c, ok := s.d.(server.GarbageCollector)
+	if !ok {
+		return 0, server.ErrGarbageCollectionNotSupported
+	}
+	return c.SweepDanglingOwners(ctx, dryRun)
+}
+
+func (s *SQLLog) RevisionAt(ctx context.Context, t time.Time) (int64, error) {
+	r, ok := s.d.(server.RevisionResolver)
+	if !ok {
+		return 0, server.ErrRevisionAtNotSupported
+	}
+	return r.RevisionAt(ctx, t)
+}
@@ -0,0 +1,139 @@
+package sqllog_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/internal/testutil"
+	"github.com/k3s-io/kine/pkg/server"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestWatchReplayMatchesSelectors(t *testing.T) {
+	ctx, backend, dialect := testutil.NewDialect(t)
+
+	startRev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("failed to get current revision: %v", err)
+	}
+
+	revs := map[int64]string{}
+	write := func(op string, pod *corev1.Pod, revision int64) int64 {
+		t.Helper()
+		value, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatalf("failed to marshal pod: %v", err)
+		}
+		var rev int64
+		switch op {
+		case "create":
+			rev, err = backend.Create(ctx, testutil.PodKey(pod), value, 0)
+		case "update":
+			rev, _, _, err = backend.Update(ctx, testutil.PodKey(pod), value, revision, 0)
+		case "delete":
+			rev, _, _, err = backend.Delete(ctx, testutil.PodKey(pod), revision)
+		}
+		if err != nil {
+			t.Fatalf("failed to %s %s: %v", op, testutil.PodKey(pod), err)
+		}
+		revs[rev] = fmt.Sprintf("%s %s", op, pod.Name)
+		return rev
+	}
+
+	a, b, c := testutil.NewPod("default", "a", "node1"), testutil.NewPod("default", "b", "node2"), testutil.NewPod("default", "c", "node2")
+	a.Labels = map[string]string{"app": "web"}
+	b.Labels = map[string]string{"app": "db"}
+	c.Labels = map[string]string{"app": "db"}
+
+	aRev := write("create", a, 0)
+	bRev := write("create", b, 0)
+	b.Spec.NodeName, b.Labels["app"] = "node1", "web"
+	bRev = write("update", b, bRev)
+	a.Spec.NodeName, a.Labels["app"] = "node3", "db"
+	aRev = write("update", a, aRev)
+	a.Spec.NodeName = "node4"
+	write("update", a, aRev)
+	write("delete", b, bRev)
+	cRev := write("create", c, 0)
+	write("delete", c, cRev)
+
+	// an event is sent if the revision or the one it replaces matches, and a
+	// deletion is matched by the revision it deletes
+	want := []string{"create a", "update b", "update a", "delete b"}
+
+	for _, indexFieldValues := range []bool{true, false} {
+		dialect.IndexFieldValues = indexFieldValues
+		for _, selectors := range [][2]string{
+			{"", "spec.nodeName=node1"},
+			{"app=web", ""},
+			{"app=web", "spec.nodeName=node1"},
+		} {
+			watchCtx, cancel := context.WithCancel(ctx)
+			wr := backend.Watch(watchCtx, testutil.PodsPrefix, testutil.PodsEnd, startRev+1, selectors[0], selectors[1])
+
+			got := []string{}
+			select {
+			case events := <-wr.Events:
+				for _, event := range events {
+					got = append(got, revs[event.KV.ModRevision])
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("timed out waiting for the replay of %q %q", selectors[0], selectors[1])
+			}
+			cancel()
+
+			if !slices.Equal(want, got) {
+				t.Errorf("replay of %q %q with indexFieldValues=%v: expected %v, got %v", selectors[0], selectors[1], indexFieldValues, want, got)
+			}
+		}
+	}
+}
+
+func TestWatchersShareDecodedMetadata(t *testing.T) {
+	ctx, backend := testutil.NewBackend(t)
+
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("failed to get current revision: %v", err)
+	}
+
+	watches := map[string]server.WatchResult{}
+	for _, selector := range []string{"spec.nodeName=node1", "spec.nodeName!=node2", "metadata.namespace=default"} {
+		watches[selector] = backend.Watch(ctx, testutil.PodsPrefix, testutil.PodsEnd, rev+1, "", selector)
+	}
+
+	testutil.CreatePods(ctx, t, backend, []*corev1.Pod{
+		testutil.NewPod("default", "a", "node1"),
+		testutil.NewPod("default", "b", "node2"),
+		testutil.NewPod("default", "c", "node1"),
+	})
+
+	kvs := map[string][]*server.KeyValue{}
+	for selector, wr := range watches {
+		timeout := time.After(5 * time.Second)
+		for len(kvs[selector]) < 2 {
+			select {
+			case events := <-wr.Events:
+				for _, event := range events {
+					kvs[selector] = append(kvs[selector], event.KV)
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for the events of %q", selector)
+			}
+		}
+	}
+
+	first := kvs["spec.nodeName=node1"][0]
+	for selector, kvs := range kvs {
+		if kvs[0] != first {
+			t.Errorf("watch of %q was sent another event for %s", selector, kvs[0].Key)
+		}
+	}
+	if md := first.Metadata(); md == nil || md != first.Metadata() {
+		t.Errorf("expected the metadata of %s to be decoded once, got %v then %v", first.Key, md, first.Metadata())
+	}
+}
@@ -0,0 +1,318 @@
+package sqllog
+
+import (
+	"context"
+	"sync"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// watcher is a watch registered with watchers.
+type watcher struct {
+	key, end string
+	sel      *util.Selectors
+	c        chan server.Events
+	group    *watcherGroup
+	// index and values are the equality requirement the watch is indexed by, if any
+	index   requirement
+	values  []string
+	pending server.Events
+	last    int
+}
+
+// requirement names a label, or a field, that watches are indexed by.
+type requirement struct {
+	field bool
+	name  string
+}
+
+// watcherGroup holds the watches on the same keys. The watches with an equality
+// requirement on a label or field are indexed by its values, so that an event is only
+// offered to those it can match; the others are offered every event.
+type watcherGroup struct {
+	all       map[*watcher]struct{}
+	unindexed map[*watcher]struct{}
+	indexed   map[requirement]map[string]map[*watcher]struct{}
+}
+
+// watchers dispatches the polled events to the watches that match them. Watches on a
+// single key or on a key prefix are grouped by that key; watches on any other range
+// are grouped together.
+type watchers struct {
+	sync.Mutex
+	running  bool
+	keys     map[string]*watcherGroup
+	prefixes map[string]*watcherGroup
+	ranges   *watcherGroup
+}
+
+// subscribe registers a watch on the keys from key to end matching sel, and returns
+// the channel its events are sent to, closed once ctx is done or the watch falls too
+// far behind. connect is called to subscribe to the polled events if no watch is
+// registered yet.
+func (w *watchers) subscribe(ctx context.Context, key, end string, sel *util.Selectors, connect func() (<-chan server.Events, error)) (<-chan server.Events, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if !w.running {
+		values, err := connect()
+		if err != nil {
+			return nil, err
+		}
+		w.keys = map[string]*watcherGroup{}
+		w.prefixes = map[string]*watcherGroup{}
+		w.ranges = newWatcherGroup()
+		w.running = true
+		go w.dispatch(values)
+	}
+
+	wt := &watcher{key: key, end: end, sel: sel, c: make(chan server.Events, 100), last: -1}
+	wt.index, wt.values = indexRequirement(sel)
+
+	switch {
+	case key == "":
+		wt.group = w.ranges
+	case end == "":
+		wt.group = groupFor(w.keys, key)
+	case end == prefixEnd(key):
+		wt.group = groupFor(w.prefixes, key)
+	default:
+		wt.group = w.ranges
+	}
+	wt.group.add(wt)
+
+	go func() {
+		<-ctx.Done()
+		w.Lock()
+		defer w.Unlock()
+		w.remove(wt)
+	}()
+
+	return wt.c, nil
+}
+
+// remove unregisters wt and closes its channel, if it is still registered.
+func (w *watchers) remove(wt *watcher) {
+	if _, ok := wt.group.all[wt]; !ok {
+		return
+	}
+	wt.group.remove(wt)
+	close(wt.c)
+
+	if len(wt.group.all) == 0 {
+		if w.keys[wt.key] == wt.group {
+			delete(w.keys, wt.key)
+		}
+		if w.prefixes[wt.key] == wt.group {
+			delete(w.prefixes, wt.key)
+		}
+	}
+}
+
+// dispatch sends each batch of values to the watches that match some of its events,
+// until values is closed. Watches too slow to take a batch are dropped.
+func (w *watchers) dispatch(values <-chan server.Events) {
+	for events := range values {
+		w.Lock()
+		matched := []*watcher{}
+		for i, event := range events {
+			w.candidates(event, func(wt *watcher) {
+				if wt.last == i || !matches(event, wt.key, wt.end, wt.sel) {
+					return
+				}
+				if wt.pending == nil {
+					matched = append(matched, wt)
+				}
+				wt.pending = append(wt.pending, event)
+				wt.last = i
+			})
+		}
+
+		for _, wt := range matched {
+			select {
+			case wt.c <- wt.pending:
+			default:
+				// Slow consumer, drop
+				w.remove(wt)
+			}
+			wt.pending, wt.last = nil, -1
+		}
+		w.Unlock()
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	for _, groups := range []map[string]*watcherGroup{w.keys, w.prefixes} {
+		for _, group := range groups {
+			for wt := range group.all {
+				w.remove(wt)
+			}
+		}
+	}
+	for wt := range w.ranges.all {
+		w.remove(wt)
+	}
+	w.running = false
+}
+
+// candidates calls fn with the watches that event may match, some more than once.
+func (w *watchers) candidates(event *server.Event, fn func(*watcher)) {
+	key := event.KV.Key
+	if group, ok := w.keys[key]; ok {
+		group.candidates(event, fn)
+	}
+	for i := 1; i <= len(key); i++ {
+		if group, ok := w.prefixes[key[:i]]; ok {
+			group.candidates(event, fn)
+		}
+	}
+	w.ranges.candidates(event, fn)
+}
+
+func newWatcherGroup() *watcherGroup {
+	return &watcherGroup{
+		all:       map[*watcher]struct{}{},
+		unindexed: map[*watcher]struct{}{},
+		indexed:   map[requirement]map[string]map[*watcher]struct{}{},
+	}
+}
+
+// groupFor returns the group of key in groups, adding it if there is none.
+func groupFor(groups map[string]*watcherGroup, key string) *watcherGroup {
+	group, ok := groups[key]
+	if !ok {
+		group = newWatcherGroup()
+		groups[key] = group
+	}
+	return group
+}
+
+func (g *watcherGroup) add(wt *watcher) {
+	g.all[wt] = struct{}{}
+	if len(wt.values) == 0 {
+		g.unindexed[wt] = struct{}{}
+		return
+	}
+
+	byValue, ok := g.indexed[wt.index]
+	if !ok {
+		byValue = map[string]map[*watcher]struct{}{}
+		g.indexed[wt.index] = byValue
+	}
+	for _, value := range wt.values {
+		if byValue[value] == nil {
+			byValue[value] = map[*watcher]struct{}{}
+		}
+		byValue[value][wt] = struct{}{}
+	}
+}
+
+func (g *watcherGroup) remove(wt *watcher) {
+	delete(g.all, wt)
+	if len(wt.values) == 0 {
+		delete(g.unindexed, wt)
+		return
+	}
+
+	byValue := g.indexed[wt.index]
+	for _, value := range wt.values {
+		delete(byValue[value], wt)
+		if len(byValue[value]) == 0 {
+			delete(byValue, value)
+		}
+	}
+	if len(byValue) == 0 {
+		delete(g.indexed, wt.index)
+	}
+}
+
+// candidates calls fn with the watches of g that event may match. The indexed watches
+// are looked up by the metadata of the event and of the revision it replaces; all of
+// them are candidates if either is not a Kubernetes object, as such values match any
+// selector.
+func (g *watcherGroup) candidates(event *server.Event, fn func(*watcher)) {
+	if len(g.indexed) == 0 {
+		for wt := range g.unindexed {
+			fn(wt)
+		}
+		return
+	}
+
+	mds := []*util.Metadata{event.KV.Metadata()}
+	if event.PrevKV != nil {
+		mds = append(mds, event.PrevKV.Metadata())
+	}
+	for _, md := range mds {
+		if md == nil {
+			for wt := range g.all {
+				fn(wt)
+			}
+			return
+		}
+	}
+
+	for wt := range g.unindexed {
+		fn(wt)
+	}
+
+	for index, byValue := range g.indexed {
+		for _, md := range mds {
+			var value string
+			if index.field {
+				value = md.Fields[index.name]
+			} else if v, ok := md.Labels[index.name]; ok {
+				value = v
+			} else {
+				continue
+			}
+			for wt := range byValue[value] {
+				fn(wt)
+			}
+		}
+	}
+}
+
+// indexRequirement returns a requirement of sel that every object it matches has one
+// of the returned values for, or no values if sel has none. Missing fields have the
+// empty value, the same way fields.Set.Get reports them.
+func indexRequirement(sel *util.Selectors) (requirement, []string) {
+	if sel.Empty() {
+		return requirement{}, nil
+	}
+
+	if sel.Labels != nil {
+		reqs, _ := sel.Labels.Requirements()
+		for _, req := range reqs {
+			switch req.Operator() {
+			case selection.Equals, selection.DoubleEquals, selection.In:
+				return requirement{name: req.Key()}, req.Values().List()
+			}
+		}
+	}
+
+	if sel.Fields != nil {
+		for _, req := range sel.Fields.Requirements() {
+			switch req.Operator {
+			case selection.Equals, selection.DoubleEquals:
+				return requirement{field: true, name: req.Field}, []string{req.Value}
+			}
+		}
+	}
+
+	return requirement{}, nil
+}
+
+// prefixEnd returns the end of the range of keys starting with key, the way etcd
+// clients compute it for prefix watches.
+func prefixEnd(key string) string {
+	end := []byte(key)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
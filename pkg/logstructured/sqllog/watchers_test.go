@@ -0,0 +1,120 @@
+package sqllog_test
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/internal/testutil"
+	"github.com/k3s-io/kine/pkg/server"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestWatchesAreOfferedMatchingEvents(t *testing.T) {
+	ctx, backend := testutil.NewBackend(t)
+
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("failed to get current revision: %v", err)
+	}
+
+	type watch struct {
+		key, end, labelSelector, fieldSelector string
+	}
+	watches := []watch{
+		{testutil.PodsPrefix, testutil.PodsEnd, "app=a", ""},
+		{testutil.PodsPrefix, testutil.PodsEnd, "app==b", ""},
+		{testutil.PodsPrefix, testutil.PodsEnd, "app in (a,c)", ""},
+		{testutil.PodsPrefix, testutil.PodsEnd, "app!=a", ""},
+		{testutil.PodsPrefix, testutil.PodsEnd, "app", "spec.nodeName=node1"},
+		{testutil.PodsPrefix, testutil.PodsEnd, "", "spec.nodeName="},
+		{testutil.PodsPrefix, testutil.PodsEnd, "", ""},
+		{testutil.PodsPrefix + "default/", testutil.PodsPrefix + "default0", "app=a", ""},
+		{testutil.PodsPrefix + "default/b", testutil.PodsPrefix + "default/d", "app=c", ""},
+		{testutil.PodsPrefix + "default/a", "", "app=b", ""},
+		{"", "", "app=a", ""},
+	}
+	results := make([]server.WatchResult, len(watches))
+	for i, w := range watches {
+		results[i] = backend.Watch(ctx, w.key, w.end, rev+1, w.labelSelector, w.fieldSelector)
+	}
+
+	// each write is recorded with the pod it replaces, to work out the watches it is sent to
+	type write struct {
+		key       string
+		pod, prev *corev1.Pod
+	}
+	writes := []write{}
+	put := func(pod *corev1.Pod, app string) {
+		t.Helper()
+		var prev *corev1.Pod
+		for _, w := range slices.Backward(writes) {
+			if w.key == testutil.PodKey(pod) {
+				prev = w.pod
+				break
+			}
+		}
+		pod = pod.DeepCopy()
+		pod.Labels = map[string]string{"app": app}
+		value, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatalf("failed to marshal pod: %v", err)
+		}
+		if prev == nil {
+			_, err = backend.Create(ctx, testutil.PodKey(pod), value, 0)
+		} else {
+			var kv *server.KeyValue
+			if _, kv, err = backend.Get(ctx, testutil.PodKey(pod), 0, true); err == nil {
+				_, _, _, err = backend.Update(ctx, testutil.PodKey(pod), value, kv.ModRevision, 0)
+			}
+		}
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", testutil.PodKey(pod), err)
+		}
+		writes = append(writes, write{key: testutil.PodKey(pod), pod: pod, prev: prev})
+	}
+
+	a, b, c := testutil.NewPod("default", "a", "node1"), testutil.NewPod("default", "b", "node2"), testutil.NewPod("other", "c", "")
+	put(a, "a")
+	put(b, "b")
+	put(c, "c")
+	put(a, "b")
+	put(b, "c")
+	put(c, "a")
+	put(a, "d")
+
+	matches := func(w watch, pod *corev1.Pod) bool {
+		if pod == nil {
+			return false
+		}
+		ls, err := labels.Parse(w.labelSelector)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", w.labelSelector, err)
+		}
+		fs, err := fields.ParseSelector(w.fieldSelector)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", w.fieldSelector, err)
+		}
+		return ls.Matches(labels.Set(pod.Labels)) && fs.Matches(fields.Set{"spec.nodeName": pod.Spec.NodeName})
+	}
+	for i, w := range watches {
+		want := []string{}
+		for _, wr := range writes {
+			inRange := w.key == "" || wr.key == w.key || (w.end != "" && wr.key >= w.key && wr.key < w.end)
+			if inRange && (matches(w, wr.pod) || matches(w, wr.prev)) {
+				want = append(want, wr.key)
+			}
+		}
+
+		got := testutil.CollectWatch(t, results[i], len(want))
+		if w.key == "" {
+			got = slices.DeleteFunc(got, func(key string) bool { return !strings.HasPrefix(key, testutil.PodsPrefix) })
+		}
+		if !slices.Equal(want, got) {
+			t.Errorf("watch %+v: expected %v, got %v", w, want, got)
+		}
+	}
+}
@@ -37,6 +37,39 @@ var (
 		Name: "kine_insert_errors_total",
 		Help: "Total number of insert retries due to unique constraint violations",
 	}, []string{"retriable"})
+
+	ReindexKeysTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_reindex_keys_total",
+		Help: "Total number of keys whose metadata was rebuilt by reindexing",
+	}, []string{"result"})
+
+	ReindexRemainingKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kine_reindex_remaining_keys",
+		Help: "Number of keys left to reindex, by key prefix",
+	}, []string{"prefix"})
+
+	GCQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_gc_queue_depth",
+		Help: "Number of owners queued for the garbage collection of their dependents",
+	})
+
+	GCTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_gc_total",
+		Help: "Total number of queued owners whose dependents were garbage collected",
+	}, []string{"result"})
+
+	GCDanglingOwners = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_gc_dangling_owners",
+		Help: "Number of missing owners still referenced by objects, as found by the last sweep",
+	})
+
+	GCLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "kine_gc_latency_seconds",
+		Help: "Length of time from queueing an owner to the garbage collection of its dependents",
+		// lowest bucket start of upper bound 0.01 sec (10 ms) with factor 2
+		// highest bucket start of 0.01 sec * 2^15 == 327.68 sec
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+	})
 )
 
 var (
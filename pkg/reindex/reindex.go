@@ -0,0 +1,34 @@
+// Package reindex keeps the labels, fields and owners indexed by a server.Reindexer
+// in step with the way they are extracted.
+//
+// The metadata of a stored value is extracted once, when it is written. Upgrading kine,
+// configuring extra fields or adding selectable fields to a CRD changes what would be
+// extracted from values that are already stored; Run rebuilds their metadata in the
+// background, so that selectors match them without waiting for them to be written
+// again.
+package reindex
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// Run reindexes the stale key prefixes of r every interval, in batches of batchSize
+// keys, until ctx is done.
+func Run(ctx context.Context, r server.Reindexer, interval time.Duration, batchSize int64) {
+	for {
+		if err := r.ReindexStale(ctx, batchSize); err != nil && !errors.Is(err, context.Canceled) {
+			logrus.Errorf("Metadata reindex failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
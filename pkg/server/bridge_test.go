@@ -0,0 +1,143 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/internal/testutil"
+	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// bridgeStream is a Watch_WatchServer that receives the requests written to it, and
+// records the responses sent to it.
+type bridgeStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	requests  chan *etcdserverpb.WatchRequest
+	responses chan *etcdserverpb.WatchResponse
+}
+
+func (s *bridgeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *bridgeStream) Send(wr *etcdserverpb.WatchResponse) error {
+	select {
+	case s.responses <- wr:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *bridgeStream) Recv() (*etcdserverpb.WatchRequest, error) {
+	select {
+	case r := <-s.requests:
+		return r, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// nextEvent returns the next event sent to the stream, skipping responses without events.
+func (s *bridgeStream) nextEvent(t *testing.T) *mvccpb.Event {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case wr := <-s.responses:
+			if len(wr.Events) > 0 {
+				return wr.Events[0]
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a watch event")
+		}
+	}
+}
+
+func TestWatchSelectorTransitions(t *testing.T) {
+	ctx, backend := testutil.NewBackend(t)
+
+	pod := testutil.NewPod("default", "web", "node1")
+	pod.Labels = map[string]string{"app": "web"}
+	value, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("failed to marshal pod: %v", err)
+	}
+	if _, err := backend.Create(ctx, testutil.PodKey(pod), value, 0); err != nil {
+		t.Fatalf("failed to create %s: %v", testutil.PodKey(pod), err)
+	}
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("failed to get current revision: %v", err)
+	}
+
+	streamCtx, cancel := context.WithCancel(metadata.NewIncomingContext(ctx, metadata.Pairs("kine-selector-transitions", "true")))
+	stream := &bridgeStream{
+		ctx:       streamCtx,
+		requests:  make(chan *etcdserverpb.WatchRequest, 1),
+		responses: make(chan *etcdserverpb.WatchResponse, 10),
+	}
+	done := make(chan error)
+	go func() {
+		done <- server.New(backend, "sqlite", time.Second, "").Watch(stream)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	stream.requests <- &etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+		CreateRequest: &etcdserverpb.WatchCreateRequest{
+			WatchId:       clientv3.AutoWatchID,
+			Key:           []byte(testutil.PodsPrefix),
+			RangeEnd:      []byte(testutil.PodsEnd),
+			StartRevision: rev + 1,
+			LabelSelector: "app=web",
+		},
+	}}
+	select {
+	case wr := <-stream.responses:
+		if !wr.Created {
+			t.Fatalf("expected the watch to be created, got %v", wr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the watch to be created")
+	}
+
+	relabel := func(app string) int64 {
+		t.Helper()
+		_, kv, err := backend.Get(ctx, testutil.PodKey(pod), 0, true)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", testutil.PodKey(pod), err)
+		}
+		pod.Labels["app"] = app
+		value, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatalf("failed to marshal pod: %v", err)
+		}
+		rev, _, _, err := backend.Update(ctx, testutil.PodKey(pod), value, kv.ModRevision, 0)
+		if err != nil {
+			t.Fatalf("failed to update %s: %v", testutil.PodKey(pod), err)
+		}
+		return rev
+	}
+
+	rev = relabel("db")
+	if e := stream.nextEvent(t); e.Type != mvccpb.DELETE || e.Kv.ModRevision != rev || e.PrevKv == nil {
+		t.Errorf("expected moving out of the selector to be a deletion at revision %d with a previous value, got %v", rev, e)
+	}
+
+	rev = relabel("web")
+	if e := stream.nextEvent(t); e.Type != mvccpb.PUT || e.Kv.ModRevision != rev || e.PrevKv != nil {
+		t.Errorf("expected moving into the selector to be a put at revision %d without a previous value, got %v", rev, e)
+	}
+}
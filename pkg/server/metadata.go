@@ -0,0 +1,33 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/k3s-io/kine/pkg/util"
+)
+
+// metadataMemo holds the metadata of a KeyValue once it has been decoded.
+type metadataMemo struct {
+	once     sync.Once
+	metadata *util.Metadata
+}
+
+// MemoizeMetadata makes Metadata decode the value of kv only once, and return the
+// same labels and fields to every caller, so that events sent to many watchers are
+// not decoded by each of them. It must be called before kv is shared, and the value
+// of kv must not change afterwards.
+func (kv *KeyValue) MemoizeMetadata() {
+	kv.metadata = &metadataMemo{}
+}
+
+// Metadata returns the labels and fields selectors match in the value of kv, or nil
+// if it is not a Kubernetes object.
+func (kv *KeyValue) Metadata() *util.Metadata {
+	if kv.metadata == nil {
+		return util.DecodeMetadata(kv.Key, kv.Value)
+	}
+	kv.metadata.once.Do(func() {
+		kv.metadata.metadata = util.DecodeMetadata(kv.Key, kv.Value)
+	})
+	return kv.metadata.metadata
+}
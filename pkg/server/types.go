@@ -3,6 +3,8 @@ package server
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"time"
 
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"google.golang.org/grpc/codes"
@@ -22,6 +24,10 @@ var (
 	ErrFutureRev     = rpctypes.ErrGRPCFutureRev
 	ErrNoLeader      = rpctypes.ErrGRPCNoLeader
 	ErrGRPCUnhealthy = rpctypes.ErrGRPCUnhealthy
+
+	ErrReindexNotSupported           = errors.New("backend does not index metadata")
+	ErrGarbageCollectionNotSupported = errors.New("backend does not collect garbage")
+	ErrRevisionAtNotSupported        = errors.New("backend does not record commit times")
 )
 
 const (
@@ -50,7 +56,7 @@ type Dialect interface {
 	CountCurrent(ctx context.Context, key, end string, labelSelector, fieldSelector string) (int64, int64, error)
 	Count(ctx context.Context, key, end string, revision int64, labelSelector, fieldSelector string) (int64, int64, int64, error)
 	CurrentRevision(ctx context.Context) (int64, error)
-	After(ctx context.Context, key, end string, rev, limit int64) (*sql.Rows, error)
+	After(ctx context.Context, key, end string, rev, limit int64, labelSelector, fieldSelector string) (*sql.Rows, error)
 	//nolint:revive
 	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error)
 	DeleteRevision(ctx context.Context, revision int64) error
@@ -64,6 +70,50 @@ type Dialect interface {
 	GetSize(ctx context.Context) (int64, error)
 	FillRetryDelay(ctx context.Context)
 	TranslateStartKey(startKey string) string
+	IndexesRevisionMetadata() bool
+}
+
+// Reindexer is implemented by backends that index the labels, fields and owners of
+// stored values apart from them, to rebuild that metadata when the way it is
+// extracted has changed.
+type Reindexer interface {
+	// Reindex rebuilds the metadata of the latest revision of every key under prefix,
+	// in batches of batchSize keys, resuming an unfinished reindex of prefix.
+	Reindex(ctx context.Context, prefix string, batchSize int64) error
+	// ReindexStale reindexes the key prefixes whose metadata was indexed with another
+	// configuration than the current one, and resumes unfinished reindexes.
+	ReindexStale(ctx context.Context, batchSize int64) error
+}
+
+// GarbageCollector is implemented by backends that garbage collect the dependents of
+// deleted objects themselves. The owners whose dependents are to be collected are
+// queued by the writes deleting them, and collected apart from those writes.
+type GarbageCollector interface {
+	// CollectGarbage collects the dependents of the queued owners until the queue is
+	// empty, unless another kine sharing the datastore holds the lease to collect them.
+	CollectGarbage(ctx context.Context) error
+	// SweepDanglingOwners queues the owners that are still referenced by objects but no
+	// longer exist, or only reports them with dryRun, and returns how many it found.
+	SweepDanglingOwners(ctx context.Context, dryRun bool) (int, error)
+}
+
+// RevisionResolver is implemented by backends that record when each revision was
+// committed, to read the keys as they were at a point in time.
+type RevisionResolver interface {
+	// RevisionAt returns the last revision committed at or before t, or 0 if there is
+	// none.
+	RevisionAt(ctx context.Context, t time.Time) (int64, error)
+}
+
+// PrefixCompactor is implemented by dialects that compact the keys under a prefix past
+// the compact revision of the other keys, so that they keep less history.
+type PrefixCompactor interface {
+	// CompactPrefix compacts the keys under prefix to revision, and returns the number
+	// of rows it deleted. ErrCompacted is returned if they already are.
+	CompactPrefix(ctx context.Context, prefix string, revision int64) (int64, error)
+	// PrefixCompactRevisions returns the revisions that the keys under each prefix
+	// were compacted to.
+	PrefixCompactRevisions(ctx context.Context) (map[string]int64, error)
 }
 
 type Transaction interface {
@@ -86,6 +136,8 @@ type KeyValue struct {
 	CreateRevision int64
 	ModRevision    int64
 	Lease          int64
+
+	metadata *metadataMemo
 }
 
 type Events []*Event
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"math/rand"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,11 +13,19 @@ import (
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/metadata"
 )
 
 const (
 	// progressResponsePeriod determines how often broadcast watch progress responses will be sent
 	progressResponsePeriod = 100 * time.Millisecond
+
+	// selectorTransitionsKey is the gRPC metadata key that opts the watches of a stream in
+	// to selector transition events: a modification that moves an object out of the
+	// selectors of a watch is sent as a deletion, and one that moves it in as a put
+	// without a previous value, so that clients keep a correct filtered view without
+	// matching the selectors themselves.
+	selectorTransitionsKey = "kine-selector-transitions"
 )
 
 var serverID int64
@@ -150,11 +159,21 @@ func (w *watcher) Create(ctx context.Context, r *etcdserverpb.WatchCreateRequest
 
 	logrus.Tracef("WATCH CREATE server=%d, id=%d, key=%s, end=%s revision=%d, progressNotify=%v, watchCount=%d", w.id, id, key, end, startRevision, r.ProgressNotify, len(w.watches))
 
+	var transitions *util.Selectors
+	if md, ok := metadata.FromIncomingContext(ctx); ok && slices.Contains(md.Get(selectorTransitionsKey), "true") {
+		var err error
+		if transitions, err = util.ParseSelectors(r.LabelSelector, r.FieldSelector); err != nil {
+			logrus.Warnf("WATCH CREATE server=%d, id=%d not sending selector transitions for invalid selectors: %v", w.id, id, err)
+		}
+	}
+
 	w.wg.Add(1)
-	go w.watch(ctx, key, end, id, startRevision, progressCh, r.LabelSelector, r.FieldSelector)
+	go w.watch(ctx, key, end, id, startRevision, progressCh, r.LabelSelector, r.FieldSelector, transitions)
 }
 
-func (w *watcher) watch(ctx context.Context, key, end string, id, startRevision int64, progressCh chan int64, labelSelector, fieldSelector string) {
+// watch sends the events of a watch until it is cancelled. If transitions is not empty,
+// modifications are sent as transitions in and out of its selectors.
+func (w *watcher) watch(ctx context.Context, key, end string, id, startRevision int64, progressCh chan int64, labelSelector, fieldSelector string, transitions *util.Selectors) {
 	defer w.wg.Done()
 	trace := logrus.IsLevelEnabled(logrus.TraceLevel)
 
@@ -224,7 +243,7 @@ func (w *watcher) watch(ctx context.Context, key, end string, id, startRevision
 			wr := &etcdserverpb.WatchResponse{
 				Header:  txnHeader(revision),
 				WatchId: id,
-				Events:  toEvents(events...),
+				Events:  toEvents(transitions, events...),
 			}
 			if trace {
 				keys := make([]string, len(wr.Events))
@@ -248,14 +267,43 @@ func (w *watcher) watch(ctx context.Context, key, end string, id, startRevision
 	logrus.Tracef("WATCH CLOSE server=%d, id=%d, key=%s", w.id, id, key)
 }
 
-func toEvents(events ...*Event) []*mvccpb.Event {
+func toEvents(transitions *util.Selectors, events ...*Event) []*mvccpb.Event {
 	ret := make([]*mvccpb.Event, 0, len(events))
 	for _, e := range events {
-		ret = append(ret, toEvent(e))
+		if transitions.Empty() {
+			ret = append(ret, toEvent(e))
+		} else {
+			ret = append(ret, toTransitionEvent(e, transitions))
+		}
 	}
 	return ret
 }
 
+// toTransitionEvent converts a modification that moves an object out of sel into an
+// etcd deletion of the previous value, and one that moves it into sel into a put
+// without a previous value. Other events, and those whose values are not Kubernetes
+// objects, are converted as they are.
+func toTransitionEvent(event *Event, sel *util.Selectors) *mvccpb.Event {
+	if event.Create || event.Delete || event.PrevKV == nil {
+		return toEvent(event)
+	}
+
+	md, prevMD := event.KV.Metadata(), event.PrevKV.Metadata()
+	if md == nil || prevMD == nil {
+		return toEvent(event)
+	}
+
+	switch matches, prevMatches := sel.Matches(md), sel.Matches(prevMD); {
+	case matches && !prevMatches:
+		return &mvccpb.Event{Type: mvccpb.PUT, Kv: toKV(event.KV)}
+	case !matches && prevMatches:
+		kv := toKV(event.KV)
+		kv.Value, kv.Version, kv.Lease, kv.CreateRevision = nil, 0, 0, 0
+		return &mvccpb.Event{Type: mvccpb.DELETE, Kv: kv, PrevKv: toKV(event.PrevKV)}
+	}
+	return toEvent(event)
+}
+
 func toEvent(event *Event) *mvccpb.Event {
 	e := &mvccpb.Event{Kv: toKV(event.KV)}
 	if !event.Create {
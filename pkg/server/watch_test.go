@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// podKV returns a revision of a pod labelled with app.
+func podKV(revision int64, app string) *KeyValue {
+	return &KeyValue{
+		Key:            "/registry/pods/default/web",
+		Value:          fmt.Appendf(nil, `{"apiVersion":"v1","kind":"Pod","metadata":{"namespace":"default","name":"web","labels":{"app":%q}}}`, app),
+		CreateRevision: 1,
+		ModRevision:    revision,
+		Version:        revision,
+	}
+}
+
+func TestToTransitionEvent(t *testing.T) {
+	sel, err := util.ParseSelectors("app=web", "")
+	if err != nil {
+		t.Fatalf("failed to parse selectors: %v", err)
+	}
+	plain := &KeyValue{Key: "/plain", Value: []byte("value"), CreateRevision: 1, ModRevision: 2}
+	plainPrev := &KeyValue{Key: "/plain", Value: []byte("previous"), CreateRevision: 1, ModRevision: 1}
+
+	for _, tc := range []struct {
+		name      string
+		event     *Event
+		wantType  mvccpb.Event_EventType
+		wantValue bool
+		wantPrev  bool
+	}{
+		{
+			name:      "moved in is a put without previous value",
+			event:     &Event{KV: podKV(2, "web"), PrevKV: podKV(1, "db")},
+			wantType:  mvccpb.PUT,
+			wantValue: true,
+		},
+		{
+			name:     "moved out is a deletion of the previous value",
+			event:    &Event{KV: podKV(2, "db"), PrevKV: podKV(1, "web")},
+			wantType: mvccpb.DELETE,
+			wantPrev: true,
+		},
+		{
+			name:      "still matching is a put",
+			event:     &Event{KV: podKV(2, "web"), PrevKV: podKV(1, "web")},
+			wantType:  mvccpb.PUT,
+			wantValue: true,
+			wantPrev:  true,
+		},
+		{
+			name:      "created is a put",
+			event:     &Event{Create: true, KV: podKV(1, "web")},
+			wantType:  mvccpb.PUT,
+			wantValue: true,
+		},
+		{
+			name:     "deleted is a deletion",
+			event:    &Event{Delete: true, KV: podKV(2, "web"), PrevKV: podKV(1, "web")},
+			wantType: mvccpb.DELETE,
+			// deletions keep the value of the row, as toEvent sends it
+			wantValue: true,
+			wantPrev:  true,
+		},
+		{
+			name:      "values that are not objects are sent as they are",
+			event:     &Event{KV: plain, PrevKV: plainPrev},
+			wantType:  mvccpb.PUT,
+			wantValue: true,
+			wantPrev:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := toTransitionEvent(tc.event, sel)
+			if got.Type != tc.wantType {
+				t.Errorf("expected a %v event, got %v", tc.wantType, got.Type)
+			}
+			if got.Kv.ModRevision != tc.event.KV.ModRevision {
+				t.Errorf("expected the event at revision %d, got %d", tc.event.KV.ModRevision, got.Kv.ModRevision)
+			}
+			if hasValue := len(got.Kv.Value) > 0; hasValue != tc.wantValue {
+				t.Errorf("expected a value: %v, got %q", tc.wantValue, got.Kv.Value)
+			}
+			if hasPrev := got.PrevKv != nil; hasPrev != tc.wantPrev {
+				t.Errorf("expected a previous value: %v, got %v", tc.wantPrev, got.PrevKv)
+			}
+		})
+	}
+}
+
+// watchBackend is a Backend whose watches send the events written to it, until they
+// are cancelled.
+type watchBackend struct {
+	Backend
+	events chan []*Event
+}
+
+func (b *watchBackend) Watch(ctx context.Context, key, end string, revision int64, labelSelector, fieldSelector string) WatchResult {
+	go func() {
+		<-ctx.Done()
+		close(b.events)
+	}()
+	return WatchResult{Events: b.events, Errorc: make(chan error)}
+}
+
+func (b *watchBackend) CurrentRevision(ctx context.Context) (int64, error) {
+	return 2, nil
+}
+
+// watchStream is a Watch_WatchServer that records the responses sent to it.
+type watchStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses chan *etcdserverpb.WatchResponse
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *watchStream) Send(wr *etcdserverpb.WatchResponse) error {
+	s.responses <- wr
+	return nil
+}
+
+func (s *watchStream) Recv() (*etcdserverpb.WatchRequest, error) {
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func TestWatchSelectorTransitionsAreOptIn(t *testing.T) {
+	moveOut := []*Event{{KV: podKV(2, "db"), PrevKV: podKV(1, "web")}}
+
+	for _, tc := range []struct {
+		name          string
+		md            metadata.MD
+		labelSelector string
+		want          mvccpb.Event_EventType
+	}{
+		{
+			name:          "not opted in",
+			labelSelector: "app=web",
+			want:          mvccpb.PUT,
+		},
+		{
+			name:          "opted in",
+			md:            metadata.Pairs(selectorTransitionsKey, "true"),
+			labelSelector: "app=web",
+			want:          mvccpb.DELETE,
+		},
+		{
+			name:          "invalid selector",
+			md:            metadata.Pairs(selectorTransitionsKey, "true"),
+			labelSelector: "app in (",
+			want:          mvccpb.PUT,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			if tc.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, tc.md)
+			}
+
+			backend := &watchBackend{events: make(chan []*Event, 1)}
+			w := watcher{
+				server:   &server{ws: &watchStream{ctx: ctx, responses: make(chan *etcdserverpb.WatchResponse, 10)}},
+				backend:  backend,
+				watches:  map[int64]func(){},
+				progress: map[int64]chan<- int64{},
+			}
+			defer w.Close()
+			responses := w.server.ws.(*watchStream).responses
+
+			w.Create(ctx, &etcdserverpb.WatchCreateRequest{
+				WatchId:       clientv3.AutoWatchID,
+				Key:           []byte("/registry/pods/"),
+				RangeEnd:      []byte("/registry/pods0"),
+				LabelSelector: tc.labelSelector,
+			})
+			backend.events <- moveOut
+
+			for {
+				select {
+				case wr := <-responses:
+					if len(wr.Events) == 0 {
+						continue
+					}
+					if got := wr.Events[0].Type; got != tc.want {
+						t.Errorf("expected a %v event, got %v", tc.want, got)
+					}
+					return
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for the event")
+				}
+			}
+		})
+	}
+}
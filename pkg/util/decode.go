@@ -0,0 +1,202 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+)
+
+var (
+	jsonDecoder = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+
+	// protobufPrefix is the magic number the apiserver writes in front of the
+	// runtime.Unknown envelope of protobuf-encoded objects.
+	protobufPrefix = []byte{0x6b, 0x38, 0x73, 0x00}
+
+	// encryptedPrefix starts every value written through an apiserver
+	// EncryptionConfiguration, followed by the provider and key name, e.g.
+	// k8s:enc:aescbc:v1:key1: or k8s:enc:kms:v2:provider:.
+	encryptedPrefix = []byte("k8s:enc:")
+)
+
+// protobufMessage is implemented by the generated protobuf code of all built-in types.
+type protobufMessage interface {
+	Unmarshal(data []byte) error
+}
+
+// IsProtobuf reports whether value is a protobuf-encoded Kubernetes object.
+func IsProtobuf(value []byte) bool {
+	return bytes.HasPrefix(value, protobufPrefix)
+}
+
+// IsEncrypted reports whether value was encrypted at rest by the apiserver.
+func IsEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, encryptedPrefix)
+}
+
+// DecodeObject decodes a stored value into the object returned by GetObjectByKey.
+// Values may be JSON, YAML or protobuf, the storage media types of the apiserver.
+//
+// Encrypted values cannot be read, so for them only the namespace and name are set,
+// as parsed from the key by NamespaceAndNameByKey.
+//
+// Protobuf values are unwrapped from their runtime.Unknown envelope and unmarshalled
+// directly, as the scheme used for JSON knows no types. Types without a dedicated
+// object decode into PartialObjectMetadata: every built-in type stores its
+// ObjectMeta as field 1, so only the metadata is read and the rest skipped.
+func DecodeObject(key string, value []byte) (runtime.Object, error) {
+	obj := GetObjectByKey(key)
+
+	if IsEncrypted(value) {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return nil, err
+		}
+		namespace, name := NamespaceAndNameByKey(key)
+		accessor.SetNamespace(namespace)
+		accessor.SetName(name)
+		return obj, nil
+	}
+
+	if !IsProtobuf(value) {
+		if _, _, err := jsonDecoder.Decode(value, nil, obj); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+
+	unknown := &runtime.Unknown{}
+	if err := unknown.Unmarshal(value[len(protobufPrefix):]); err != nil {
+		return nil, fmt.Errorf("failed to decode protobuf envelope of %s: %w", key, err)
+	}
+
+	msg, ok := obj.(protobufMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot decode protobuf into %T", obj)
+	}
+	if err := msg.Unmarshal(unknown.Raw); err != nil {
+		return nil, fmt.Errorf("failed to decode protobuf %s of %s: %w", unknown.Kind, key, err)
+	}
+	obj.GetObjectKind().SetGroupVersionKind(schema.FromAPIVersionAndKind(unknown.APIVersion, unknown.Kind))
+
+	return obj, nil
+}
+
+// UpdateProtobufObjectMeta applies update to the ObjectMeta of a protobuf-encoded
+// value, and returns the value encoded again. Only the metadata, field 1 of every
+// built-in type, is decoded and replaced: the other fields are kept as they were, so
+// that the objects of types without a dedicated object can be updated as well.
+func UpdateProtobufObjectMeta(value []byte, update func(*metav1.ObjectMeta)) ([]byte, error) {
+	unknown := &runtime.Unknown{}
+	if err := unknown.Unmarshal(value[len(protobufPrefix):]); err != nil {
+		return nil, fmt.Errorf("failed to decode protobuf envelope: %w", err)
+	}
+
+	var objectMeta *metav1.ObjectMeta
+	rest := []byte{}
+	for raw := unknown.Raw; len(raw) > 0; {
+		tag, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf field tag")
+		}
+		size, err := protobufFieldSize(tag, raw[n:])
+		if err != nil {
+			return nil, err
+		}
+		field := raw[:n+size]
+		raw = raw[n+size:]
+
+		if tag != 1<<3|2 {
+			rest = append(rest, field...)
+			continue
+		}
+		// the length of the metadata was checked by protobufFieldSize
+		length, m := binary.Uvarint(field[n:])
+		objectMeta = &metav1.ObjectMeta{}
+		if err := objectMeta.Unmarshal(field[n+m : n+m+int(length)]); err != nil {
+			return nil, fmt.Errorf("failed to decode protobuf %s metadata: %w", unknown.Kind, err)
+		}
+	}
+	if objectMeta == nil {
+		return nil, fmt.Errorf("protobuf %s has no metadata", unknown.Kind)
+	}
+
+	update(objectMeta)
+	encoded, err := objectMeta.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	raw := binary.AppendUvarint(nil, 1<<3|2)
+	raw = binary.AppendUvarint(raw, uint64(len(encoded)))
+	raw = append(raw, encoded...)
+	unknown.Raw = append(raw, rest...)
+
+	envelope, err := unknown.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append(bytes.Clone(protobufPrefix), envelope...), nil
+}
+
+// protobufFieldSize returns the size of the value of a protobuf field with tag, which
+// starts data.
+func protobufFieldSize(tag uint64, data []byte) (int, error) {
+	switch tag & 7 {
+	case 0:
+		if _, n := binary.Uvarint(data); n > 0 {
+			return n, nil
+		}
+	case 1:
+		if len(data) >= 8 {
+			return 8, nil
+		}
+	case 2:
+		if length, n := binary.Uvarint(data); n > 0 && length <= uint64(len(data)-n) {
+			return n + int(length), nil
+		}
+	case 5:
+		if len(data) >= 4 {
+			return 4, nil
+		}
+	default:
+		return 0, fmt.Errorf("unsupported protobuf wire type %d", tag&7)
+	}
+	return 0, errors.New("truncated protobuf field")
+}
+
+// NamespaceAndNameByKey parses the namespace and name of an object from its registry
+// key, /registry/<prefix>/[<namespace>/]<name>. The prefix of built-in resources is
+// looked up in the registry, as some are stored under two path segments; any other
+// prefix is <group>/<resource>, as only API groups that are not built in (and so
+// always contain a dot) are part of the key.
+func NamespaceAndNameByKey(key string) (namespace, name string) {
+	var parts []string
+	if _, rest := getBuiltinResource(key); rest != "" {
+		parts = strings.Split(rest, "/")
+	} else {
+		parts = strings.Split(strings.TrimPrefix(key, "/registry/"), "/")
+		if len(parts) > 0 && strings.Contains(parts[0], ".") {
+			parts = parts[1:]
+		}
+		if len(parts) > 0 {
+			parts = parts[1:]
+		}
+	}
+
+	switch len(parts) {
+	case 1:
+		return "", parts[0]
+	case 2:
+		return parts[0], parts[1]
+	default:
+		return "", ""
+	}
+}
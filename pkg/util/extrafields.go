@@ -0,0 +1,155 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ohler55/ojg/jp"
+	"github.com/ohler55/ojg/oj"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+// extraField is a field extracted by JSONPath from the values stored under a key prefix,
+// in addition to the field labels registered by the apiserver.
+type extraField struct {
+	prefix string
+	name   string
+	path   jp.Expr
+}
+
+var (
+	extraFields = atomic.Pointer[[]extraField]{}
+
+	// extraFieldNameRegex restricts field names to dotted identifiers, as they are
+	// used in field selectors and as JSON object keys in the dialects' path syntax.
+	extraFieldNameRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(\.[A-Za-z][A-Za-z0-9]*)*$`)
+)
+
+// LoadExtraFields reads the extra fields to index from a JSON file mapping registry key
+// prefixes to field names and the JSONPath expressions they are extracted with, e.g.
+//
+//	{"/registry/pods/": {"spec.priorityClassName": "$.spec.priorityClassName"}}
+func LoadExtraFields(file string) error {
+	jsonData, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	prefixes := map[string]map[string]string{}
+	if err := json.Unmarshal(jsonData, &prefixes); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+
+	return SetExtraFields(prefixes)
+}
+
+// SetExtraFields replaces the extra fields to index, given as field names and JSONPath
+// expressions by registry key prefix.
+func SetExtraFields(prefixes map[string]map[string]string) error {
+	fs := []extraField{}
+	for prefix, paths := range prefixes {
+		if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+			return fmt.Errorf("extra fields prefix %q must start and end with /", prefix)
+		}
+		for name, path := range paths {
+			if !extraFieldNameRegex.MatchString(name) {
+				return fmt.Errorf("extra field name %q under %s must be a dotted path of alphanumeric segments", name, prefix)
+			}
+			expr, err := jp.ParseString(path)
+			if err != nil {
+				return fmt.Errorf("extra field %s under %s: invalid JSONPath %q: %w", name, prefix, path, err)
+			}
+			fs = append(fs, extraField{prefix: prefix, name: name, path: expr})
+		}
+	}
+
+	slices.SortFunc(fs, func(a, b extraField) int {
+		return strings.Compare(a.prefix+" "+a.name, b.prefix+" "+b.name)
+	})
+	extraFields.Store(&fs)
+	bumpMetadataGeneration()
+
+	return nil
+}
+
+// GetExtraFields returns the names of the extra fields to index by registry key prefix.
+func GetExtraFields() map[string][]string {
+	names := map[string][]string{}
+	if fs := extraFields.Load(); fs != nil {
+		for _, f := range *fs {
+			names[f.prefix] = append(names[f.prefix], f.name)
+		}
+	}
+	return names
+}
+
+// getExtraFieldsSet extracts the extra fields configured for key from value. Fields whose
+// expression matches nothing are set to the empty string, so that values indexed with the
+// field can be told apart from those indexed before it was configured. Nothing is
+// extracted from values that cannot be read.
+func getExtraFieldsSet(key string, value []byte) fields.Set {
+	fs := extraFields.Load()
+	if fs == nil || IsEncrypted(value) {
+		return nil
+	}
+
+	var (
+		doc any
+		set fields.Set
+	)
+	for _, f := range *fs {
+		if !strings.HasPrefix(key, f.prefix) {
+			continue
+		}
+
+		if set == nil {
+			var err error
+			if doc, err = parseDocument(value); err != nil {
+				return nil
+			}
+			set = fields.Set{}
+		}
+
+		set[f.name] = ""
+		if results := f.path.Get(doc); len(results) > 0 {
+			set[f.name] = fmt.Sprintf("%v", results[0])
+		}
+	}
+
+	return set
+}
+
+// parseDocument parses value into generic JSON data for JSONPath queries. Protobuf
+// values are decoded into their typed object by the envelope's kind, and converted.
+func parseDocument(value []byte) (any, error) {
+	if !IsProtobuf(value) {
+		return oj.Parse(value)
+	}
+
+	unknown := &runtime.Unknown{}
+	if err := unknown.Unmarshal(value[len(protobufPrefix):]); err != nil {
+		return nil, err
+	}
+
+	obj, err := clientgoscheme.Scheme.New(schema.FromAPIVersionAndKind(unknown.APIVersion, unknown.Kind))
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := obj.(protobufMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot decode protobuf into %T", obj)
+	}
+	if err := msg.Unmarshal(unknown.Raw); err != nil {
+		return nil, err
+	}
+
+	return runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+}
@@ -0,0 +1,142 @@
+package util
+
+import (
+	"sync/atomic"
+
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// metadataGeneration is bumped whenever the fields selectable on a key may have
+// changed, so that metadata decoded before then is decoded again.
+var metadataGeneration atomic.Int64
+
+// MetadataGeneration returns the generation of the selectable fields. Metadata
+// decoded under an older generation may lack fields that are now selectable.
+func MetadataGeneration() int64 {
+	return metadataGeneration.Load()
+}
+
+func bumpMetadataGeneration() {
+	metadataGeneration.Add(1)
+}
+
+// Metadata holds the selectable labels and fields of a stored value, for drivers
+// that evaluate selectors in process instead of in SQL.
+type Metadata struct {
+	Labels labels.Set
+	Fields fields.Set
+}
+
+// DecodeMetadata extracts labels and fields from value the same way the SQL drivers
+// index them. It returns nil if value is not a Kubernetes object; such values never
+// match a non-empty selector, as the SQL drivers have no metadata rows for them.
+func DecodeMetadata(key string, value []byte) *Metadata {
+	if len(value) == 0 {
+		return nil
+	}
+
+	obj, err := DecodeObject(key, value)
+	if err != nil {
+		return nil
+	}
+
+	return &Metadata{
+		Labels: GetLabelsSetByObject(obj),
+		Fields: GetFieldsSetByObject(key, obj, value),
+	}
+}
+
+// CachedMetadata decodes the metadata of a stored value on first use, and again
+// after the selectable fields change.
+type CachedMetadata struct {
+	key     string
+	value   []byte
+	decoded atomic.Pointer[generationMetadata]
+}
+
+type generationMetadata struct {
+	generation int64
+	md         *Metadata
+}
+
+// NewCachedMetadata returns the lazily decoded metadata of value.
+func NewCachedMetadata(key string, value []byte) *CachedMetadata {
+	return &CachedMetadata{key: key, value: value}
+}
+
+// Get returns the metadata decoded under the current generation. A nil
+// *CachedMetadata has no metadata.
+func (c *CachedMetadata) Get() *Metadata {
+	if c == nil {
+		return nil
+	}
+
+	generation := MetadataGeneration()
+	if d := c.decoded.Load(); d != nil && d.generation == generation {
+		return d.md
+	}
+
+	md := DecodeMetadata(c.key, c.value)
+	c.decoded.Store(&generationMetadata{generation: generation, md: md})
+	return md
+}
+
+// Selectors is a parsed pair of label and field selectors. A nil *Selectors, or one
+// with nil members, matches everything.
+type Selectors struct {
+	Labels labels.Selector
+	Fields fields.Selector
+}
+
+// ParseSelectors parses the selectors passed to List, Count and Watch. It returns
+// nil if both are empty.
+func ParseSelectors(labelSelector, fieldSelector string) (*Selectors, error) {
+	if labelSelector == "" && fieldSelector == "" {
+		return nil, nil
+	}
+
+	s := &Selectors{}
+	if labelSelector != "" {
+		ls, err := labels.Parse(labelSelector)
+		if err != nil {
+			return nil, err
+		}
+		if !ls.Empty() {
+			s.Labels = ls
+		}
+	}
+	if fieldSelector != "" {
+		fs, err := fields.ParseSelector(fieldSelector)
+		if err != nil {
+			return nil, err
+		}
+		if !fs.Empty() {
+			s.Fields = fs
+		}
+	}
+
+	return s, nil
+}
+
+// Empty reports whether s matches everything.
+func (s *Selectors) Empty() bool {
+	return s == nil || (s.Labels == nil && s.Fields == nil)
+}
+
+// Matches reports whether md satisfies both selectors.
+func (s *Selectors) Matches(md *Metadata) bool {
+	if s.Empty() {
+		return true
+	}
+	if md == nil {
+		return false
+	}
+	if s.Labels != nil && !s.Labels.Matches(md.Labels) {
+		return false
+	}
+	if s.Fields != nil && !s.Fields.Matches(md.Fields) {
+		return false
+	}
+	return true
+}
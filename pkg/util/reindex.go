@@ -0,0 +1,56 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// MetadataVersion is the version of the way labels, fields and owners are extracted
+// from stored values. It must be bumped whenever that changes for values that are
+// already stored, for instance when field labels are added to a built-in resource,
+// so that the metadata indexed by earlier versions is rebuilt.
+//
+// Version 2 indexes each field value in a row of its own on mysql and sqlite.
+const MetadataVersion = 2
+
+// MetadataPrefixes returns the key prefixes whose metadata is extracted with a
+// configuration of their own, sorted: "/" for everything extracted the same way by
+// every kine of the same MetadataVersion, and the prefixes of the configured extra
+// fields and of the custom resources with selectable fields.
+func MetadataPrefixes() []string {
+	prefixes := []string{"/"}
+	for prefix := range GetExtraFields() {
+		prefixes = append(prefixes, prefix)
+	}
+	for _, groupPlural := range GetCustomResourceDefinitions() {
+		prefixes = append(prefixes, "/registry/"+groupPlural+"/")
+	}
+	slices.Sort(prefixes)
+	return slices.Compact(prefixes)
+}
+
+// MetadataFingerprint returns a digest of the configuration the metadata of the keys
+// under prefix is extracted with. The keys must be reindexed when it changes.
+func MetadataFingerprint(prefix string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "version %d\n", MetadataVersion)
+
+	if fs := extraFields.Load(); fs != nil {
+		for _, f := range *fs {
+			if f.prefix == prefix {
+				fmt.Fprintf(h, "extra %s %s\n", f.name, f.path.String())
+			}
+		}
+	}
+
+	if cr, ok := getCustomResource(prefix); ok {
+		fmt.Fprintf(h, "kind %s\n", cr.kind)
+		for _, field := range cr.fields {
+			fmt.Fprintf(h, "field %s\n", field)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
@@ -0,0 +1,284 @@
+package util
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	certv1 "k8s.io/api/certificates/v1"
+	certv1beta1 "k8s.io/api/certificates/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/api/resource/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// builtinResource describes how the values of a built-in resource are decoded, and
+// which field labels the apiserver accepts in field selectors for it.
+type builtinResource struct {
+	// prefix is the path of the resource under /registry/. It is the plural name of
+	// the resource, except for the few the apiserver stores under a legacy path.
+	prefix string
+	// newObject returns the object values are decoded into.
+	newObject func() runtime.Object
+	// fields returns the field labels of the resource besides metadata.name and
+	// metadata.namespace, which every resource has. It is nil if there are none.
+	fields func(obj runtime.Object) fields.Set
+}
+
+// typedResource is a resource with field labels besides the metadata ones, whose
+// values are decoded into P to read them.
+func typedResource[T any, P interface {
+	*T
+	runtime.Object
+}](prefix string, fn func(P) fields.Set) builtinResource {
+	r := objectResource[T, P](prefix)
+	r.fields = func(obj runtime.Object) fields.Set { return fn(obj.(P)) }
+	return r
+}
+
+// objectResource is a resource with only the metadata field labels, whose values are
+// decoded into P as kine reads more than their metadata.
+func objectResource[T any, P interface {
+	*T
+	runtime.Object
+}](prefix string) builtinResource {
+	return builtinResource{
+		prefix:    prefix,
+		newObject: func() runtime.Object { return P(new(T)) },
+	}
+}
+
+// metadataResource is a resource with only the metadata field labels, whose values
+// are decoded into PartialObjectMetadata.
+func metadataResource(prefix string) builtinResource {
+	return builtinResource{
+		prefix:    prefix,
+		newObject: func() runtime.Object { return &metav1.PartialObjectMetadata{} },
+	}
+}
+
+// builtinResources are the resources served by kube-apiserver, with the field labels
+// registered for each by its storage strategy.
+var builtinResources = []builtinResource{
+	// core
+	typedResource("pods", func(obj *corev1.Pod) fields.Set {
+		return fields.Set{
+			"spec.nodeName":            obj.Spec.NodeName,
+			"spec.restartPolicy":       string(obj.Spec.RestartPolicy),
+			"spec.schedulerName":       obj.Spec.SchedulerName,
+			"spec.serviceAccountName":  obj.Spec.ServiceAccountName,
+			"spec.hostNetwork":         fmt.Sprintf("%v", obj.Spec.HostNetwork),
+			"status.phase":             string(obj.Status.Phase),
+			"status.podIP":             obj.Status.PodIP,
+			"status.nominatedNodeName": obj.Status.NominatedNodeName,
+		}
+	}),
+	typedResource("events", func(obj *corev1.Event) fields.Set {
+		source := obj.Source.Component
+		if source == "" {
+			source = obj.ReportingController
+		}
+		return fields.Set{
+			"involvedObject.kind":            obj.InvolvedObject.Kind,
+			"involvedObject.namespace":       obj.InvolvedObject.Namespace,
+			"involvedObject.name":            obj.InvolvedObject.Name,
+			"involvedObject.uid":             string(obj.InvolvedObject.UID),
+			"involvedObject.apiVersion":      obj.InvolvedObject.APIVersion,
+			"involvedObject.resourceVersion": obj.InvolvedObject.ResourceVersion,
+			"involvedObject.fieldPath":       obj.InvolvedObject.FieldPath,
+			"reason":                         obj.Reason,
+			"reportingComponent":             obj.ReportingController,
+			"source":                         source,
+			"type":                           obj.Type,
+		}
+	}),
+	typedResource("secrets", func(obj *corev1.Secret) fields.Set {
+		return fields.Set{
+			"type": string(obj.Type),
+		}
+	}),
+	typedResource("namespaces", func(obj *corev1.Namespace) fields.Set {
+		return fields.Set{
+			"status.phase": string(obj.Status.Phase),
+			// kept by the apiserver for backwards compatibility
+			"name": obj.Name,
+		}
+	}),
+	typedResource("controllers", func(obj *corev1.ReplicationController) fields.Set {
+		return fields.Set{
+			"status.replicas": fmt.Sprintf("%d", obj.Status.Replicas),
+		}
+	}),
+	typedResource("minions", func(obj *corev1.Node) fields.Set {
+		return fields.Set{
+			"spec.unschedulable": fmt.Sprintf("%v", obj.Spec.Unschedulable),
+		}
+	}),
+	metadataResource("services/specs"),
+	metadataResource("services/endpoints"),
+	metadataResource("configmaps"),
+	metadataResource("serviceaccounts"),
+	metadataResource("persistentvolumes"),
+	metadataResource("persistentvolumeclaims"),
+	metadataResource("podtemplates"),
+	metadataResource("limitranges"),
+	metadataResource("resourcequotas"),
+
+	// apps
+	typedResource("replicasets", func(obj *appsv1.ReplicaSet) fields.Set {
+		return fields.Set{
+			"status.replicas": fmt.Sprintf("%d", obj.Status.Replicas),
+		}
+	}),
+	metadataResource("deployments"),
+	metadataResource("statefulsets"),
+	metadataResource("daemonsets"),
+	metadataResource("controllerrevisions"),
+
+	// batch
+	typedResource("jobs", func(obj *batchv1.Job) fields.Set {
+		return fields.Set{
+			"status.successful": fmt.Sprintf("%d", obj.Status.Succeeded),
+		}
+	}),
+	metadataResource("cronjobs"),
+
+	// certificates.k8s.io
+	typedResource("certificatesigningrequests", func(obj *certv1.CertificateSigningRequest) fields.Set {
+		return fields.Set{
+			"spec.signerName": obj.Spec.SignerName,
+		}
+	}),
+	typedResource("clustertrustbundles", func(obj *certv1beta1.ClusterTrustBundle) fields.Set {
+		return fields.Set{
+			"spec.signerName": obj.Spec.SignerName,
+		}
+	}),
+	typedResource("podcertificaterequests", func(obj *certv1beta1.PodCertificateRequest) fields.Set {
+		return fields.Set{
+			"spec.signerName": obj.Spec.SignerName,
+			"spec.podName":    obj.Spec.PodName,
+			"spec.nodeName":   string(obj.Spec.NodeName),
+		}
+	}),
+
+	// resource.k8s.io
+	typedResource("resourceslices", func(obj *resourcev1.ResourceSlice) fields.Set {
+		nodeName := ""
+		if obj.Spec.NodeName != nil {
+			nodeName = *obj.Spec.NodeName
+		}
+		return fields.Set{
+			"spec.nodeName": nodeName,
+			"spec.driver":   obj.Spec.Driver,
+		}
+	}),
+	metadataResource("resourceclaims"),
+	metadataResource("resourceclaimtemplates"),
+	metadataResource("deviceclasses"),
+
+	// admissionregistration.k8s.io
+	metadataResource("mutatingwebhookconfigurations"),
+	metadataResource("validatingwebhookconfigurations"),
+	metadataResource("mutatingadmissionpolicies"),
+	metadataResource("mutatingadmissionpolicybindings"),
+	metadataResource("validatingadmissionpolicies"),
+	metadataResource("validatingadmissionpolicybindings"),
+
+	// autoscaling
+	metadataResource("horizontalpodautoscalers"),
+
+	// coordination.k8s.io
+	metadataResource("leases"),
+	metadataResource("leasecandidates"),
+
+	// discovery.k8s.io
+	metadataResource("endpointslices"),
+
+	// flowcontrol.apiserver.k8s.io
+	metadataResource("flowschemas"),
+	metadataResource("prioritylevelconfigurations"),
+
+	// internal.apiserver.k8s.io
+	metadataResource("storageversions"),
+
+	// networking.k8s.io
+	metadataResource("ingress"),
+	metadataResource("ingressclasses"),
+	metadataResource("networkpolicies"),
+	metadataResource("ipaddresses"),
+	metadataResource("servicecidrs"),
+
+	// node.k8s.io
+	metadataResource("runtimeclasses"),
+
+	// policy
+	metadataResource("poddisruptionbudgets"),
+
+	// rbac.authorization.k8s.io
+	metadataResource("roles"),
+	metadataResource("rolebindings"),
+	metadataResource("clusterroles"),
+	metadataResource("clusterrolebindings"),
+
+	// scheduling.k8s.io
+	metadataResource("priorityclasses"),
+
+	// storage.k8s.io
+	metadataResource("storageclasses"),
+	metadataResource("volumeattachments"),
+	metadataResource("csidrivers"),
+	metadataResource("csinodes"),
+	metadataResource("csistoragecapacities"),
+	metadataResource("volumeattributesclasses"),
+
+	// storagemigration.k8s.io
+	metadataResource("storageversionmigrations"),
+
+	// served by the extension and aggregation apiservers, which keep the group in the path
+	objectResource[apiextensionsv1.CustomResourceDefinition]("apiextensions.k8s.io/customresourcedefinitions"),
+	metadataResource("apiregistration.k8s.io/apiservices"),
+}
+
+var (
+	builtinResourcesByPrefix = map[string]*builtinResource{}
+	builtinFieldsByType      = map[reflect.Type]func(runtime.Object) fields.Set{}
+)
+
+func init() {
+	for i := range builtinResources {
+		r := &builtinResources[i]
+		builtinResourcesByPrefix[r.prefix] = r
+		if r.fields != nil {
+			builtinFieldsByType[reflect.TypeOf(r.newObject())] = r.fields
+		}
+	}
+}
+
+// getBuiltinResource returns the built-in resource key is stored under, if any, and
+// the rest of the key after its prefix. Prefixes are one or two path segments long.
+func getBuiltinResource(key string) (*builtinResource, string) {
+	path, ok := strings.CutPrefix(key, "/registry/")
+	if !ok {
+		return nil, ""
+	}
+
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) == 3 {
+		if r, ok := builtinResourcesByPrefix[parts[0]+"/"+parts[1]]; ok {
+			return r, parts[2]
+		}
+	}
+	if len(parts) > 1 {
+		if r, ok := builtinResourcesByPrefix[parts[0]]; ok {
+			return r, strings.Join(parts[1:], "/")
+		}
+	}
+
+	return nil, ""
+}
@@ -1,24 +1,21 @@
 package util
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"path"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/alphadose/haxmap"
-	goplural "github.com/gertd/go-pluralize"
-	jsoniter "github.com/json-iterator/go"
 	"github.com/ohler55/ojg/jp"
 	"github.com/ohler55/ojg/oj"
 	"github.com/sirupsen/logrus"
-	appsv1 "k8s.io/api/apps/v1"
-	batchv1 "k8s.io/api/batch/v1"
-	certv1 "k8s.io/api/certificates/v1"
-	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
@@ -26,49 +23,39 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 )
 
+// customResource is the registry entry of a CRD.
+type customResource struct {
+	kind string
+	// fields are the JSONPaths, without the leading dot, of the fields selectable in
+	// any served version. Stored objects are indexed with all of them, unless
+	// versionFields is set, as selectors may be given in any served version while
+	// objects are stored in one.
+	fields []string
+	// queries are the parsed JSONPaths of fields, in the same order.
+	queries []jp.Expr
+	// versionFields are, with webhook conversion, the indexes in fields of the fields
+	// selectable in each served version. Objects are then only indexed with the fields
+	// of the version they are stored in, as the webhook may move the fields of other
+	// versions to other paths. It is nil without webhook conversion, as every version
+	// has the same schema.
+	versionFields map[string][]int
+}
+
 var (
-	customResourceDefsFile  = "./db/crds.json"
 	customResourceDefsMutex = sync.Mutex{}
-	customResourceDefs      = haxmap.New[string, []string]()
+	customResourceDefs      = atomic.Pointer[haxmap.Map[string, *customResource]]{}
 	customResourceKinds     = atomic.Pointer[[]string]{}
-	customResourceDefsOnce  sync.Once
-	pluralize               = goplural.NewClient()
 )
 
 func init() {
-	if crfd := os.Getenv("CUSTOM_RESOURCE_DEFINITION_METADATA_FILE"); crfd != "" {
-		customResourceDefsFile = crfd
-	}
+	customResourceDefs.Store(haxmap.New[string, *customResource]())
 }
 
-func getCustomResourceDefs() *haxmap.Map[string, []string] {
-	customResourceDefsOnce.Do(func() {
-		if err := os.MkdirAll(filepath.Dir(customResourceDefsFile), 0700); err != nil {
-			logrus.Fatalf("Directory creation failed: %v", err)
-		}
-
-		jsonData, err := os.ReadFile(customResourceDefsFile)
-		if err != nil {
-			if os.IsNotExist(err) {
-				return
-			}
-
-			logrus.Fatalf("Custom resource definition file read failed: %v", err)
-		}
-
-		crds := map[string][]string{}
-		if err := json.Unmarshal(jsonData, &crds); err != nil {
-			logrus.Fatalf("Custom resource definition file unmarshal failed: %v", err)
-		}
-
-		for k, v := range crds {
-			customResourceDefs.Set(k, v)
-		}
-	})
-
-	return customResourceDefs
+func getCustomResourceDefs() *haxmap.Map[string, *customResource] {
+	return customResourceDefs.Load()
 }
 
+// GetCustomResourceDefinitions returns the group/plural of the registered CRDs.
 func GetCustomResourceDefinitions() []string {
 	kinds := customResourceKinds.Load()
 	if kinds == nil {
@@ -84,324 +71,258 @@ func GetCustomResourceDefinitions() []string {
 	return *kinds
 }
 
-//nolint:revive
+// RegisterCustomResourceDefinition replaces the registry entry of a stored CRD with
+// its selectable fields, dropping the entry if it no longer has any.
 func RegisterCustomResourceDefinition(rawDef []byte) error {
-	def := map[string]any{}
-	err := jsoniter.Unmarshal(rawDef, &def)
+	groupPlural, cr, err := parseCustomResourceDefinition(rawDef)
 	if err != nil {
 		return err
 	}
 
-	cm := func(a any) map[string]any {
-		if a == nil {
-			return map[string]any{}
-		}
-		return a.(map[string]any)
+	customResourceDefsMutex.Lock()
+	defer customResourceDefsMutex.Unlock()
+
+	crds := getCustomResourceDefs()
+	if cr != nil {
+		crds.Set(groupPlural, cr)
+	} else {
+		crds.Del(groupPlural)
 	}
-	cs := func(a any) []any {
-		if a == nil {
-			return []any{}
+	storeCustomResourceKinds(crds)
+
+	return nil
+}
+
+// UnregisterCustomResourceDefinition drops the registry entry of the CRD stored under
+// key. CRDs are named <plural>.<group>, so the entry is found by the key alone.
+func UnregisterCustomResourceDefinition(key string) {
+	plural, group, ok := strings.Cut(path.Base(key), ".")
+	if !ok {
+		return
+	}
+
+	customResourceDefsMutex.Lock()
+	defer customResourceDefsMutex.Unlock()
+
+	crds := getCustomResourceDefs()
+	crds.Del(group + "/" + plural)
+	storeCustomResourceKinds(crds)
+}
+
+// ResetCustomResourceDefinitions replaces the registry with the selectable fields of
+// the given stored CRDs. CRDs that fail to parse are left out, and their errors
+// returned once the rest are registered.
+func ResetCustomResourceDefinitions(rawDefs [][]byte) error {
+	crds := haxmap.New[string, *customResource]()
+	errs := []error{}
+	for _, rawDef := range rawDefs {
+		groupPlural, cr, err := parseCustomResourceDefinition(rawDef)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if cr != nil {
+			crds.Set(groupPlural, cr)
 		}
-		return a.([]any)
 	}
 
-	group := cm(def["spec"])["group"]
-	plural := cm(cm(def["spec"])["names"])["plural"]
-	selectableFields := []string{}
-	for _, f := range cs(cm(def["spec"])["selectableFields"]) {
-		selectableFields = append(selectableFields, strings.TrimPrefix(cm(f)["jsonPath"].(string), "."))
+	customResourceDefsMutex.Lock()
+	defer customResourceDefsMutex.Unlock()
+
+	customResourceDefs.Store(crds)
+	storeCustomResourceKinds(crds)
+
+	return errors.Join(errs...)
+}
+
+// storeCustomResourceKinds caches the registered group/plural keys, and invalidates
+// the metadata decoded with the previous selectable fields.
+// Caller must hold customResourceDefsMutex.
+func storeCustomResourceKinds(crds *haxmap.Map[string, *customResource]) {
+	kinds := []string{}
+	for k := range crds.Keys() {
+		kinds = append(kinds, k)
 	}
+	customResourceKinds.Store(&kinds)
+	bumpMetadataGeneration()
+}
 
-	lockOnce := sync.Once{}
+// getCustomResource returns the registry entry of the custom resource stored under key,
+// /registry/<group>/<plural>/..., if its CRD has selectable fields.
+func getCustomResource(key string) (*customResource, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, "/registry/"), "/", 3)
+	if len(parts) < 3 || !strings.Contains(parts[0], ".") {
+		return nil, false
+	}
+	return getCustomResourceDefs().Get(parts[0] + "/" + parts[1])
+}
 
-	stored := false
-	for _, v := range cs(cm(def["spec"])["versions"]) {
-		versionSelectableFields := make([]string, len(selectableFields))
-		copy(versionSelectableFields, selectableFields)
+// customResourceDefinitionKey is a key under which CRDs are stored, to decode them by.
+const customResourceDefinitionKey = "/registry/apiextensions.k8s.io/customresourcedefinitions/"
 
-		for _, f := range cs(cm(v)["selectableFields"]) {
-			versionSelectableFields = append(versionSelectableFields, strings.TrimPrefix(cm(f)["jsonPath"].(string), "."))
-		}
+// parseCustomResourceDefinition returns the group/plural of a stored CRD, and its
+// registry entry, or nil if none of its served versions has selectable fields.
+func parseCustomResourceDefinition(rawDef []byte) (string, *customResource, error) {
+	if IsEncrypted(rawDef) {
+		return "", nil, errors.New("custom resource definition is encrypted")
+	}
+	obj, err := DecodeObject(customResourceDefinitionKey, rawDef)
+	if err != nil {
+		return "", nil, err
+	}
+	def, ok := obj.(*apiextensionsv1.CustomResourceDefinition)
+	if !ok {
+		return "", nil, fmt.Errorf("cannot decode custom resource definition into %T", obj)
+	}
 
-		if len(versionSelectableFields) == 0 {
+	name := def.Name
+	group := def.Spec.Group
+	plural := def.Spec.Names.Plural
+	kind := def.Spec.Names.Kind
+	if group == "" || plural == "" || kind == "" {
+		return "", nil, fmt.Errorf("custom resource definition %q has no group, plural or kind", name)
+	}
+
+	fields := []string{}
+	versionFields := map[string][]string{}
+	for _, v := range def.Spec.Versions {
+		if !v.Served {
 			continue
 		}
 
-		unlock := false
-		lockOnce.Do(func() {
-			unlock = true
-			customResourceDefsMutex.Lock()
-		})
-		if unlock {
-			defer customResourceDefsMutex.Unlock()
+		vfs := []string{}
+		for _, f := range v.SelectableFields {
+			vfs = append(vfs, strings.TrimPrefix(f.JSONPath, "."))
 		}
+		slices.Sort(vfs)
+		vfs = slices.Compact(vfs)
 
-		getCustomResourceDefs().Set(fmt.Sprintf("%s.%s/%s", cm(v)["name"].(string), group, plural.(string)), versionSelectableFields)
-		stored = true
-	}
-	if !stored {
-		return nil
+		versionFields[v.Name] = vfs
+		fields = append(fields, vfs...)
 	}
+	slices.Sort(fields)
+	fields = slices.Compact(fields)
 
-	kinds := []string{}
-	crds := map[string][]string{}
-	for k, v := range getCustomResourceDefs().Iterator() {
-		kinds = append(kinds, k)
-		crds[k] = v
+	if len(fields) == 0 {
+		return group + "/" + plural, nil, nil
 	}
 
-	customResourceKinds.Store(&kinds)
-
-	var jsonData []byte
-	if jsonData, err = jsoniter.Marshal(crds); err != nil {
-		return err
+	queries := make([]jp.Expr, len(fields))
+	for i, field := range fields {
+		query, err := jp.ParseString("$." + field)
+		if err != nil {
+			return "", nil, fmt.Errorf("custom resource definition %q has invalid selectable field %q: %w", name, field, err)
+		}
+		queries[i] = query
 	}
 
-	if err := os.WriteFile(customResourceDefsFile, jsonData, 0600); err != nil {
-		return err
+	cr := &customResource{kind: kind, fields: fields, queries: queries}
+	if def.Spec.Conversion != nil && def.Spec.Conversion.Strategy == apiextensionsv1.WebhookConverter {
+		cr.versionFields = map[string][]int{}
+		for version, vfs := range versionFields {
+			for _, field := range vfs {
+				i, _ := slices.BinarySearch(fields, field)
+				cr.versionFields[version] = append(cr.versionFields[version], i)
+			}
+			if len(vfs) != len(fields) {
+				logrus.Infof("Custom resource definition %s uses webhook conversion; objects stored in version %s are only indexed with its selectable fields %v", name, version, vfs)
+			}
+		}
 	}
 
-	return nil
+	return group + "/" + plural, cr, nil
 }
 
+// GetObjectByKey returns the object the value stored under key decodes into: the
+// typed object of built-in resources with field labels besides the metadata ones, and
+// PartialObjectMetadata for everything else.
 func GetObjectByKey(key string) runtime.Object {
-	switch {
-	case strings.HasPrefix(key, "/registry/pods/"):
-		return &corev1.Pod{}
-	case strings.HasPrefix(key, "/registry/events/"):
-		return &corev1.Event{}
-	case strings.HasPrefix(key, "/registry/secrets/"):
-		return &corev1.Secret{}
-	case strings.HasPrefix(key, "/registry/namespaces/"):
-		return &corev1.Namespace{}
-	case strings.HasPrefix(key, "/registry/replicasets/"):
-		return &appsv1.ReplicaSet{}
-	case strings.HasPrefix(key, "/registry/replicationcontrollers/"):
-		return &corev1.ReplicationController{}
-	case strings.HasPrefix(key, "/registry/jobs/"):
-		return &batchv1.Job{}
-	case strings.HasPrefix(key, "/registry/minions/"):
-		return &corev1.Node{}
-	case strings.HasPrefix(key, "/registry/certificatesigningrequests/"):
-		return &certv1.CertificateSigningRequest{}
-	default:
-		return &metav1.PartialObjectMetadata{}
+	if r, _ := getBuiltinResource(key); r != nil {
+		return r.newObject()
 	}
+	return &metav1.PartialObjectMetadata{}
 }
 
-func GetUIDByObject(obj runtime.Object) (uid types.UID) {
-	switch obj := obj.(type) {
-	case *corev1.Pod:
-		uid = obj.UID
-	case *corev1.Event:
-		uid = obj.UID
-	case *corev1.Secret:
-		uid = obj.UID
-	case *corev1.Namespace:
-		uid = obj.UID
-	case *appsv1.ReplicaSet:
-		uid = obj.UID
-	case *corev1.ReplicationController:
-		uid = obj.UID
-	case *batchv1.Job:
-		uid = obj.UID
-	case *corev1.Node:
-		uid = obj.UID
-	case *certv1.CertificateSigningRequest:
-		uid = obj.UID
-	case *metav1.PartialObjectMetadata:
-		uid = obj.UID
+func GetUIDByObject(obj runtime.Object) types.UID {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
 	}
-
-	return uid
+	return accessor.GetUID()
 }
 
-func GetFinalizersByObject(obj runtime.Object) (finalizers []string) {
-	switch obj := obj.(type) {
-	case *corev1.Pod:
-		finalizers = obj.Finalizers
-	case *corev1.Event:
-		finalizers = obj.Finalizers
-	case *corev1.Secret:
-		finalizers = obj.Finalizers
-	case *corev1.Namespace:
-		finalizers = obj.Finalizers
-	case *appsv1.ReplicaSet:
-		finalizers = obj.Finalizers
-	case *corev1.ReplicationController:
-		finalizers = obj.Finalizers
-	case *batchv1.Job:
-		finalizers = obj.Finalizers
-	case *corev1.Node:
-		finalizers = obj.Finalizers
-	case *certv1.CertificateSigningRequest:
-		finalizers = obj.Finalizers
-	case *metav1.PartialObjectMetadata:
-		finalizers = obj.Finalizers
-	default:
-		finalizers = nil
+func GetFinalizersByObject(obj runtime.Object) []string {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil
 	}
-
-	return finalizers
+	return accessor.GetFinalizers()
 }
 
 func GetOwnersByObject(obj runtime.Object) []metav1.OwnerReference {
-	switch obj := obj.(type) {
-	case *corev1.Pod:
-		return obj.OwnerReferences
-	case *corev1.Event:
-		return obj.OwnerReferences
-	case *corev1.Secret:
-		return obj.OwnerReferences
-	case *corev1.Namespace:
-		return obj.OwnerReferences
-	case *appsv1.ReplicaSet:
-		return obj.OwnerReferences
-	case *corev1.ReplicationController:
-		return obj.OwnerReferences
-	case *batchv1.Job:
-		return obj.OwnerReferences
-	case *corev1.Node:
-		return obj.OwnerReferences
-	case *certv1.CertificateSigningRequest:
-		return obj.OwnerReferences
-	case *metav1.PartialObjectMetadata:
-		return obj.OwnerReferences
-	default:
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
 		return []metav1.OwnerReference{}
 	}
+	return accessor.GetOwnerReferences()
 }
 
-func GetLabelsSetByObject(obj runtime.Object) (ls labels.Set) {
-	switch obj := obj.(type) {
-	case *corev1.Pod:
-		ls = labels.Set(obj.Labels)
-	case *corev1.Event:
-		ls = labels.Set(obj.Labels)
-	case *corev1.Secret:
-		ls = labels.Set(obj.Labels)
-	case *corev1.Namespace:
-		ls = labels.Set(obj.Labels)
-	case *appsv1.ReplicaSet:
-		ls = labels.Set(obj.Labels)
-	case *corev1.ReplicationController:
-		ls = labels.Set(obj.Labels)
-	case *batchv1.Job:
-		ls = labels.Set(obj.Labels)
-	case *corev1.Node:
-		ls = labels.Set(obj.Labels)
-	case *certv1.CertificateSigningRequest:
-		ls = labels.Set(obj.Labels)
-	case *metav1.PartialObjectMetadata:
-		ls = labels.Set(obj.Labels)
-	default:
-		ls = labels.Set{}
+func GetLabelsSetByObject(obj runtime.Object) labels.Set {
+	accessor, err := meta.Accessor(obj)
+	if err != nil || accessor.GetLabels() == nil {
+		return labels.Set{}
 	}
-
-	return ls
+	return labels.Set(accessor.GetLabels())
 }
 
-func GetFieldsSetByObject(obj runtime.Object, value []byte) (fs fields.Set) {
-	switch obj := obj.(type) {
-	case *corev1.Pod:
-		fs = fields.Set{
-			"metadata.name":            obj.Name,
-			"metadata.namespace":       obj.Namespace,
-			"spec.nodeName":            obj.Spec.NodeName,
-			"spec.restartPolicy":       string(obj.Spec.RestartPolicy),
-			"spec.schedulerName":       obj.Spec.SchedulerName,
-			"spec.serviceAccountName":  obj.Spec.ServiceAccountName,
-			"spec.hostNetwork":         fmt.Sprintf("%v", obj.Spec.HostNetwork),
-			"status.phase":             string(obj.Status.Phase),
-			"status.podIP":             obj.Status.PodIP,
-			"status.nominatedNodeName": obj.Status.NominatedNodeName,
-		}
-	case *corev1.Event:
-		fs = fields.Set{
-			"metadata.name":                  obj.Name,
-			"metadata.namespace":             obj.Namespace,
-			"involvedObject.kind":            obj.InvolvedObject.Kind,
-			"involvedObject.namespace":       obj.InvolvedObject.Namespace,
-			"involvedObject.name":            obj.InvolvedObject.Name,
-			"involvedObject.uid":             string(obj.InvolvedObject.UID),
-			"involvedObject.apiVersion":      obj.InvolvedObject.APIVersion,
-			"involvedObject.resourceVersion": obj.InvolvedObject.ResourceVersion,
-			"involvedObject.fieldPath":       obj.InvolvedObject.FieldPath,
-			"reason":                         obj.Reason,
-			"reportingComponent":             obj.ReportingController,
-			"source":                         obj.ReportingController,
-			"type":                           obj.Type,
-		}
-	case *corev1.Secret:
-		fs = fields.Set{
-			"metadata.name":      obj.Name,
-			"metadata.namespace": obj.Namespace,
-			"type":               string(obj.Type),
-		}
-	case *corev1.Namespace:
-		fs = fields.Set{
-			"metadata.name":      obj.Name,
-			"metadata.namespace": obj.Namespace,
-			"status.phase":       string(obj.Status.Phase),
-		}
-	case *appsv1.ReplicaSet:
-		fs = fields.Set{
-			"metadata.name":      obj.Name,
-			"metadata.namespace": obj.Namespace,
-			"status.replicas":    fmt.Sprintf("%d", obj.Status.Replicas),
-		}
-	case *corev1.ReplicationController:
-		fs = fields.Set{
-			"metadata.name":      obj.Name,
-			"metadata.namespace": obj.Namespace,
-			"status.replicas":    fmt.Sprintf("%d", obj.Status.Replicas),
-		}
-	case *batchv1.Job:
-		fs = fields.Set{
-			"metadata.name":      obj.Name,
-			"metadata.namespace": obj.Namespace,
-			"status.successful":  fmt.Sprintf("%d", obj.Status.Succeeded),
-		}
-	case *corev1.Node:
-		fs = fields.Set{
-			"metadata.name":      obj.Name,
-			"metadata.namespace": obj.Namespace,
-			"spec.unschedulable": fmt.Sprintf("%v", obj.Spec.Unschedulable),
-		}
-	case *certv1.CertificateSigningRequest:
-		fs = fields.Set{
-			"metadata.name":      obj.Name,
-			"metadata.namespace": obj.Namespace,
-			"spec.signerName":    obj.Spec.SignerName,
+// GetFieldsSetByObject returns the fields of obj, decoded from the value stored under
+// key, that field selectors can match: the field labels of its resource, and the
+// extra fields configured for key.
+func GetFieldsSetByObject(key string, obj runtime.Object, value []byte) (fs fields.Set) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return fields.Set{}
+	}
+
+	fs = fields.Set{
+		"metadata.name":      accessor.GetName(),
+		"metadata.namespace": accessor.GetNamespace(),
+	}
+
+	// the other fields of encrypted values are unknown, so they are not indexed
+	// rather than indexed as empty
+	if IsEncrypted(value) {
+		return fs
+	}
+
+	for k, v := range getExtraFieldsSet(key, value) {
+		fs[k] = v
+	}
+
+	if resourceFields, ok := builtinFieldsByType[reflect.TypeOf(obj)]; ok {
+		for k, v := range resourceFields(obj) {
+			fs[k] = v
 		}
-	case *metav1.PartialObjectMetadata:
-		fs = fields.Set{
-			"metadata.name":      obj.Name,
-			"metadata.namespace": obj.Namespace,
+		return fs
+	}
+
+	// custom resources are always stored as JSON
+	if cr, ok := getCustomResource(key); ok && !IsProtobuf(value) && obj.GetObjectKind().GroupVersionKind().Kind == cr.kind {
+		version := obj.GetObjectKind().GroupVersionKind().Version
+		obj, err := oj.Parse(value)
+		if err != nil {
+			logrus.Errorf("Failed to parse %s, its selectable fields are not indexed: %v", key, err)
+			return fs
 		}
 
-		if obj.Name != "" && strings.Contains(obj.APIVersion, "/") {
-			apiVer := strings.Split(obj.APIVersion, "/")
-			if customFields, ok := getCustomResourceDefs().Get(fmt.Sprintf("%s.%s/%s", apiVer[1], apiVer[0], pluralize.Plural(strings.ToLower(obj.Kind)))); ok {
-				obj, err := oj.ParseString(string(value))
-				if err != nil {
-					logrus.Fatalf("Object parse failed: %v", err)
-				}
-
-				for _, field := range customFields {
-					query, err := jp.ParseString("$." + field)
-					if err != nil {
-						logrus.Fatalf("JSON query parse failed: %v", err)
-					}
-
-					if fiedlValue := query.Get(obj); len(fiedlValue) > 0 {
-						fs[field] = fmt.Sprintf("%v", fiedlValue[0])
-					}
-				}
+		for i, field := range cr.fields {
+			if cr.versionFields != nil && !slices.Contains(cr.versionFields[version], i) {
+				continue
+			}
+			if fieldValue := cr.queries[i].Get(obj); len(fieldValue) > 0 {
+				fs[field] = fmt.Sprintf("%v", fieldValue[0])
 			}
 		}
-	default:
-		fs = fields.Set{}
 	}
 
 	return fs
@@ -0,0 +1,242 @@
+package util
+
+import (
+	"encoding/json"
+	"maps"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/api/resource/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+)
+
+func TestBuiltinResourceFields(t *testing.T) {
+	nodeName := "node1"
+	for _, tc := range []struct {
+		key  string
+		obj  runtime.Object
+		want fields.Set
+	}{
+		{
+			key: "/registry/events/default/scheduled",
+			obj: &corev1.Event{
+				ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: "scheduled"},
+				InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web"},
+				Reason:         "Scheduled",
+				Source:         corev1.EventSource{Component: "default-scheduler"},
+				Type:           corev1.EventTypeNormal,
+			},
+			want: fields.Set{"involvedObject.name": "web", "reason": "Scheduled", "source": "default-scheduler", "type": "Normal"},
+		},
+		{
+			key: "/registry/events/default/pulled",
+			obj: &corev1.Event{
+				ObjectMeta:          metav1.ObjectMeta{Namespace: "default", Name: "pulled"},
+				Reason:              "Pulled",
+				ReportingController: "kubelet",
+			},
+			want: fields.Set{"source": "kubelet", "reportingComponent": "kubelet"},
+		},
+		{
+			key: "/registry/namespaces/default",
+			obj: &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: "default"},
+				Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceActive},
+			},
+			want: fields.Set{"name": "default", "status.phase": "Active"},
+		},
+		{
+			key: "/registry/controllers/default/web",
+			obj: &corev1.ReplicationController{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Status:     corev1.ReplicationControllerStatus{Replicas: 3},
+			},
+			want: fields.Set{"status.replicas": "3"},
+		},
+		{
+			key: "/registry/resourceslices/node1-gpu",
+			obj: &resourcev1.ResourceSlice{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1-gpu"},
+				Spec:       resourcev1.ResourceSliceSpec{Driver: "gpu.example.com", NodeName: &nodeName},
+			},
+			want: fields.Set{"spec.nodeName": "node1", "spec.driver": "gpu.example.com"},
+		},
+	} {
+		t.Run(tc.key, func(t *testing.T) {
+			value, err := json.Marshal(tc.obj)
+			if err != nil {
+				t.Fatalf("failed to marshal %s: %v", tc.key, err)
+			}
+			md := DecodeMetadata(tc.key, value)
+			if md == nil {
+				t.Fatalf("failed to decode %s", tc.key)
+			}
+			for k, v := range tc.want {
+				if got, ok := md.Fields[k]; !ok || got != v {
+					t.Errorf("expected field %s=%q, got %v", k, v, md.Fields)
+				}
+			}
+		})
+	}
+
+	// services are stored under a two-segment prefix, so the namespace and name of
+	// encrypted ones can only be parsed from the key with the registry
+	md := DecodeMetadata("/registry/services/specs/default/web", []byte("k8s:enc:aescbc:v1:key1:\xff\x00"))
+	if want := (fields.Set{"metadata.name": "web", "metadata.namespace": "default"}); md == nil || !maps.Equal(want, md.Fields) {
+		t.Errorf("expected the fields of an encrypted service to be %v, got %v", want, md)
+	}
+}
+
+func TestProtobufCustomResourceDefinitionsAreRegistered(t *testing.T) {
+	t.Cleanup(func() {
+		_ = ResetCustomResourceDefinitions(nil)
+	})
+
+	scheme := runtime.NewScheme()
+	if err := apiextensionsv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to build scheme: %v", err)
+	}
+
+	crd := &apiextensionsv1.CustomResourceDefinition{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apiextensions.k8s.io/v1", Kind: "CustomResourceDefinition"},
+		ObjectMeta: metav1.ObjectMeta{Name: "gizmos.example.com"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "example.com",
+			Names: apiextensionsv1.CustomResourceDefinitionNames{Plural: "gizmos", Kind: "Gizmo"},
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{{
+				Name:             "v1",
+				Served:           true,
+				Storage:          true,
+				SelectableFields: []apiextensionsv1.SelectableField{{JSONPath: ".spec.color"}},
+			}},
+		},
+	}
+	value, err := runtime.Encode(protobuf.NewSerializer(scheme, scheme), crd)
+	if err != nil {
+		t.Fatalf("failed to encode crd: %v", err)
+	}
+	if !IsProtobuf(value) {
+		t.Fatalf("expected a protobuf value")
+	}
+	if err := RegisterCustomResourceDefinition(value); err != nil {
+		t.Fatalf("failed to register crd: %v", err)
+	}
+
+	md := DecodeMetadata("/registry/example.com/gizmos/default/red", []byte(`{"apiVersion":"example.com/v1","kind":"Gizmo","metadata":{"namespace":"default","name":"red"},"spec":{"color":"red"}}`))
+	if md == nil || md.Fields["spec.color"] != "red" {
+		t.Fatalf("expected spec.color to be selectable, got %v", md)
+	}
+}
+
+func TestUnparsableCustomResourcesKeepBuiltinFields(t *testing.T) {
+	t.Cleanup(func() {
+		_ = ResetCustomResourceDefinitions(nil)
+	})
+
+	crd := `{"apiVersion":"apiextensions.k8s.io/v1","kind":"CustomResourceDefinition",` +
+		`"metadata":{"name":"widgets.example.com"},` +
+		`"spec":{"group":"example.com","names":{"plural":"widgets","kind":"Widget"},` +
+		`"versions":[{"name":"v1","served":true,"storage":true,"selectableFields":[{"jsonPath":".spec.color"}]}]}}`
+	if err := RegisterCustomResourceDefinition([]byte(crd)); err != nil {
+		t.Fatalf("failed to register crd: %v", err)
+	}
+
+	obj := &metav1.PartialObjectMetadata{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "example.com/v1", Kind: "Widget"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "red"},
+	}
+	got := GetFieldsSetByObject("/registry/example.com/widgets/default/red", obj, []byte("{not json"))
+	want := fields.Set{"metadata.name": "red", "metadata.namespace": "default"}
+	if !maps.Equal(want, got) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestCustomResourceDefinitionFields(t *testing.T) {
+	t.Cleanup(func() {
+		_ = ResetCustomResourceDefinitions(nil)
+	})
+
+	const key = "/registry/example.com/cacti/default/first"
+	crd := func(betaFields string) []byte {
+		return []byte(`{"apiVersion":"apiextensions.k8s.io/v1","kind":"CustomResourceDefinition",` +
+			`"metadata":{"name":"cacti.example.com"},` +
+			`"spec":{"group":"example.com","names":{"plural":"cacti","kind":"Cactus"},"versions":[` +
+			`{"name":"v1","served":true,"storage":true,"selectableFields":[{"jsonPath":".spec.color"}]},` +
+			`{"name":"v1beta1","served":true,"storage":false,"selectableFields":[` + betaFields + `]},` +
+			`{"name":"v1alpha1","served":false,"storage":false,"selectableFields":[{"jsonPath":".spec.secret"}]}]}}`)
+	}
+	value := []byte(`{"apiVersion":"example.com/v1","kind":"Cactus","metadata":{"namespace":"default","name":"first"},` +
+		`"spec":{"color":"green","size":"small","secret":"x"}}`)
+	expectFields := func(want fields.Set) {
+		t.Helper()
+		if md := DecodeMetadata(key, value); md == nil || !maps.Equal(want, md.Fields) {
+			t.Errorf("expected fields %v, got %v", want, md)
+		}
+	}
+
+	// the fields of every served version are indexed, and those of others are not
+	if err := RegisterCustomResourceDefinition(crd(`{"jsonPath":".spec.size"}`)); err != nil {
+		t.Fatalf("failed to register crd: %v", err)
+	}
+	expectFields(fields.Set{"metadata.name": "first", "metadata.namespace": "default", "spec.color": "green", "spec.size": "small"})
+
+	// fields removed from the crd are no longer indexed
+	if err := RegisterCustomResourceDefinition(crd("")); err != nil {
+		t.Fatalf("failed to register crd: %v", err)
+	}
+	expectFields(fields.Set{"metadata.name": "first", "metadata.namespace": "default", "spec.color": "green"})
+
+	// unregistered crds are found by their key
+	UnregisterCustomResourceDefinition("/registry/apiextensions.k8s.io/customresourcedefinitions/cacti.example.com")
+	expectFields(fields.Set{"metadata.name": "first", "metadata.namespace": "default"})
+}
+
+func TestWebhookConvertedCustomResourcesAreIndexedByStoredVersion(t *testing.T) {
+	t.Cleanup(func() {
+		_ = ResetCustomResourceDefinitions(nil)
+	})
+
+	crd := func(conversion string) []byte {
+		return []byte(`{"apiVersion":"apiextensions.k8s.io/v1","kind":"CustomResourceDefinition",` +
+			`"metadata":{"name":"widgets.example.com"},` +
+			`"spec":{"group":"example.com","names":{"plural":"widgets","kind":"Widget"},` + conversion +
+			`"versions":[{"name":"v1","served":true,"storage":true,"selectableFields":[{"jsonPath":".spec.color"}]},` +
+			`{"name":"v2","served":true,"storage":false,"selectableFields":[{"jsonPath":".spec.colour"}]}]}}`)
+	}
+	value := []byte(`{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"namespace":"default","name":"red"},` +
+		`"spec":{"color":"red","colour":"blue"}}`)
+	obj := &metav1.PartialObjectMetadata{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "example.com/v1", Kind: "Widget"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "red"},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		conversion string
+		want       fields.Set
+	}{
+		{
+			name: "no conversion",
+			want: fields.Set{"metadata.name": "red", "metadata.namespace": "default", "spec.color": "red", "spec.colour": "blue"},
+		},
+		{
+			name:       "webhook conversion",
+			conversion: `"conversion":{"strategy":"Webhook"},`,
+			want:       fields.Set{"metadata.name": "red", "metadata.namespace": "default", "spec.color": "red"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := RegisterCustomResourceDefinition(crd(tc.conversion)); err != nil {
+				t.Fatalf("failed to register crd: %v", err)
+			}
+			if got := GetFieldsSetByObject("/registry/example.com/widgets/default/red", obj, value); !maps.Equal(tc.want, got) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}